@@ -61,11 +61,13 @@ func LeasesDownloadFromAerospike() (err error) {
 			IP:      IP,
 			MAC:     MAC,
 			Expires: Expires,
+			Bound:   true, // Only ACKed leases are stored
 		}
 
 		if _, ok = Subnet.LeasesByMAC[MAC]; !ok {
 			Subnet.LeasesByMAC[MAC] = Lease
 			Subnet.LeasesByIP[IP] = Lease
+			Subnet.AddrUse(IP)
 		} else {
 			Duplicates++
 			continue
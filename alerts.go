@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+type UtilLevel int
+
+const (
+	UTIL_OK UtilLevel = iota
+	UTIL_WARNING
+	UTIL_CRITICAL
+)
+
+// Reached level is kept until utilization drops this many percents below its threshold, to avoid flapping
+const UTIL_HYSTERESIS = 2.0
+
+var AlertsWebhook *Webhook
+
+func (l UtilLevel) String() string {
+	switch l {
+	case UTIL_WARNING:
+		return "warning"
+	case UTIL_CRITICAL:
+		return "critical"
+	}
+
+	return "ok"
+}
+
+func (l UtilLevel) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// Pool utilization thresholds in percents of capacity, zero ones are disabled.
+// Zero fields of subnet's thresholds are inherited from segment's ones
+type UtilThresholds struct {
+	Warning  float64 `json:"warning"`
+	Critical float64 `json:"critical"`
+}
+
+func (t UtilThresholds) Merge(Override UtilThresholds) UtilThresholds {
+	if Override.Warning > 0 {
+		t.Warning = Override.Warning
+	}
+
+	if Override.Critical > 0 {
+		t.Critical = Override.Critical
+	}
+
+	return t
+}
+
+func (t UtilThresholds) Validate() error {
+	if t.Warning < 0 || t.Warning > 100 || t.Critical < 0 || t.Critical > 100 {
+		return fmt.Errorf("util_warning (%g) and util_critical (%g) should be within 0 - 100", t.Warning, t.Critical)
+	}
+
+	if t.Warning > 0 && t.Critical > 0 && t.Warning >= t.Critical {
+		return fmt.Errorf("util_warning (%g) should be less than util_critical (%g)", t.Warning, t.Critical)
+	}
+
+	return nil
+}
+
+func (t UtilThresholds) String() string {
+	return fmt.Sprintf("warning %g%%, critical %g%%", t.Warning, t.Critical)
+}
+
+func (t UtilThresholds) Level(Util float64, Prev UtilLevel) UtilLevel {
+	for _, v := range []struct {
+		Level     UtilLevel
+		Threshold float64
+	}{
+		{UTIL_CRITICAL, t.Critical},
+		{UTIL_WARNING, t.Warning},
+	} {
+		if v.Threshold <= 0 {
+			continue
+		}
+
+		if Util >= v.Threshold || (Prev >= v.Level && Util > v.Threshold-UTIL_HYSTERESIS) {
+			return v.Level
+		}
+	}
+
+	return UTIL_OK
+}
+
+// Fired when subnet's utilization level changes, sent to webhook as is
+type UtilAlert struct {
+	Time     time.Time `json:"time"`
+	ServerID string    `json:"server_id"`
+	Segment  string    `json:"segment"`
+	Subnet   string    `json:"subnet"`
+
+	Level     UtilLevel `json:"level"`
+	PrevLevel UtilLevel `json:"prev_level"`
+
+	Utilization  float64        `json:"utilization"`
+	LeasesActive int            `json:"leases_active"`
+	Capacity     int            `json:"capacity"`
+	Thresholds   UtilThresholds `json:"thresholds"`
+}
+
+func AlertsInit() (err error) {
+	if o.AlertsWebhook != "" {
+		AlertsWebhook = NewWebhook("alerts", o.AlertsWebhook, o.AlertsWebhookTimeout, o.AlertsWebhookRetries)
+		log.Warnf("Alerts: Sending to webhook %s", o.AlertsWebhook)
+	}
+
+	return
+}
+
+// Percents of the pool occupied by active leases (assumes locked subnet)
+func (s *Subnet) UtilizationNoLock() float64 {
+	if s.CapacityCount == 0 {
+		return 0
+	}
+
+	return float64(s.LeasesActiveCount) * 100 / float64(s.CapacityCount)
+}
+
+func (s *Subnet) Alert() UtilLevel {
+	s.RLock()
+	defer s.RUnlock()
+	return s.AlertLevel
+}
+
+// Marks the subnet as having no free addresses, called without subnet lock
+func (s *Subnet) NoFreeSet(t time.Time) {
+	atomic.StoreInt64(&s.NoFreeLast, t.UnixNano())
+}
+
+func (s *Subnet) NoFreeGet() (t time.Time) {
+	if ns := atomic.LoadInt64(&s.NoFreeLast); ns > 0 {
+		t = time.Unix(0, ns)
+	}
+
+	return
+}
+
+// Updates subnet's alert level from the current stats (assumes locked subnet with updated stats),
+// returns the alert if the level was changed
+func (s *Subnet) AlertEvaluateNoLock(Segment *Segment) (a *UtilAlert) {
+	t := Segment.Util.Merge(s.Util)
+	Util := s.UtilizationNoLock()
+
+	Level := t.Level(Util, s.AlertLevel)
+	if Level == s.AlertLevel {
+		return
+	}
+
+	a = &UtilAlert{
+		Time:     time.Now(),
+		ServerID: o.ServerID,
+		Segment:  Segment.Name,
+		Subnet:   s.NetStr,
+
+		Level:     Level,
+		PrevLevel: s.AlertLevel,
+
+		Utilization:  Util,
+		LeasesActive: s.LeasesActiveCount,
+		Capacity:     s.CapacityCount,
+		Thresholds:   t,
+	}
+
+	s.AlertLevel = Level
+	return
+}
+
+// Sends the alert to log, webhook and metrics
+func AlertFire(a *UtilAlert) {
+	if a.Level > a.PrevLevel {
+		log.Warnf("Alert: Subnet %s (%s) utilization %.1f%% (%d/%d leases) crossed %s threshold (%s)",
+			a.Subnet, a.Segment, a.Utilization, a.LeasesActive, a.Capacity, a.Level, a.Thresholds)
+	} else {
+		log.Warnf("Alert: Subnet %s (%s) utilization %.1f%% (%d/%d leases) recovered from %s to %s",
+			a.Subnet, a.Segment, a.Utilization, a.LeasesActive, a.Capacity, a.PrevLevel, a.Level)
+	}
+
+	if AlertsWebhook != nil {
+		AlertsWebhook.Send(a)
+	}
+
+	MetricsSendAlert(a)
+}
+
+// Lists subnets above utilization thresholds or which had no free addresses during the Period
+func AlertsDumpExhausted(Period time.Duration) string {
+	type Row struct {
+		Segment *Segment
+		Subnet  *Subnet
+		Util    float64
+		Active  int
+		Level   UtilLevel
+		NoFree  time.Time
+	}
+
+	var (
+		b    bytes.Buffer
+		Rows []Row
+		Now  = time.Now()
+	)
+
+	CacheReloadingMtx.RLock()
+	for _, Seg := range o.SegmentsOrdered {
+		Seg.RLock()
+		for _, Net := range Seg.Subnets {
+			Net.RLock()
+			r := Row{
+				Segment: Seg,
+				Subnet:  Net,
+				Util:    Net.UtilizationNoLock(),
+				Active:  Net.LeasesActiveCount,
+				Level:   Net.AlertLevel,
+				NoFree:  Net.NoFreeGet(),
+			}
+			Net.RUnlock()
+
+			if r.Level > UTIL_OK || Now.Sub(r.NoFree) <= Period {
+				Rows = append(Rows, r)
+			}
+		}
+		Seg.RUnlock()
+	}
+	CacheReloadingMtx.RUnlock()
+
+	// Most utilized first
+	sort.Slice(Rows, func(i, j int) bool {
+		return Rows[i].Util > Rows[j].Util
+	})
+
+	w := tabwriter.NewWriter(&b, 0, 0, 3, ' ', 0)
+	fmt.Fprintf(w, "Subnets above utilization thresholds or without free addresses during the last %s:\n", Period)
+	fmt.Fprintf(w, " Segment\tSubnet\tUtilization\tLeases active/total\tLevel\tNo free addresses\n")
+
+	for _, r := range Rows {
+		NoFree := "-"
+		if !r.NoFree.IsZero() {
+			NoFree = fmt.Sprintf("%s ago", Now.Sub(r.NoFree))
+		}
+
+		fmt.Fprintf(w, " %s\t%s\t%.1f%%\t%d/%d\t%s\t%s\n", r.Segment.Name, r.Subnet.NetStr, r.Util, r.Active, r.Subnet.Capacity(), r.Level, NoFree)
+	}
+
+	w.Flush()
+	return b.String()
+}
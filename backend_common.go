@@ -1,13 +1,39 @@
 package main
 
+import (
+	"fmt"
+)
+
+const (
+	BACKEND_HASH = "hash"
+	BACKEND_DISK = "disk"
+)
+
 type Backend interface {
 	Init() error
+	Load() error
+	SelfTest() error
+	SubnetStore(*Segment, *Subnet) error
 	LeaseCheckAndDelete(*ReqCtx) error
 	LeaseCheckAndUpdate(*ReqCtx) error
 	LeaseFind(*ReqCtx) error
 }
 
 // Constructor
-func ConstructBackend() Backend {
-	return &BackendHash{}
+func ConstructBackend(Type string) (b Backend, err error) {
+	switch Type {
+	case BACKEND_HASH:
+		b = &BackendHash{
+			LeaseStore:  LeaseUploadToAerospike,
+			LeaseRemove: LeaseDeleteFromAerospike,
+		}
+
+	case BACKEND_DISK:
+		b, err = NewBackendDisk(o.DHCPDiskPath)
+
+	default:
+		err = fmt.Errorf("Unknown backend type '%s'", Type)
+	}
+
+	return
 }
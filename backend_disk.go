@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	aux "mt-aux"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+)
+
+var (
+	BoltBucketLeases  = []byte("leases")
+	BoltBucketSubnets = []byte("subnets")
+)
+
+// Keeps leases in memory the same way BackendHash does,
+// but persists them into a local BoltDB file instead of Aerospike
+type BackendDisk struct {
+	BackendHash
+
+	Path string
+	DB   *bolt.DB
+}
+
+func NewBackendDisk(Path string) (b *BackendDisk, err error) {
+	b = &BackendDisk{
+		Path: Path,
+	}
+
+	b.LeaseStore = b.LeaseUpload
+	b.LeaseRemove = b.LeaseDelete
+	b.LeasePurge = b.LeaseDelete
+
+	if b.DB, err = bolt.Open(Path, 0600, &bolt.Options{Timeout: 5 * time.Second}); err != nil {
+		err = fmt.Errorf("Unable to open '%s': %s", Path, err)
+		return
+	}
+
+	if err = b.DB.Update(func(tx *bolt.Tx) (err error) {
+		if _, err = tx.CreateBucketIfNotExists(BoltBucketLeases); err != nil {
+			return
+		}
+
+		_, err = tx.CreateBucketIfNotExists(BoltBucketSubnets)
+		return
+	}); err != nil {
+		err = fmt.Errorf("Unable to create buckets in '%s': %s", Path, err)
+		return
+	}
+
+	log.Warnf("Disk storage '%s' opened", Path)
+	return
+}
+
+// Loads automode subnets and leases from disk
+func (b *BackendDisk) Load() (err error) {
+	if err = b.SubnetsLoad(); err != nil {
+		return fmt.Errorf("Unable to load subnets from disk: %s", err)
+	}
+
+	if err = b.LeasesLoad(); err != nil {
+		return fmt.Errorf("Unable to load leases from disk: %s", err)
+	}
+
+	return
+}
+
+func (b *BackendDisk) SelfTest() error {
+	return b.DB.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(BoltBucketLeases) == nil || tx.Bucket(BoltBucketSubnets) == nil {
+			return errors.New("Buckets not found")
+		}
+
+		return nil
+	})
+}
+
+func (b *BackendDisk) SubnetStore(Segment *Segment, Subnet *Subnet) (err error) {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint32(v[0:], uint32(Segment.Id))
+	binary.BigEndian.PutUint32(v[4:], Subnet.Net)
+
+	if err = b.DB.Batch(func(tx *bolt.Tx) error {
+		return tx.Bucket(BoltBucketSubnets).Put(BoltKey(Segment.Id, Subnet.Net), v)
+	}); err != nil {
+		log.Errorf("Unable to store subnet %s: %s", Subnet.NetStr, err)
+	}
+
+	return
+}
+
+func (b *BackendDisk) LeaseUpload(Segment *Segment, Subnet *Subnet, Lease *Lease) (err error) {
+	v := make([]byte, 28)
+	binary.BigEndian.PutUint32(v[0:], uint32(Segment.Id))
+	binary.BigEndian.PutUint32(v[4:], Subnet.Net)
+	binary.BigEndian.PutUint32(v[8:], Lease.IP)
+	binary.BigEndian.PutUint64(v[12:], Lease.MAC)
+	binary.BigEndian.PutUint64(v[20:], uint64(Lease.Expires.Unix()))
+
+	if err = b.DB.Batch(func(tx *bolt.Tx) error {
+		return tx.Bucket(BoltBucketLeases).Put(BoltKey(Segment.Id, Lease.IP), v)
+	}); err != nil {
+		log.Errorf("Unable to store lease %s: %s", aux.IPIntToStr(Lease.IP), err)
+	}
+
+	return
+}
+
+func (b *BackendDisk) LeaseDelete(Segment *Segment, Lease *Lease) (err error) {
+	if err = b.DB.Batch(func(tx *bolt.Tx) error {
+		Bucket, k := tx.Bucket(BoltBucketLeases), BoltKey(Segment.Id, Lease.IP)
+
+		// Deletes are asynchronous, the address could have been given to another MAC meanwhile
+		if v := Bucket.Get(k); len(v) == 28 && binary.BigEndian.Uint64(v[12:]) != Lease.MAC {
+			return nil
+		}
+
+		return Bucket.Delete(k)
+	}); err != nil {
+		log.Errorf("Unable to delete lease %s: %s", aux.IPIntToStr(Lease.IP), err)
+	}
+
+	return
+}
+
+func (b *BackendDisk) SubnetsLoad() (err error) {
+	var (
+		Segment *Segment
+		Count   int
+		ok      bool
+	)
+
+	TimeStart := time.Now()
+
+	err = b.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(BoltBucketSubnets).ForEach(func(k, v []byte) error {
+			if len(v) != 8 {
+				log.Warnf("Subnet record '%s' is malformed - skipping", k)
+				return nil
+			}
+
+			SegmentId := int(binary.BigEndian.Uint32(v[0:]))
+			NetAddr := binary.BigEndian.Uint32(v[4:])
+
+			if Segment, ok = o.Segments[SegmentId]; !ok {
+				log.Warnf("Segment with ID '%d' not found - skipping subnet '%s' loading", SegmentId, aux.IPIntToStr(NetAddr))
+				return nil
+			}
+
+			if !Segment.AutoMode {
+				log.Warnf("Segment '%s' has automode disabled - will not load it", Segment.Name)
+				return nil
+			}
+
+			if _, ok = Segment.Subnets[NetAddr]; ok {
+				log.Warnf("Subnet '%s' already exists in Segment '%s' - skipping", aux.IPIntToStr(NetAddr), Segment.Name)
+				return nil
+			}
+
+			Segment.Subnets[NetAddr] = GenerateAutoSubnet(NetAddr, Segment)
+			Count++
+
+			log.Debugf("Subnet '%s' loaded into Segment '%s'", aux.IPIntToStr(NetAddr), Segment.Name)
+			return nil
+		})
+	})
+
+	log.Warnf("%d automode subnets loaded in %s", Count, time.Since(TimeStart))
+	return
+}
+
+func (b *BackendDisk) LeasesLoad() (err error) {
+	var (
+		Segment    *Segment
+		Subnet     *Subnet
+		Count      int
+		Duplicates int
+		Stale      [][]byte
+		ok         bool
+	)
+
+	TimeStart := time.Now()
+
+	err = b.DB.Update(func(tx *bolt.Tx) (err error) {
+		Bucket := tx.Bucket(BoltBucketLeases)
+
+		if err = Bucket.ForEach(func(k, v []byte) error {
+			if len(v) != 28 {
+				log.Warnf("Lease record '%s' is malformed - removing", k)
+				Stale = append(Stale, append([]byte{}, k...))
+				return nil
+			}
+
+			SegmentId := int(binary.BigEndian.Uint32(v[0:]))
+			NetAddr := binary.BigEndian.Uint32(v[4:])
+			IP := binary.BigEndian.Uint32(v[8:])
+			MAC := binary.BigEndian.Uint64(v[12:])
+			Expires := time.Unix(int64(binary.BigEndian.Uint64(v[20:])), 0)
+
+			// Expired leases are not needed anymore, there's no TTL on disk so we clean them here
+			if time.Now().After(Expires) {
+				Stale = append(Stale, append([]byte{}, k...))
+				return nil
+			}
+
+			if Segment, ok = o.Segments[SegmentId]; !ok {
+				log.Warnf("Segment with ID '%d' not found - skipping subnet '%s' loading", SegmentId, aux.IPIntToStr(NetAddr))
+				return nil
+			}
+
+			if Subnet, ok = Segment.Subnets[NetAddr]; !ok {
+				log.Warnf("Subnet '%s' not found in Segment '%s' - skipping lease (%s -> %s)",
+					aux.IPIntToStr(NetAddr), Segment.Name, aux.IPIntToStr(IP), aux.MACIntToStr(MAC),
+				)
+
+				return nil
+			}
+
+			Lease := &Lease{
+				IP:      IP,
+				MAC:     MAC,
+				Expires: Expires,
+				Bound:   true, // Only ACKed leases are stored
+			}
+
+			if _, ok = Subnet.LeasesByMAC[MAC]; !ok {
+				Subnet.LeasesByMAC[MAC] = Lease
+				Subnet.LeasesByIP[IP] = Lease
+				Subnet.AddrUse(IP)
+			} else {
+				Duplicates++
+				return nil
+			}
+
+			Count++
+
+			log.Debugf("Lease '%s' -> '%s' (Subnet '%s', Expires in %d sec) loaded into Segment '%s'",
+				aux.IPIntToStr(IP), aux.MACIntToStr(MAC), aux.IPIntToStr(NetAddr), Lease.ExpiresIn(), Segment.Name,
+			)
+
+			return nil
+		}); err != nil {
+			return
+		}
+
+		// Bucket can't be modified during ForEach, so delete stale records afterwards
+		for _, k := range Stale {
+			if err = Bucket.Delete(k); err != nil {
+				return
+			}
+		}
+
+		return
+	})
+
+	log.Warnf("%d leases loaded in %s (%d duplicates, %d stale removed)", Count, time.Since(TimeStart), Duplicates, len(Stale))
+	return
+}
+
+func BoltKey(SegmentId int, Addr uint32) []byte {
+	return []byte(fmt.Sprintf("%d:%d", SegmentId, Addr))
+}
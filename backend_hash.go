@@ -1,7 +1,10 @@
 package main
 
 import (
+	"fmt"
+	"math/rand"
 	aux "mt-aux"
+	"mt-aux/dhcp"
 	"sync"
 	"time"
 
@@ -10,6 +13,13 @@ import (
 
 type BackendHash struct {
 	WorkersMtx sync.RWMutex // Make sure workers do not interfere with each other
+
+	// Persistent storage hooks, called asynchronously on lease changes
+	LeaseStore  func(*Segment, *Subnet, *Lease) error
+	LeaseRemove func(*Segment, *Lease) error
+
+	// Removes cleaned up leases from the storage, nil if the storage expires them itself
+	LeasePurge func(*Segment, *Lease) error
 }
 
 func (b *BackendHash) Init() (err error) {
@@ -18,6 +28,32 @@ func (b *BackendHash) Init() (err error) {
 	return
 }
 
+// Loads automode subnets and leases from Aerospike
+func (b *BackendHash) Load() (err error) {
+	if err = SubnetsDownloadFromAerospike(); err != nil {
+		return fmt.Errorf("Unable to download subnets from Aerospike: %s", err)
+	}
+
+	if err = LeasesDownloadFromAerospike(); err != nil {
+		return fmt.Errorf("Unable to download leases from Aerospike: %s", err)
+	}
+
+	return
+}
+
+func (b *BackendHash) SelfTest() (err error) {
+	if err = as.SelfTest(); err != nil {
+		return
+	}
+
+	_, err = as.Get(as.Rpolicy(), as.Key(o.ASSetLeases, "testbullshit"))
+	return
+}
+
+func (b *BackendHash) SubnetStore(Segment *Segment, Subnet *Subnet) error {
+	return SubnetUploadToAerospike(Subnet, Segment)
+}
+
 func (b *BackendHash) StatsWorker(Interval time.Duration) {
 	for {
 		time.Sleep(Interval)
@@ -35,11 +71,18 @@ func (b *BackendHash) StatsWorker(Interval time.Duration) {
 				Segment.LeasesTotal += Subnet.Capacity()
 
 				Subnet.Lock()
-				Subnet.UpdateStatsNoLock()
+				for _, Lease := range Subnet.UpdateStatsNoLock() {
+					LeaseEventSend(LeaseEventExpire(Segment, Subnet, Lease))
+				}
 				Segment.LeasesActive += Subnet.LeasesActiveCount
 				Segment.LeasesExpired += Subnet.LeasesExpiredCount
+				Alert := Subnet.AlertEvaluateNoLock(Segment)
 				Subnet.Unlock()
 
+				if Alert != nil {
+					go AlertFire(Alert)
+				}
+
 				go MetricsSendStats(Segment, Subnet, time.Since(TimeStartSubnet))
 			}
 			Duration := time.Since(TimeStart)
@@ -62,57 +105,99 @@ func (b *BackendHash) StatsWorker(Interval time.Duration) {
 }
 
 func (b *BackendHash) CleanupWorker(Interval time.Duration) {
+	for {
+		time.Sleep(Interval)
+		b.Cleanup()
+	}
+}
+
+// Deletes expired leases from all the subnets
+func (b *BackendHash) Cleanup() {
 	var (
 		ExpiredByMAC, ExpiredByIP           int
 		ExpiredByMACTotal, ExpiredByIPTotal int
+		Removed                             []*Lease
 	)
 
-	for {
-		time.Sleep(Interval)
-
-		b.WorkersMtx.Lock()
-		CacheReloadingMtx.RLock()
-
-		for _, Segment := range o.Segments {
-			ExpiredByMACTotal, ExpiredByIPTotal = 0, 0
-			Segment.RLock()
-
-			TimeStart := time.Now()
-			for _, Subnet := range Segment.Subnets {
-				TimeStartSubnet := time.Now()
-				ExpiredByMAC, ExpiredByIP = Subnet.CleanupExpired()
-				go MetricsSendCleanup(Segment, Subnet, time.Since(TimeStartSubnet), ExpiredByMAC, ExpiredByIP)
-
-				ExpiredByMACTotal += ExpiredByMAC
-				ExpiredByIPTotal += ExpiredByIP
+	b.WorkersMtx.Lock()
+	CacheReloadingMtx.RLock()
+
+	for _, Segment := range o.Segments {
+		ExpiredByMACTotal, ExpiredByIPTotal = 0, 0
+		Segment.RLock()
+
+		TimeStart := time.Now()
+		for _, Subnet := range Segment.Subnets {
+			TimeStartSubnet := time.Now()
+			ExpiredByMAC, Removed = Subnet.CleanupExpired()
+			ExpiredByIP = len(Removed)
+			HistogramCleanup.Observe(time.Since(TimeStartSubnet))
+
+			for _, Lease := range Removed {
+				// Stats worker didn't notice it expiring before it was cleaned up
+				if Lease.Bound {
+					LeaseEventSend(LeaseEventExpire(Segment, Subnet, *Lease))
+				}
+
+				if b.LeasePurge != nil {
+					go b.LeasePurge(Segment, Lease)
+				}
 			}
-			Duration := time.Since(TimeStart)
 
-			if o.LogTickers {
-				log.Warnf(
-					"Ticker: CleanupWorker(): Segment %s (%d): done in %s: %d subnets processed, expired: %d by MAC, %d by IP",
-					Segment.Name, Segment.Id, Duration, len(Segment.Subnets), ExpiredByMACTotal, ExpiredByIPTotal,
-				)
-			}
+			go MetricsSendCleanup(Segment, Subnet, time.Since(TimeStartSubnet), ExpiredByMAC, ExpiredByIP)
 
-			Segment.RUnlock()
+			ExpiredByMACTotal += ExpiredByMAC
+			ExpiredByIPTotal += ExpiredByIP
 		}
+		Duration := time.Since(TimeStart)
 
-		CacheReloadingMtx.RUnlock()
-		b.WorkersMtx.Unlock()
+		if o.LogTickers {
+			log.Warnf(
+				"Ticker: CleanupWorker(): Segment %s (%d): done in %s: %d subnets processed, expired: %d by MAC, %d by IP",
+				Segment.Name, Segment.Id, Duration, len(Segment.Subnets), ExpiredByMACTotal, ExpiredByIPTotal,
+			)
+		}
+
+		Segment.RUnlock()
 	}
+
+	CacheReloadingMtx.RUnlock()
+	b.WorkersMtx.Unlock()
 }
 
 func (b *BackendHash) LeaseFind(Ctx *ReqCtx) (err error) {
 	var (
-		Lease *Lease
-		ip    uint32
-		ok    bool
+		Lease    *Lease
+		ip       uint32
+		ok       bool
+		r        IPRange
+		Released bool
 	)
 
+	// Client's class may restrict allocation to its pool
+	Pool := []IPRange{{Start: Ctx.Subnet.RangeStart, End: Ctx.Subnet.RangeEnd}}
+	if Ctx.Class != nil && len(Ctx.Class.Pool) > 0 {
+		Pool = Ctx.Class.PoolIn(Ctx.Subnet)
+	}
+
 	// Lock whole subnet during processing
 	Ctx.Subnet.Lock()
 
+	// Reserved address has priority over any other lease
+	if Ctx.Reservation != nil {
+		if !b.LeaseReserved(Ctx) {
+			Ctx.DropReason = DROPREASON_RESERVED_OCCUPIED
+			Ctx.Subnet.Unlock()
+			return
+		}
+
+		Ctx.SetRequestedIP(Ctx.Reservation.IP)
+		Ctx.LogDebugf("Found reserved lease: %s", Ctx.IPStr)
+		Ctx.StatsInc(STATS_LEASE_RESERVED)
+		Ctx.LeaseSource = LEASE_SRC_RESERVED
+		goto out
+	}
+
 	// Check if client's MAC already has a lease in this subnet
 	if Lease, ok = Ctx.Subnet.LeasesByMAC[Ctx.MAC]; ok {
 		if Lease.MAC != Ctx.MAC {
@@ -132,9 +217,25 @@ func (b *BackendHash) LeaseFind(Ctx *ReqCtx) (err error) {
 			goto search
 		}
 
+		// Ranges could have shrunk or the address got excluded since the lease was given out
+		if !Ctx.Subnet.AddrAllowed(Lease.IP) {
+			Ctx.LogDebugf("Found lease '%s', but it's excluded or outside of the ranges", aux.IPIntToStr(Lease.IP))
+			goto search
+		}
+
+		if !IPRangesContain(Pool, Lease.IP) {
+			if Ctx.Class != nil {
+				Ctx.LogDebugf("Found lease '%s', but it's outside of class '%s' pool", aux.IPIntToStr(Lease.IP), Ctx.Class.Name)
+			} else {
+				Ctx.LogDebugf("Found lease '%s', but it's outside of the pool", aux.IPIntToStr(Lease.IP))
+			}
+			goto search
+		}
+
 		Ctx.SetRequestedIP(Lease.IP)
 		Ctx.LogDebugf("Found existing lease: %s (expired=%t)", Ctx.IPStr, Lease.Expired())
-		Lease.Expires = Ctx.RequestStart.Add(o.DHCPGraceTTL)
+		Ctx.Subnet.AddrUse(Lease.IP)
+		Ctx.Subnet.LeaseExpiresSet(Lease, Ctx.RequestStart.Add(Ctx.OfferHoldTTL()))
 		Lease.DiscoverSet()
 		Ctx.StatsInc(STATS_LEASE_EXISTING)
 		Ctx.LeaseSource = LEASE_SRC_EXISTING
@@ -144,9 +245,12 @@ func (b *BackendHash) LeaseFind(Ctx *ReqCtx) (err error) {
 search:
 	Ctx.LogDebugf("Existing lease not found, trying to reserve")
 
-	// Try some random IPs first
+	// Try some random IPs first, skipping ones that are known to be occupied
 	for i := 0; i < o.DHCPRandomTries; i++ {
-		ip = aux.RandRangeUint32(Ctx.Subnet.RangeStart, Ctx.Subnet.RangeEnd)
+		r = Pool[rand.Intn(len(Pool))]
+		if ip = aux.RandRangeUint32(r.Start, r.End); Ctx.Subnet.Used.IsSet(ip) {
+			continue
+		}
 
 		if b.LeaseAdd(Ctx, ip) {
 			Ctx.SetRequestedIP(ip)
@@ -155,36 +259,103 @@ search:
 			Ctx.LeaseSource = LEASE_SRC_RANDOM
 			goto out
 		}
+
+		// Pool bitmap is out of sync with leases, fix it
+		Ctx.Subnet.AddrUse(ip)
 	}
 
-	// Iterate through subnet range to find free lease
-	for ip = Ctx.Subnet.RangeStart; ip <= Ctx.Subnet.RangeEnd; ip++ {
-		if b.LeaseAdd(Ctx, ip) {
-			Ctx.SetRequestedIP(ip)
-			Ctx.LogDebugf("Found range lease: %s", Ctx.IPStr)
-			Ctx.StatsInc(STATS_LEASE_RANGE)
-			Ctx.LeaseSource = LEASE_SRC_RANGE
-			break
+	// Search the pool bitmap for a free address starting from the last random one
+scan:
+	for _, r = range Pool {
+		for ip, ok = Ctx.Subnet.Used.FindFreeIn(ip, r.Start, r.End); ok; ip, ok = Ctx.Subnet.Used.FindFreeIn(ip, r.Start, r.End) {
+			if b.LeaseAdd(Ctx, ip) {
+				Ctx.SetRequestedIP(ip)
+				Ctx.LogDebugf("Found range lease: %s", Ctx.IPStr)
+				Ctx.StatsInc(STATS_LEASE_RANGE)
+				Ctx.LeaseSource = LEASE_SRC_RANGE
+				goto out
+			}
+
+			Ctx.Subnet.AddrUse(ip)
 		}
 	}
 
+	// Expired leases keep their addresses until the next stats update, reclaim them right away
+	if !Released && Ctx.Subnet.ReleaseExpiredNoLock() > 0 {
+		Released = true
+		goto scan
+	}
+
 out:
 	Ctx.Subnet.Unlock()
 
 	if Ctx.IP <= 0 {
 		Ctx.StatsInc(STATS_LEASE_NO_FREE)
+		Ctx.Subnet.NoFreeSet(Ctx.RequestStart)
 	}
 
 	return
 }
 
+// Creates or refreshes the lease for reserved address (it assumes an already locked subnet).
+// Returns false if the address is still bound to another MAC, it's not offered until that lease expires
+func (b *BackendHash) LeaseReserved(Ctx *ReqCtx) bool {
+	ip := Ctx.Reservation.IP
+
+	if L, ok := Ctx.Subnet.LeasesByIP[ip]; ok && L.MAC == Ctx.MAC {
+		Ctx.Subnet.LeaseExpiresSet(L, Ctx.RequestStart.Add(Ctx.OfferHoldTTL()))
+		L.DiscoverSet()
+		return true
+	} else if ok {
+		if !L.Expired() {
+			if L.Bound {
+				Ctx.LogWarnf("Reserved lease '%s' is bound to another MAC '%s' until %s", aux.IPIntToStr(ip), aux.MACIntToStr(L.MAC), aux.TimeString(L.Expires))
+				return false
+			}
+
+			Ctx.LogWarnf("Reserved lease '%s' is offered to another MAC '%s' - taking over", aux.IPIntToStr(ip), aux.MACIntToStr(L.MAC))
+		}
+
+		// Previous owner must not find the address as its own anymore
+		if Cur, ok := Ctx.Subnet.LeasesByMAC[L.MAC]; ok && Cur == L {
+			delete(Ctx.Subnet.LeasesByMAC, L.MAC)
+		}
+	}
+
+	// Free the dynamic lease which this MAC could have got before the reservation
+	if L, ok := Ctx.Subnet.LeasesByMAC[Ctx.MAC]; ok && L.IP != ip {
+		if Cur, ok := Ctx.Subnet.LeasesByIP[L.IP]; ok && Cur == L {
+			delete(Ctx.Subnet.LeasesByIP, L.IP)
+			Ctx.Subnet.AddrRelease(L.IP)
+			go b.LeaseRemove(Ctx.Segment, L)
+		}
+	}
+
+	L := &Lease{
+		IP:  ip,
+		MAC: Ctx.MAC,
+	}
+	Ctx.Subnet.LeaseExpiresSet(L, Ctx.RequestStart.Add(Ctx.OfferHoldTTL()))
+	L.DiscoverSet()
+
+	Ctx.Subnet.LeasesByIP[ip] = L
+	Ctx.Subnet.LeasesByMAC[Ctx.MAC] = L
+	return true
+}
+
 // Try to add lease (it assumes an already locked subnet)
 func (b *BackendHash) LeaseAdd(Ctx *ReqCtx, ip uint32) bool {
 	var (
 		L  *Lease
+		R  *Reservation
 		ok bool
 	)
 
+	// Reserved addresses are never given to other MACs
+	if R, ok = Ctx.Subnet.ReservationsIP[ip]; ok && R.MAC != Ctx.MAC {
+		return false
+	}
+
 	if L, ok = Ctx.Subnet.LeasesByIP[ip]; ok {
 		// Lease already occupied, check if it's expired
 		if !L.Expired() {
@@ -195,14 +366,15 @@ func (b *BackendHash) LeaseAdd(Ctx *ReqCtx, ip uint32) bool {
 	}
 
 	L = &Lease{
-		IP:      ip,
-		MAC:     Ctx.MAC,
-		Expires: Ctx.RequestStart.Add(o.DHCPGraceTTL),
+		IP:  ip,
+		MAC: Ctx.MAC,
 	}
+	Ctx.Subnet.LeaseExpiresSet(L, Ctx.RequestStart.Add(Ctx.OfferHoldTTL()))
 	L.DiscoverSet()
 
 	Ctx.Subnet.LeasesByIP[ip] = L
 	Ctx.Subnet.LeasesByMAC[Ctx.MAC] = L
+	Ctx.Subnet.AddrUse(ip)
 	return true
 }
 
@@ -232,16 +404,24 @@ func (b *BackendHash) LeaseCheckAndUpdate(Ctx *ReqCtx) (err error) {
 		goto out
 	}
 
-	Ctx.Lease.Expires = Ctx.RequestStart.Add(Ctx.Subnet.LeaseTTL)
+	Ctx.Subnet.LeaseExpiresSet(Ctx.Lease, Ctx.RequestStart.Add(Ctx.LeaseTTL()))
 	Ctx.LogDebugf("Lease for IP '%s' updated to expire @ %s", Ctx.IPStr, aux.TimeString(Ctx.Lease.Expires))
 	valid = true
 
 out:
 	if valid {
+		Ctx.Lease.Bound = true
 		Ctx.LeaseCopy = &Lease{}
 		*Ctx.LeaseCopy = *Ctx.Lease
 		Ctx.Lease.Discover = false
-		go LeaseUploadToAerospike(Ctx.SegmentCopy, Ctx.SubnetCopy, Ctx.LeaseCopy)
+		go b.LeaseStore(Ctx.SegmentCopy, Ctx.SubnetCopy, Ctx.LeaseCopy)
+
+		// REQUEST after DISCOVER completes the allocation, otherwise client extends its lease
+		if Ctx.LeaseCopy.Discover {
+			LeaseEventSend(Ctx.LeaseEvent(LEASE_EVENT_GRANT, Ctx.LeaseCopy))
+		} else {
+			LeaseEventSend(Ctx.LeaseEvent(LEASE_EVENT_RENEW, Ctx.LeaseCopy))
+		}
 	} else {
 		Ctx.Lease = nil
 	}
@@ -267,7 +447,14 @@ func (b *BackendHash) LeaseCheckAndDelete(Ctx *ReqCtx) (err error) {
 
 		delete(Ctx.Subnet.LeasesByIP, Ctx.IP)
 		delete(Ctx.Subnet.LeasesByMAC, Ctx.MAC)
-		go LeaseDeleteFromAerospike(Ctx.Segment, Lease)
+		Ctx.Subnet.AddrRelease(Ctx.IP)
+		go b.LeaseRemove(Ctx.Segment, Lease)
+
+		if Ctx.DHCPRequest == dhcp.Decline {
+			LeaseEventSend(Ctx.LeaseEvent(LEASE_EVENT_DECLINE, Lease))
+		} else {
+			LeaseEventSend(Ctx.LeaseEvent(LEASE_EVENT_RELEASE, Lease))
+		}
 
 		Ctx.LogDebugf("Lease for IP '%s' removed", Ctx.IP)
 		goto out
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"encoding/binary"
+	aux "mt-aux"
+	"mt-aux/dhcp"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+)
+
+const (
+	TEST_SEGMENT_ID = 1
+	TEST_LEASE_TTL  = time.Hour
+	TEST_OFFER_TTL  = 2 * time.Minute
+)
+
+// Minimal config the request processing needs, options are kept
+// as goroutines started by previous tests may still read them
+func InitTestOpts() {
+	if o == nil {
+		o = &Opts{
+			ServerID:        "test",
+			DHCPRandomTries: 5,
+			DHCPGraceTTL:    5 * time.Second,
+			DHCPCleanupAge:  time.Minute,
+		}
+	}
+
+	o.Segments, o.SegmentsOrdered = map[int]*Segment{}, nil
+}
+
+// Segment with a single subnet, its pool is RangeStart - RangeEnd
+func NewTestSegment(NetAddr, RangeStart, RangeEnd string) (Seg *Segment, Net *Subnet) {
+	Seg = &Segment{
+		Id:      TEST_SEGMENT_ID,
+		Name:    "test",
+		Lease:   LeasePolicy{OfferTTL: TEST_OFFER_TTL},
+		Subnets: map[uint32]*Subnet{},
+	}
+	Seg.StatsInit()
+
+	Net = &Subnet{
+		Net:    aux.IPStrToInt(NetAddr),
+		NetStr: NetAddr + "/24",
+		Mask:   aux.IPStrToInt("255.255.255.0"),
+
+		RangeStart: aux.IPStrToInt(RangeStart),
+		RangeEnd:   aux.IPStrToInt(RangeEnd),
+		LeaseTTL:   TEST_LEASE_TTL,
+
+		LeasesByIP:     map[uint32]*Lease{},
+		LeasesByMAC:    map[uint64]*Lease{},
+		Reservations:   map[uint64]*Reservation{},
+		ReservationsIP: map[uint32]*Reservation{},
+	}
+	Net.StatsInit()
+	Net.PoolInit()
+
+	Seg.Subnets[Net.Net] = Net
+	o.Segments[Seg.Id] = Seg
+	o.SegmentsOrdered = append(o.SegmentsOrdered, Seg)
+	return
+}
+
+func NewTestCtx(Seg *Segment, Subnet *Subnet, MAC uint64, Request dhcp.MessageType) *ReqCtx {
+	c := &ReqCtx{
+		MAC:          MAC,
+		MACStr:       aux.MACIntToStr(MAC),
+		DHCPRequest:  Request,
+		Segment:      Seg,
+		Subnet:       Subnet,
+		SegmentCopy:  Seg,
+		SubnetCopy:   Subnet,
+		Reservation:  Subnet.Reservations[MAC],
+		RequestStart: time.Now(),
+		LogF:         log.Fields{},
+	}
+
+	return c
+}
+
+// Waits for asynchronous storage updates
+func Eventually(t *testing.T, What string, f func() bool) {
+	t.Helper()
+
+	for Deadline := time.Now().Add(2 * time.Second); time.Now().Before(Deadline); time.Sleep(5 * time.Millisecond) {
+		if f() {
+			return
+		}
+	}
+
+	t.Fatalf("Timed out waiting for %s", What)
+}
+
+// Storage hooks of BackendHash keeping leases in memory instead of Aerospike
+type TestLeaseStorage struct {
+	Leases map[uint32]uint64
+	sync.Mutex
+}
+
+func (s *TestLeaseStorage) Store(Segment *Segment, Subnet *Subnet, Lease *Lease) error {
+	s.Lock()
+	defer s.Unlock()
+	s.Leases[Lease.IP] = Lease.MAC
+	return nil
+}
+
+func (s *TestLeaseStorage) Remove(Segment *Segment, Lease *Lease) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.Leases, Lease.IP)
+	return nil
+}
+
+// Backend under test with its storage inspector, Reopen is nil if leases aren't loaded back from the storage
+type TestBackend struct {
+	Backend
+	Hash   *BackendHash
+	Stored func(IP uint32) (MAC uint64, ok bool)
+	Reopen func(t *testing.T) *TestBackend
+}
+
+func NewTestBackendHash(t *testing.T) *TestBackend {
+	s := &TestLeaseStorage{Leases: map[uint32]uint64{}}
+	b := &BackendHash{
+		LeaseStore:  s.Store,
+		LeaseRemove: s.Remove,
+	}
+
+	return &TestBackend{
+		Backend: b,
+		Hash:    b,
+		Stored: func(IP uint32) (MAC uint64, ok bool) {
+			s.Lock()
+			defer s.Unlock()
+			MAC, ok = s.Leases[IP]
+			return
+		},
+	}
+}
+
+func NewTestBackendDisk(t *testing.T) *TestBackend {
+	return OpenTestBackendDisk(t, filepath.Join(t.TempDir(), "leases.db"))
+}
+
+func OpenTestBackendDisk(t *testing.T, Path string) *TestBackend {
+	b, err := NewBackendDisk(Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.DB.Close() })
+
+	return &TestBackend{
+		Backend: b,
+		Hash:    &b.BackendHash,
+		Stored: func(IP uint32) (MAC uint64, ok bool) {
+			b.DB.View(func(tx *bolt.Tx) error {
+				if v := tx.Bucket(BoltBucketLeases).Get(BoltKey(TEST_SEGMENT_ID, IP)); len(v) == 28 {
+					MAC, ok = binary.BigEndian.Uint64(v[12:]), true
+				}
+
+				return nil
+			})
+
+			return
+		},
+		Reopen: func(t *testing.T) *TestBackend {
+			b.DB.Close()
+			return OpenTestBackendDisk(t, Path)
+		},
+	}
+}
+
+func TestBackendHash(t *testing.T) {
+	BackendSuite(t, NewTestBackendHash)
+}
+
+func TestBackendDisk(t *testing.T) {
+	BackendSuite(t, NewTestBackendDisk)
+}
+
+// Behavior every backend must share
+func BackendSuite(t *testing.T, New func(t *testing.T) *TestBackend) {
+	const (
+		MAC1 = 0x001122330001 + iota
+		MAC2
+		MAC3
+		MAC4
+		MAC5
+		MAC6
+		MACReserved
+	)
+
+	InitTestOpts()
+	b := New(t)
+	Seg, Net := NewTestSegment("10.0.0.0", "10.0.0.10", "10.0.0.13")
+
+	ReservedIP := aux.IPStrToInt("10.0.0.50")
+	Net.Reservations[MACReserved] = &Reservation{MAC: MACReserved, IP: ReservedIP}
+	Net.ReservationsIP[ReservedIP] = Net.Reservations[MACReserved]
+
+	Find := func(MAC uint64) *ReqCtx {
+		c := NewTestCtx(Seg, Net, MAC, dhcp.Discover)
+		if err := b.LeaseFind(c); err != nil {
+			t.Fatalf("LeaseFind: %s", err)
+		}
+
+		return c
+	}
+
+	Request := func(MAC, IP uint64) *ReqCtx {
+		c := NewTestCtx(Seg, Net, MAC, dhcp.Request)
+		c.SetRequestedIP(uint32(IP))
+		if err := b.LeaseCheckAndUpdate(c); err != nil {
+			t.Fatalf("LeaseCheckAndUpdate: %s", err)
+		}
+
+		return c
+	}
+
+	Stored := func(IP uint32, MAC uint64) func() bool {
+		return func() bool {
+			m, ok := b.Stored(IP)
+			return ok && m == MAC
+		}
+	}
+
+	NotStored := func(IP uint32) func() bool {
+		return func() bool {
+			_, ok := b.Stored(IP)
+			return !ok
+		}
+	}
+
+	var IP1 uint32
+
+	t.Run("discover offers address for offer TTL", func(t *testing.T) {
+		c := Find(MAC1)
+		if IP1 = c.IP; IP1 < Net.RangeStart || IP1 > Net.RangeEnd {
+			t.Fatalf("Offered %s is outside of the pool", c.IPStr)
+		}
+
+		if l := Net.LeasesByIP[IP1]; l == nil || !l.Expires.Equal(c.RequestStart.Add(TEST_OFFER_TTL)) {
+			t.Fatalf("Offered lease should expire in %s", TEST_OFFER_TTL)
+		}
+
+		if c = Find(MAC1); c.IP != IP1 {
+			t.Fatalf("Second DISCOVER got %s instead of %s", c.IPStr, aux.IPIntToStr(IP1))
+		}
+	})
+
+	t.Run("request binds and stores lease", func(t *testing.T) {
+		c := Request(MAC1, uint64(IP1))
+		if c.Lease == nil || !c.Lease.Bound || !c.Lease.Expires.Equal(c.RequestStart.Add(TEST_LEASE_TTL)) {
+			t.Fatalf("Lease is not bound for %s", TEST_LEASE_TTL)
+		}
+
+		Eventually(t, "lease to be stored", Stored(IP1, MAC1))
+	})
+
+	t.Run("another MAC can't request bound address", func(t *testing.T) {
+		if c := Request(MAC2, uint64(IP1)); c.Lease != nil || c.NotFoundReason != NOTFOUND_ANOTHER_MAC {
+			t.Fatalf("Lease of another MAC was given out")
+		}
+	})
+
+	t.Run("pool exhaustion", func(t *testing.T) {
+		Seen := map[uint32]bool{IP1: true}
+		for _, MAC := range []uint64{MAC2, MAC3, MAC4} {
+			c := Find(MAC)
+			if c.IP == 0 || Seen[c.IP] {
+				t.Fatalf("MAC %x got %s", MAC, c.IPStr)
+			}
+
+			Seen[c.IP] = true
+		}
+
+		if c := Find(MAC5); c.IP != 0 {
+			t.Fatalf("Exhausted pool gave out %s", c.IPStr)
+		}
+	})
+
+	t.Run("release frees address", func(t *testing.T) {
+		c := NewTestCtx(Seg, Net, MAC1, dhcp.Release)
+		c.SetRequestedIP(IP1)
+		if err := b.LeaseCheckAndDelete(c); err != nil {
+			t.Fatal(err)
+		}
+
+		Eventually(t, "lease to be removed from storage", NotStored(IP1))
+
+		if c = Find(MAC5); c.IP != IP1 {
+			t.Fatalf("Released address wasn't reused, got %s", c.IPStr)
+		}
+	})
+
+	t.Run("expired address is reused before stats update", func(t *testing.T) {
+		Net.Lock()
+		l := Net.LeasesByMAC[MAC2]
+		Net.LeaseExpiresSet(l, time.Now().Add(-time.Second))
+		Net.Unlock()
+
+		if c := Find(MAC6); c.IP != l.IP {
+			t.Fatalf("Expired %s wasn't reused, got %s", aux.IPIntToStr(l.IP), c.IPStr)
+		}
+	})
+
+	t.Run("reserved address bound to another MAC", func(t *testing.T) {
+		// Lease bound before the address was reserved
+		Owner := &Lease{IP: ReservedIP, MAC: MAC6 + 200, Expires: time.Now().Add(time.Hour), Bound: true}
+		Net.LeasesByIP[ReservedIP], Net.LeasesByMAC[Owner.MAC] = Owner, Owner
+
+		if c := Find(MACReserved); c.IP != 0 || c.DropReason != DROPREASON_RESERVED_OCCUPIED {
+			t.Fatalf("Reserved address bound to another MAC was offered")
+		}
+
+		if Net.LeasesByIP[ReservedIP] != Owner || Net.LeasesByMAC[Owner.MAC] != Owner {
+			t.Fatalf("Bound lease was taken from its owner")
+		}
+
+		if c := Request(MACReserved, uint64(ReservedIP)); c.Lease != nil || c.NotFoundReason != NOTFOUND_ANOTHER_MAC {
+			t.Fatalf("Reserved address bound to another MAC was acknowledged")
+		}
+
+		// Address is given to the reserved MAC once the lease expires
+		Net.Lock()
+		Net.LeaseExpiresSet(Owner, time.Now().Add(-time.Second))
+		Net.Unlock()
+
+		if c := Find(MACReserved); c.IP != ReservedIP {
+			t.Fatalf("Reserved MAC got %s after the lease of another MAC expired", c.IPStr)
+		}
+	})
+
+	t.Run("reservation", func(t *testing.T) {
+		// Address offered before it was reserved
+		Squatter := &Lease{IP: ReservedIP, MAC: MAC6 + 100, Expires: time.Now().Add(time.Hour)}
+		Net.LeasesByIP[ReservedIP], Net.LeasesByMAC[Squatter.MAC] = Squatter, Squatter
+
+		if c := Find(MACReserved); c.IP != ReservedIP {
+			t.Fatalf("Reserved MAC got %s", c.IPStr)
+		}
+
+		if _, ok := Net.LeasesByMAC[Squatter.MAC]; ok {
+			t.Fatalf("Previous owner of reserved address still has the lease")
+		}
+
+		if c := Request(MACReserved, uint64(ReservedIP)); c.Lease == nil {
+			t.Fatalf("Reserved lease isn't bound")
+		}
+	})
+
+	t.Run("cleanup removes expired leases from storage", func(t *testing.T) {
+		c := Request(MAC5, uint64(IP1))
+		if c.Lease == nil {
+			t.Fatalf("Lease isn't bound")
+		}
+
+		Eventually(t, "lease to be stored", Stored(IP1, MAC5))
+
+		Net.Lock()
+		Net.LeasesByIP[IP1].Expires = time.Now().Add(-2 * o.DHCPCleanupAge)
+		Net.Unlock()
+
+		// Stats worker hasn't seen the lease expiring, so cleanup reports it
+		LeaseEvents = make(chan *LeaseEvent, 100)
+		defer func() { LeaseEvents = nil }()
+
+		b.Hash.Cleanup()
+
+		Expired := 0
+		for len(LeaseEvents) > 0 {
+			if e := <-LeaseEvents; e.Type == LEASE_EVENT_EXPIRE && e.MAC == aux.MACIntToStr(MAC5) {
+				Expired++
+			}
+		}
+
+		if Expired != 1 {
+			t.Fatalf("%d expire events sent for bound lease, expected 1", Expired)
+		}
+
+		if _, ok := Net.LeasesByMAC[MAC5]; ok {
+			t.Fatalf("Expired lease is still in LeasesByMAC")
+		}
+
+		if _, ok := Net.LeasesByIP[IP1]; ok {
+			t.Fatalf("Expired lease is still in LeasesByIP")
+		}
+
+		// Aerospike expires records itself
+		if b.Hash.LeasePurge != nil {
+			Eventually(t, "expired lease to be removed from storage", NotStored(IP1))
+		}
+	})
+
+	if b.Reopen == nil {
+		return
+	}
+
+	t.Run("leases are loaded back", func(t *testing.T) {
+		Eventually(t, "reserved lease to be stored", Stored(ReservedIP, MACReserved))
+
+		b = b.Reopen(t)
+		Net.LeasesByIP, Net.LeasesByMAC = map[uint32]*Lease{}, map[uint64]*Lease{}
+		Net.PoolInit()
+
+		if err := b.Load(); err != nil {
+			t.Fatal(err)
+		}
+
+		if l := Net.LeasesByMAC[MACReserved]; l == nil || l.IP != ReservedIP || !l.Bound {
+			t.Fatalf("Reserved lease wasn't loaded")
+		}
+
+		if _, ok := Net.LeasesByIP[IP1]; ok {
+			t.Fatalf("Purged lease was loaded")
+		}
+	})
+}
+
+// Lease loaded from the storage after the range has shrunk
+func TestLeaseFindOutsidePool(t *testing.T) {
+	const MAC = 0x001122330101
+
+	InitTestOpts()
+	b := NewTestBackendHash(t)
+	Seg, Net := NewTestSegment("10.0.0.0", "10.0.0.10", "10.0.0.13")
+
+	Old := &Lease{IP: aux.IPStrToInt("10.0.0.100"), MAC: MAC, Expires: time.Now().Add(time.Hour), Bound: true}
+	Net.LeasesByIP[Old.IP], Net.LeasesByMAC[MAC] = Old, Old
+
+	c := NewTestCtx(Seg, Net, MAC, dhcp.Discover)
+	if err := b.LeaseFind(c); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.IP < Net.RangeStart || c.IP > Net.RangeEnd {
+		t.Fatalf("Offered %s is outside of the pool", c.IPStr)
+	}
+}
+
+// Without offer_ttl the address is held for grace_ttl, not for the whole lease time
+func TestOfferHoldTTL(t *testing.T) {
+	const (
+		MAC1 = 0x001122330201 + iota
+		MAC2
+	)
+
+	InitTestOpts()
+	b := NewTestBackendHash(t)
+	Seg, Net := NewTestSegment("10.0.0.0", "10.0.0.10", "10.0.0.10")
+	Seg.Lease = LeasePolicy{}
+
+	// Offer was made grace_ttl ago and client never requested it
+	c := NewTestCtx(Seg, Net, MAC1, dhcp.Discover)
+	c.RequestStart = time.Now().Add(-o.DHCPGraceTTL)
+	if err := b.LeaseFind(c); err != nil {
+		t.Fatal(err)
+	}
+
+	if l := Net.LeasesByIP[c.IP]; l == nil || !l.Expires.Equal(c.RequestStart.Add(o.DHCPGraceTTL)) {
+		t.Fatalf("Offered lease should expire in %s", o.DHCPGraceTTL)
+	}
+
+	Offered := c.IP
+	if c = NewTestCtx(Seg, Net, MAC2, dhcp.Discover); b.LeaseFind(c) != nil || c.IP != Offered {
+		t.Fatalf("Unanswered offer of %s wasn't freed, got %s", aux.IPIntToStr(Offered), c.IPStr)
+	}
+}
+
+// Existing lease on an address which got excluded or falls between the ranges isn't offered again
+func TestLeaseFindNotAllowed(t *testing.T) {
+	const MAC = 0x001122330301
+
+	InitTestOpts()
+	b := NewTestBackendHash(t)
+	Seg, Net := NewTestSegment("10.0.0.0", "10.0.0.10", "10.0.0.23")
+	Net.Ranges = []IPRange{
+		{Start: aux.IPStrToInt("10.0.0.10"), End: aux.IPStrToInt("10.0.0.13")},
+		{Start: aux.IPStrToInt("10.0.0.20"), End: aux.IPStrToInt("10.0.0.23")},
+	}
+	Net.Exclusions = []IPRange{{Start: aux.IPStrToInt("10.0.0.11"), End: aux.IPStrToInt("10.0.0.11")}}
+	Net.PoolInit()
+
+	for i, IP := range []string{"10.0.0.11", "10.0.0.15"} {
+		Old := &Lease{IP: aux.IPStrToInt(IP), MAC: MAC + uint64(i), Expires: time.Now().Add(time.Hour), Bound: true}
+		Net.LeasesByIP[Old.IP], Net.LeasesByMAC[Old.MAC] = Old, Old
+
+		c := NewTestCtx(Seg, Net, Old.MAC, dhcp.Discover)
+		if err := b.LeaseFind(c); err != nil {
+			t.Fatal(err)
+		}
+
+		if !Net.AddrAllowed(c.IP) {
+			t.Fatalf("Lease on %s was offered as %s", IP, c.IPStr)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"math/bits"
+)
+
+// Bitmap of occupied addresses in a contiguous IP range.
+// Second-level index marks full words, so searching for a free address
+// costs O(size/4096) at most regardless of how occupied the range is.
+type IPBitmap struct {
+	Start uint32
+	End   uint32
+
+	Words []uint64
+	Full  []uint64
+
+	Count int
+}
+
+func NewIPBitmap(Start, End uint32) (b *IPBitmap) {
+	b = &IPBitmap{
+		Start: Start,
+		End:   End,
+	}
+
+	if End < Start {
+		return
+	}
+
+	Size := int(End-Start) + 1
+	b.Words = make([]uint64, (Size+63)/64)
+	b.Full = make([]uint64, (len(b.Words)+63)/64)
+
+	// Mark padding bits in the last word as occupied so they're never returned
+	if tail := uint(Size % 64); tail != 0 {
+		b.Words[len(b.Words)-1] = ^uint64(0) << tail
+	}
+
+	// Same for the padding in the index
+	if tail := uint(len(b.Words) % 64); tail != 0 {
+		b.Full[len(b.Full)-1] = ^uint64(0) << tail
+	}
+
+	return
+}
+
+func (b *IPBitmap) Size() int {
+	if len(b.Words) == 0 {
+		return 0
+	}
+
+	return int(b.End-b.Start) + 1
+}
+
+func (b *IPBitmap) InRange(ip uint32) bool {
+	return ip >= b.Start && ip <= b.End && len(b.Words) > 0
+}
+
+// Addresses outside of the range are reported as occupied
+func (b *IPBitmap) IsSet(ip uint32) bool {
+	if !b.InRange(ip) {
+		return true
+	}
+
+	i := ip - b.Start
+	return b.Words[i/64]&(1<<(i%64)) != 0
+}
+
+func (b *IPBitmap) Set(ip uint32) {
+	if !b.InRange(ip) {
+		return
+	}
+
+	i := ip - b.Start
+	w := i / 64
+
+	if b.Words[w]&(1<<(i%64)) != 0 {
+		return
+	}
+
+	b.Words[w] |= 1 << (i % 64)
+	b.Count++
+
+	if b.Words[w] == ^uint64(0) {
+		b.Full[w/64] |= 1 << (w % 64)
+	}
+}
+
+func (b *IPBitmap) Clear(ip uint32) {
+	if !b.InRange(ip) {
+		return
+	}
+
+	i := ip - b.Start
+	w := i / 64
+
+	if b.Words[w]&(1<<(i%64)) == 0 {
+		return
+	}
+
+	b.Words[w] &^= 1 << (i % 64)
+	b.Count--
+	b.Full[w/64] &^= 1 << (w % 64)
+}
+
+// Returns first free address at or after From, wrapping around the end of range
+func (b *IPBitmap) FindFree(From uint32) (ip uint32, ok bool) {
+	if len(b.Words) == 0 {
+		return
+	}
+
+	if !b.InRange(From) {
+		From = b.Start
+	}
+
+	i := int(From - b.Start)
+	w := i / 64
+
+	// Free bits in the starting word at or after From
+	if free := ^b.Words[w] & (^uint64(0) << uint(i%64)); free != 0 {
+		return b.addr(w, free), true
+	}
+
+	if n, ok := b.nextWord(w+1, len(b.Words)); ok {
+		return b.addr(n, ^b.Words[n]), true
+	}
+
+	// Wrap around, starting word is included to check the bits before From
+	if n, ok := b.nextWord(0, w+1); ok {
+		return b.addr(n, ^b.Words[n]), true
+	}
+
+	return
+}
+
+// Same as FindFree, but only addresses in [Start, End] are considered
+func (b *IPBitmap) FindFreeIn(From, Start, End uint32) (ip uint32, ok bool) {
+	if len(b.Words) == 0 {
+		return
+	}
+
+	if Start < b.Start {
+		Start = b.Start
+	}
+
+	if End > b.End {
+		End = b.End
+	}
+
+	if Start > End {
+		return
+	}
+
+	if From < Start || From > End {
+		From = Start
+	}
+
+	if ip, ok = b.findFreeRange(From, End); ok || From == Start {
+		return
+	}
+
+	return b.findFreeRange(Start, From-1)
+}
+
+// Returns first free address in [From, To] without wrapping around
+func (b *IPBitmap) findFreeRange(From, To uint32) (ip uint32, ok bool) {
+	i, Last := int(From-b.Start), int(To-b.Start)
+	w := i / 64
+
+	if free := ^b.Words[w] & (^uint64(0) << uint(i%64)); free != 0 {
+		ip = b.addr(w, free)
+		return ip, ip <= To
+	}
+
+	if n, found := b.nextWord(w+1, Last/64+1); found {
+		ip = b.addr(n, ^b.Words[n])
+		return ip, ip <= To
+	}
+
+	return
+}
+
+// Finds first word which is not full in [From, To)
+func (b *IPBitmap) nextWord(From, To int) (w int, ok bool) {
+	for From < To {
+		s := From / 64
+
+		if free := ^b.Full[s] & (^uint64(0) << uint(From%64)); free != 0 {
+			if w = s*64 + bits.TrailingZeros64(free); w < To {
+				return w, true
+			}
+
+			return 0, false
+		}
+
+		From = (s + 1) * 64
+	}
+
+	return
+}
+
+func (b *IPBitmap) addr(w int, free uint64) uint32 {
+	return b.Start + uint32(w*64+bits.TrailingZeros64(free))
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	aux "mt-aux"
+	"mt-aux/dhcp"
+	"testing"
+	"time"
+)
+
+func TestIPBitmapFindFreeIn(t *testing.T) {
+	b := NewIPBitmap(100, 299)
+	for ip := uint32(100); ip <= 299; ip++ {
+		if ip != 150 && ip != 250 {
+			b.Set(ip)
+		}
+	}
+
+	for _, tt := range []struct {
+		From, Start, End uint32
+		IP               uint32
+		ok               bool
+	}{
+		{100, 100, 299, 150, true},
+		{151, 100, 299, 250, true},
+		{251, 100, 299, 150, true}, // Wraps around
+		{0, 200, 299, 250, true},
+		{100, 160, 240, 0, false},
+		{100, 300, 400, 0, false},
+	} {
+		if ip, ok := b.FindFreeIn(tt.From, tt.Start, tt.End); ok != tt.ok || (ok && ip != tt.IP) {
+			t.Errorf("FindFreeIn(%d, %d, %d) = %d, %t, expected %d, %t", tt.From, tt.Start, tt.End, ip, ok, tt.IP, tt.ok)
+		}
+	}
+
+	if b.Clear(200); b.Count != 197 || b.IsSet(200) {
+		t.Errorf("Address wasn't cleared, count %d", b.Count)
+	}
+}
+
+// Allocation before the bitmap: random tries, then walking the whole range
+func LeaseFindLinear(b *BackendHash, Ctx *ReqCtx) {
+	Ctx.Subnet.Lock()
+	defer Ctx.Subnet.Unlock()
+
+	for i := 0; i < o.DHCPRandomTries; i++ {
+		if ip := aux.RandRangeUint32(Ctx.Subnet.RangeStart, Ctx.Subnet.RangeEnd); b.LeaseAdd(Ctx, ip) {
+			Ctx.SetRequestedIP(ip)
+			return
+		}
+	}
+
+	for ip := Ctx.Subnet.RangeStart; ip <= Ctx.Subnet.RangeEnd; ip++ {
+		if b.LeaseAdd(Ctx, ip) {
+			Ctx.SetRequestedIP(ip)
+			return
+		}
+	}
+}
+
+// DISCOVER in a /16 pool occupied by the given percent of active leases
+func BenchmarkLeaseFind(b *testing.B) {
+	for _, Fill := range []int{50, 90, 99} {
+		for _, Method := range []string{"bitmap", "linear"} {
+			b.Run(fmt.Sprintf("fill=%d/%s", Fill, Method), func(b *testing.B) {
+				InitTestOpts()
+				Seg, Net := NewTestSegment("10.0.0.0", "10.0.0.1", "10.0.255.254")
+				s := &TestLeaseStorage{Leases: map[uint32]uint64{}}
+				Backend := &BackendHash{LeaseStore: s.Store, LeaseRemove: s.Remove}
+
+				Size := int(Net.RangeEnd - Net.RangeStart + 1)
+				Expires := time.Now().Add(time.Hour)
+				for n, i := range rand.Perm(Size)[:Size*Fill/100] {
+					l := &Lease{IP: Net.RangeStart + uint32(i), MAC: uint64(n + 1), Expires: Expires}
+					Net.LeasesByIP[l.IP], Net.LeasesByMAC[l.MAC] = l, l
+					Net.AddrUse(l.IP)
+				}
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					c := NewTestCtx(Seg, Net, uint64(Size+1), dhcp.Discover)
+					if Method == "bitmap" {
+						Backend.LeaseFind(c)
+					} else {
+						LeaseFindLinear(Backend, c)
+					}
+
+					if c.IP == 0 {
+						b.Fatalf("No free address found")
+					}
+
+					// Keep the fill level
+					delete(Net.LeasesByIP, c.IP)
+					delete(Net.LeasesByMAC, c.MAC)
+					Net.AddrRelease(c.IP)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	aux "mt-aux"
+	"sort"
+	"text/tabwriter"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	CHECK_INFO    = "INFO"
+	CHECK_WARNING = "WARNING"
+	CHECK_ERROR   = "ERROR"
+)
+
+type CheckItem struct {
+	Level   string
+	Object  string
+	Message string
+}
+
+// Result of config validation (-check-config)
+type CheckReport struct {
+	Items    []CheckItem
+	Errors   int
+	Warnings int
+}
+
+func (r *CheckReport) Add(Level, Object, Message string, args ...interface{}) {
+	r.Items = append(r.Items, CheckItem{
+		Level:   Level,
+		Object:  Object,
+		Message: fmt.Sprintf(Message, args...),
+	})
+
+	switch Level {
+	case CHECK_ERROR:
+		r.Errors++
+	case CHECK_WARNING:
+		r.Warnings++
+	}
+}
+
+func (r *CheckReport) String() string {
+	var b bytes.Buffer
+	w := tabwriter.NewWriter(&b, 0, 0, 3, ' ', 0)
+
+	fmt.Fprintf(w, "Level\tObject\tMessage\n")
+	for _, v := range r.Items {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", v.Level, v.Object, v.Message)
+	}
+	w.Flush()
+
+	fmt.Fprintf(&b, "\nConfig check: %d errors, %d warnings\n", r.Errors, r.Warnings)
+	return b.String()
+}
+
+// Loads config & subnets without serving anything, prints the report and returns exit code
+func ConfigCheck() int {
+	var (
+		r   = &CheckReport{}
+		err error
+	)
+
+	// Config loading & subnet dumps would bury the report. Dry run doesn't log to syslog
+	CheckConfig, SyslogConfigured = true, true
+	log.SetLevel(log.ErrorLevel)
+
+	if o, err = ConfigLoad(); err != nil {
+		r.Add(CHECK_ERROR, "config", "%s", err)
+		goto out
+	}
+
+	r.Add(CHECK_INFO, "config", "Loaded '%s': %d segments, %d classes", ConfigFilename, len(o.Segments), len(o.Classes))
+
+	for _, Seg := range o.SegmentsOrdered {
+		CheckSegment(r, Seg)
+	}
+
+	for _, v := range SegmentsCheckOverlap(o.SegmentsOrdered, o.DHCPSegmentMatch) {
+		r.Add(CHECK_WARNING, "segments", "%s", v)
+	}
+
+	if !CheckConfigMySQL || o.MySQLDSN == "" {
+		r.Add(CHECK_INFO, "mysql", "Subnets are not checked")
+		goto out
+	}
+
+	if err = LoadSegments(o.Segments); err != nil {
+		r.Add(CHECK_ERROR, "mysql", "%s", err)
+		goto out
+	}
+
+	for _, Seg := range o.SegmentsOrdered {
+		for _, Subnet := range Seg.Subnets {
+			CheckSubnet(r, Seg, Subnet)
+		}
+	}
+
+	CheckSubnetsOverlap(r)
+
+out:
+	fmt.Print(r.String())
+
+	if r.Errors > 0 {
+		return 1
+	}
+
+	return 0
+}
+
+func CheckSegment(r *CheckReport, Seg *Segment) {
+	Object := fmt.Sprintf("segment '%s'", Seg.Name)
+
+	if Seg.Matcher != nil {
+		r.Add(CHECK_INFO, Object, "Detect rule is compiled")
+	} else {
+		r.Add(CHECK_INFO, Object, "Detect rule is evaluated by govaluate")
+	}
+
+	if !Seg.AutoMode {
+		return
+	}
+
+	// Automode addresses are relative to the generated network
+	Host := ^Seg.AutoModeMask
+
+	for _, v := range Seg.AutoModeRanges {
+		if v.End >= Host {
+			r.Add(CHECK_ERROR, Object, "Automode range '%s' doesn't fit into mask %s or covers broadcast address", v, aux.IPIntToStr(Seg.AutoModeMask))
+		}
+	}
+
+	for _, v := range Seg.AutoModeExclusions {
+		if v.End > Host {
+			r.Add(CHECK_WARNING, Object, "Automode exclusion '%s' doesn't fit into mask %s", v, aux.IPIntToStr(Seg.AutoModeMask))
+		}
+	}
+
+	if Seg.AutoModeRouter >= Host {
+		r.Add(CHECK_ERROR, Object, "Automode router '%s' doesn't fit into mask %s or is broadcast address", aux.IPIntToStr(Seg.AutoModeRouter), aux.IPIntToStr(Seg.AutoModeMask))
+	} else if IPRangesContain(Seg.AutoModeRanges, Seg.AutoModeRouter) && !IPRangesContain(Seg.AutoModeExclusions, Seg.AutoModeRouter) {
+		r.Add(CHECK_ERROR, Object, "Automode router '%s' is inside of the pool", aux.IPIntToStr(Seg.AutoModeRouter))
+	}
+
+	for _, v := range Seg.AutoModeRoutes {
+		if v.Router >= Host {
+			r.Add(CHECK_ERROR, Object, "Automode route gateway '%s' doesn't fit into mask %s", aux.IPIntToStr(v.Router), aux.IPIntToStr(Seg.AutoModeMask))
+		}
+	}
+}
+
+func CheckSubnet(r *CheckReport, Seg *Segment, Subnet *Subnet) {
+	var (
+		Object    = fmt.Sprintf("subnet %s (%s)", Subnet.NetStr, Seg.Name)
+		Broadcast = Subnet.Net | ^Subnet.Mask
+		// Networks /31 and /32 have no network & broadcast addresses (RFC 3021)
+		P2P = aux.InetMaskToCIDRBits(Subnet.Mask) >= 31
+	)
+
+	if Subnet.Net&Subnet.Mask != Subnet.Net {
+		r.Add(CHECK_ERROR, Object, "Network address has host bits set")
+	}
+
+	for _, v := range Subnet.Ranges {
+		switch {
+		case v.Start&Subnet.Mask != Subnet.Net || v.End&Subnet.Mask != Subnet.Net:
+			r.Add(CHECK_ERROR, Object, "Range '%s' is outside of the network", v)
+		case !P2P && (v.Start == Subnet.Net || v.End == Broadcast):
+			r.Add(CHECK_ERROR, Object, "Range '%s' covers network or broadcast address", v)
+		}
+	}
+
+	switch {
+	case Subnet.Router == 0:
+		r.Add(CHECK_WARNING, Object, "Router is not defined")
+	case Subnet.Router&Subnet.Mask != Subnet.Net:
+		r.Add(CHECK_ERROR, Object, "Router '%s' is outside of the network", aux.IPIntToStr(Subnet.Router))
+	case !P2P && (Subnet.Router == Subnet.Net || Subnet.Router == Broadcast):
+		r.Add(CHECK_ERROR, Object, "Router '%s' is network or broadcast address", aux.IPIntToStr(Subnet.Router))
+	case Subnet.AddrAllowed(Subnet.Router):
+		r.Add(CHECK_ERROR, Object, "Router '%s' is inside of the pool", aux.IPIntToStr(Subnet.Router))
+	}
+
+	if len(Subnet.DNS) == 0 {
+		r.Add(CHECK_WARNING, Object, "No DNS servers defined")
+	}
+
+	if Subnet.LeaseTTL <= 0 {
+		r.Add(CHECK_WARNING, Object, "Lease TTL is not defined")
+	}
+
+	if Subnet.Capacity() == 0 {
+		r.Add(CHECK_WARNING, Object, "Pool is empty")
+	}
+}
+
+// Subnets of different segments may not overlap, the same addresses would be leased twice.
+// Nested subnets of one segment are allowed, the most specific one is chosen
+func CheckSubnetsOverlap(r *CheckReport) {
+	type Net struct {
+		Segment *Segment
+		Subnet  *Subnet
+	}
+
+	var Nets []Net
+	for _, Seg := range o.SegmentsOrdered {
+		for _, Subnet := range Seg.Subnets {
+			Nets = append(Nets, Net{Seg, Subnet})
+		}
+	}
+
+	sort.Slice(Nets, func(i, j int) bool {
+		return Nets[i].Subnet.Net < Nets[j].Subnet.Net
+	})
+
+	for i, a := range Nets {
+		Broadcast := a.Subnet.Net | ^a.Subnet.Mask
+
+		for _, b := range Nets[i+1:] {
+			if b.Subnet.Net > Broadcast {
+				break
+			}
+
+			if a.Segment == b.Segment {
+				r.Add(CHECK_WARNING, fmt.Sprintf("subnet %s (%s)", b.Subnet.NetStr, b.Segment.Name),
+					"Nested into subnet %s", a.Subnet.NetStr)
+				continue
+			}
+
+			r.Add(CHECK_ERROR, fmt.Sprintf("subnet %s (%s)", b.Subnet.NetStr, b.Segment.Name),
+				"Overlaps with subnet %s of segment '%s'", a.Subnet.NetStr, a.Segment.Name)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Debug level and unreachable syslog would break the report if the dry run applied them
+const TEST_CHECK_CONFIG = `
+server_id = "check"
+
+[log]
+level = "DEBUG"
+syslog = "127.0.0.1:1/tcp"
+
+[dhcp]
+backend = "disk"
+
+[segments.test]
+id = 1
+detect_rule = "RelayIP == 10.0.0.1"
+`
+
+// Config check replaces global options & log level, so it runs in a child process
+func TestConfigCheckDryRun(t *testing.T) {
+	if Dir := os.Getenv("TEST_CONFIG_CHECK_DIR"); Dir != "" {
+		ConfigCheckDryRun(t, Dir)
+		return
+	}
+
+	Dir, err := ioutil.TempDir("", "mt-dhcpd-check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(Dir)
+
+	if err = ioutil.WriteFile(filepath.Join(Dir, "check.toml"), []byte(TEST_CHECK_CONFIG), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	Cmd := exec.Command(os.Args[0], "-test.run=^TestConfigCheckDryRun$")
+	Cmd.Env = append(os.Environ(), "TEST_CONFIG_CHECK_DIR="+Dir)
+
+	if Out, err := Cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Config check failed: %s\n%s", err, Out)
+	}
+}
+
+func ConfigCheckDryRun(t *testing.T, Dir string) {
+	if err := os.Chdir(Dir); err != nil {
+		t.Fatal(err)
+	}
+
+	ConfigFilename, CheckConfigMySQL = "check", false
+
+	if Code := ConfigCheck(); Code != 0 {
+		t.Fatalf("Config check returned %d", Code)
+	}
+
+	if l := log.GetLevel(); l != log.ErrorLevel {
+		t.Fatalf("Log level %s after config check, expected %s", l, log.ErrorLevel)
+	}
+}
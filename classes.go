@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	aux "mt-aux"
+	dhcp "mt-aux/dhcp"
+	"net"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Knetic/govaluate"
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Option-82 sub-options (RFC 3046, RFC 3993)
+const (
+	OPTION82_CIRCUIT_ID    = 1
+	OPTION82_REMOTE_ID     = 2
+	OPTION82_SUBSCRIBER_ID = 6
+)
+
+// Named group of clients matched by expression over request's attributes.
+// Class can restrict the pool inside the subnet and override options & lease time
+type ClientClass struct {
+	Name     string
+	Priority int
+
+	Match           string
+	MatchExpression *govaluate.EvaluableExpression
+
+	Pool     []IPRange // Relative to subnet's network
+	Options  []dhcp.Option
+	DNS      []net.IP
+	LeaseTTL time.Duration
+}
+
+// Classes are evaluated in order of descending priority, first match wins
+func ClassesLoad() (Classes []*ClientClass, err error) {
+	for Name := range viper.GetStringMap("classes") {
+		var Class *ClientClass
+		if Class, err = ClassLoad(Name, viper.Sub("classes."+Name)); err != nil {
+			return nil, fmt.Errorf("Class '%s': %s", Name, err)
+		}
+
+		Classes = append(Classes, Class)
+	}
+
+	sort.Slice(Classes, func(i, j int) bool {
+		if Classes[i].Priority != Classes[j].Priority {
+			return Classes[i].Priority > Classes[j].Priority
+		}
+
+		return Classes[i].Name < Classes[j].Name
+	})
+
+	return
+}
+
+func ClassLoad(Name string, Cfg *viper.Viper) (c *ClientClass, err error) {
+	c = &ClientClass{
+		Name:     Name,
+		Priority: Cfg.GetInt("priority"),
+		Match:    Cfg.GetString("match"),
+		LeaseTTL: Cfg.GetDuration("lease_ttl"),
+	}
+
+	if c.Match == "" {
+		return nil, errors.New("match expression should be defined")
+	}
+
+	if c.MatchExpression, err = govaluate.NewEvaluableExpressionWithFunctions(aux.ConvertStringIPandMACToInt(c.Match), goValuateFunctions); err != nil {
+		return
+	}
+
+	for _, v := range Cfg.GetStringSlice("pool") {
+		var r IPRange
+		if r, err = ParseIPRange(v); err != nil {
+			return nil, fmt.Errorf("Wrong pool range '%s'", v)
+		}
+
+		c.Pool = append(c.Pool, r)
+	}
+
+	// Sort option names to keep list options' order stable
+	Options := Cfg.GetStringMapString("options")
+	var Names []string
+	for k := range Options {
+		Names = append(Names, k)
+	}
+	sort.Strings(Names)
+
+	for _, k := range Names {
+		if OptionName(k) == "dns" {
+			for _, v := range OptionSplitList(Options[k]) {
+				ip := net.ParseIP(v).To4()
+				if ip == nil {
+					return nil, fmt.Errorf("Unable to parse DNS '%s' as IP address", v)
+				}
+
+				c.DNS = append(c.DNS, ip)
+			}
+
+			continue
+		}
+
+		if c.Options, err = OptionAdd(c.Options, k, Options[k]); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func ClassesDump(Classes []*ClientClass) {
+	var b bytes.Buffer
+	w := tabwriter.NewWriter(&b, 0, 0, 3, ' ', 0)
+
+	for _, c := range Classes {
+		fmt.Fprintf(w, "Class '%s' (priority %d):\n", c.Name, c.Priority)
+		fmt.Fprintf(w, " Match:\t%s\n", c.Match)
+		fmt.Fprintf(w, " Pool:\t%s\n", IPRangesString(c.Pool))
+		fmt.Fprintf(w, " Options:\t%s\n", OptionsString(c.Options))
+		fmt.Fprintf(w, " DNS:\t%v\n", c.DNS)
+		fmt.Fprintf(w, " Lease TTL:\t%s\n", c.LeaseTTL)
+	}
+	w.Flush()
+
+	for _, v := range strings.Split(b.String(), "\n") {
+		log.Warnf(v)
+	}
+}
+
+// Absolute pool ranges inside the subnet
+func (c *ClientClass) PoolIn(s *Subnet) (Pool []IPRange) {
+	for _, r := range c.Pool {
+		Pool = append(Pool, r.Offset(s.Net))
+	}
+
+	return
+}
+
+// Extracts attributes used by segment & class expressions from request options
+func (c *ReqCtx) ParseClientAttributes() {
+	c.MACOUI = c.MACStr
+	if len(c.MACOUI) > 8 {
+		c.MACOUI = c.MACOUI[:8]
+	}
+
+	c.VendorClass = string(c.RequestOptions[dhcp.OptionVendorClassIdentifier])
+	c.UserClass = string(c.RequestOptions[dhcp.OptionUserClass])
+	c.Hostname = string(c.RequestOptions[dhcp.OptionHostName])
+	c.ClientID = hex.EncodeToString(c.RequestOptions[dhcp.OptionClientIdentifier])
+
+	// Option-82 is already parsed while looking for Link-Selection
+	c.CircuitID = string(c.Option82[OPTION82_CIRCUIT_ID])
+	c.RemoteID = string(c.Option82[OPTION82_REMOTE_ID])
+	c.SubscriberID = string(c.Option82[OPTION82_SUBSCRIBER_ID])
+}
+
+func (c *ReqCtx) ExpressionParameters() map[string]interface{} {
+	p := map[string]interface{}{
+		"MAC":          c.MAC,
+		"MACOUI":       c.MACOUI,
+		"RemoteIP":     c.RemoteIP,
+		"RelayIP":      c.RelayIP,
+		"VendorClass":  c.VendorClass,
+		"UserClass":    c.UserClass,
+		"Hostname":     c.Hostname,
+		"ClientID":     c.ClientID,
+		"CircuitID":    c.CircuitID,
+		"RemoteID":     c.RemoteID,
+		"SubscriberID": c.SubscriberID,
+		"SegmentId":    0,
+		"SegmentName":  "",
+	}
+
+	if c.Segment != nil {
+		p["SegmentId"] = c.Segment.Id
+		p["SegmentName"] = c.Segment.Name
+	}
+
+	return p
+}
+
+func (c *ReqCtx) ClassEvaluate() {
+	if len(o.Classes) == 0 {
+		return
+	}
+
+	p := c.ExpressionParameters()
+
+	for _, Class := range o.Classes {
+		t, err := Class.MatchExpression.Evaluate(p)
+		if err != nil {
+			c.LogErrorf("Unable to evaluate class '%s' expression: %s", Class.Name, err)
+			continue
+		}
+
+		if b, ok := t.(bool); !ok {
+			c.LogErrorf("Class '%s' expression result is not boolean", Class.Name)
+			continue
+		} else if b {
+			c.Class = Class
+			c.LogF["class"] = Class.Name
+			c.LogDebugf("Class '%s' matched", Class.Name)
+			return
+		}
+	}
+}
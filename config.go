@@ -7,7 +7,11 @@ import (
 	"fmt"
 	aux "mt-aux"
 	"net"
+	"regexp"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
 	"text/tabwriter"
 	"time"
 
@@ -18,12 +22,18 @@ import (
 
 var (
 	ConfigFilename     string
+	CheckConfig        bool
+	CheckConfigMySQL   bool
 	goValuateFunctions map[string]govaluate.ExpressionFunction
+	goValuateRegexps   sync.Map
+	SyslogConfigured   bool
 )
 
 type Opts struct {
-	ServerID string
-	Segments map[int]*Segment
+	ServerID        string
+	Segments        map[int]*Segment
+	SegmentsOrdered []*Segment // In evaluation order
+	Classes         []*ClientClass
 
 	MySQLDSN   string
 	HTTPListen []string
@@ -34,14 +44,40 @@ type Opts struct {
 	MetricsMeasurementStats        string
 	MetricsMeasurementStatsSegment string
 	MetricsMeasurementCleanup      string
-
-	DHCPListen          []string
-	DHCPGraceTTL        time.Duration
-	DHCPRandomTries     int
-	DHCPBufferSize      int
-	DHCPCleanupInterval time.Duration
-	DHCPCleanupAge      time.Duration
-	DHCPStatsInterval   time.Duration
+	MetricsMeasurementAlerts       string
+	MetricsPrometheusSubnetLimit   int
+	MetricsSinks                   []MetricsSinkConfig
+
+	DHCPBackend          string
+	DHCPDiskPath         string
+	DHCPListen           []string
+	DHCPListenInterfaces []string
+	DHCPReplyToSource    bool
+	DHCPGraceTTL         time.Duration
+	DHCPRandomTries      int
+	DHCPBufferSize       int
+	DHCPWorkers          int
+	DHCPQueueSize        int
+	DHCPSocketsPerListen int
+	DHCPBatchSize        int
+	DHCPCleanupInterval  time.Duration
+	DHCPCleanupAge       time.Duration
+	DHCPStatsInterval    time.Duration
+	DHCPRateLimit        RateLimits
+	DHCPSegmentMatch     string
+
+	AlertsUtil            UtilThresholds // Defaults for segments
+	AlertsWebhook         string
+	AlertsWebhookTimeout  time.Duration
+	AlertsWebhookRetries  int
+	AlertsExhaustedPeriod time.Duration
+
+	EventsEnabled        bool
+	EventsQueueSize      int
+	EventsFile           string
+	EventsWebhook        string
+	EventsWebhookTimeout time.Duration
+	EventsWebhookRetries int
 
 	ASNamespace   string
 	ASHosts       []string
@@ -57,6 +93,8 @@ type Opts struct {
 
 func init() {
 	flag.StringVar(&ConfigFilename, "config", "mt-dhcpd", "Config filename (without extension)")
+	flag.BoolVar(&CheckConfig, "check-config", false, "Check config and subnets, print report and exit")
+	flag.BoolVar(&CheckConfigMySQL, "check-mysql", true, "Load subnets from MySQL when checking config")
 
 	goValuateFunctions = map[string]govaluate.ExpressionFunction{
 		"InRange": func(args ...interface{}) (interface{}, error) {
@@ -66,7 +104,78 @@ func init() {
 		"InNetwork": func(args ...interface{}) (interface{}, error) {
 			return int64(args[0].(float64))&int64(args[2].(float64)) == int64(args[1].(float64)), nil
 		},
+
+		"HasPrefix": goValuateStringFunc(strings.HasPrefix),
+		"HasSuffix": goValuateStringFunc(strings.HasSuffix),
+		"Contains":  goValuateStringFunc(strings.Contains),
+
+		"Matches": goValuateStringFunc(func(s, re string) bool {
+			r, err := goValuateRegexp(re)
+			return err == nil && r.MatchString(s)
+		}),
+
+		"ToLower": func(args ...interface{}) (interface{}, error) {
+			if len(args) != 1 {
+				return nil, errors.New("ToLower() expects 1 argument")
+			}
+
+			s, ok := args[0].(string)
+			if !ok {
+				return nil, errors.New("ToLower() expects string argument")
+			}
+
+			return strings.ToLower(s), nil
+		},
+	}
+}
+
+// Wraps func(string, string) bool for use in expressions
+func goValuateStringFunc(f func(string, string) bool) govaluate.ExpressionFunction {
+	return func(args ...interface{}) (interface{}, error) {
+		if len(args) != 2 {
+			return nil, errors.New("Function expects 2 arguments")
+		}
+
+		a, ok1 := args[0].(string)
+		b, ok2 := args[1].(string)
+		if !ok1 || !ok2 {
+			return nil, errors.New("Function expects string arguments")
+		}
+
+		return f(a, b), nil
+	}
+}
+
+// Expressions are evaluated for every request, so compiled regexps are cached
+func goValuateRegexp(re string) (r *regexp.Regexp, err error) {
+	if v, ok := goValuateRegexps.Load(re); ok {
+		return v.(*regexp.Regexp), nil
+	}
+
+	if r, err = regexp.Compile(re); err != nil {
+		return
+	}
+
+	goValuateRegexps.Store(re, r)
+	return
+}
+
+func SyslogInit(Syslog string) (err error) {
+	if Syslog == "local" {
+		SyslogEnable("", "")
+	} else if Syslog != "" {
+		if t := strings.Split(Syslog, "/"); len(t) != 2 || (t[1] != "udp" && t[1] != "tcp") {
+			err = fmt.Errorf("log.syslog can be either 'local' or 'host:port/protocol'")
+			return
+		} else {
+			if err = SyslogEnable(t[1], t[0]); err != nil {
+				err = fmt.Errorf("Unable to enable syslog: %s", err)
+				return
+			}
+		}
 	}
+
+	return
 }
 
 func ConfigLoad() (o *Opts, err error) {
@@ -81,11 +190,29 @@ func ConfigLoad() (o *Opts, err error) {
 		return
 	}
 
+	viper.SetDefault("dhcp.backend", BACKEND_HASH)
+	viper.SetDefault("dhcp.disk_path", "/var/lib/mt-dhcpd/leases.db")
+	viper.SetDefault("dhcp.grace_ttl", 5*time.Second)
 	viper.SetDefault("dhcp.buffer_size", 4*1024*1024)
+	viper.SetDefault("dhcp.workers", 16*runtime.NumCPU())
+	viper.SetDefault("dhcp.queue_size", 4096)
+	viper.SetDefault("dhcp.sockets_per_listen", 1)
+	viper.SetDefault("dhcp.batch_size", 1)
 	viper.SetDefault("dhcp.cleanup_interval", 5*time.Second)
 	viper.SetDefault("dhcp.cleanup_age", 60*time.Minute)
 	viper.SetDefault("dhcp.stats_interval", 1*time.Second)
+	viper.SetDefault("dhcp.segment_match", SEGMENT_MATCH_FIRST)
 	viper.SetDefault("aerospike.scan_timeout", 30*time.Second)
+	viper.SetDefault("metrics.prometheus_subnet_limit", 1000)
+	viper.SetDefault("metrics.measurement_alerts", "dhcp_alerts")
+	viper.SetDefault("alerts.util_warning", 80)
+	viper.SetDefault("alerts.util_critical", 95)
+	viper.SetDefault("alerts.webhook_timeout", 5*time.Second)
+	viper.SetDefault("alerts.webhook_retries", 3)
+	viper.SetDefault("alerts.exhausted_period", 5*time.Minute)
+	viper.SetDefault("events.queue_size", 10000)
+	viper.SetDefault("events.webhook_timeout", 5*time.Second)
+	viper.SetDefault("events.webhook_retries", 3)
 
 	o = &Opts{
 		ServerID: viper.GetString("server_id"),
@@ -99,14 +226,41 @@ func ConfigLoad() (o *Opts, err error) {
 		MetricsMeasurementStats:        viper.GetString("metrics.measurement_stats"),
 		MetricsMeasurementStatsSegment: viper.GetString("metrics.measurement_stats_segment"),
 		MetricsMeasurementCleanup:      viper.GetString("metrics.measurement_cleanup"),
-
-		DHCPListen:          viper.GetStringSlice("dhcp.listen"),
-		DHCPGraceTTL:        viper.GetDuration("dhcp.grace_ttl"),
-		DHCPRandomTries:     viper.GetInt("dhcp.random_tries"),
-		DHCPBufferSize:      viper.GetInt("dhcp.buffer_size"),
-		DHCPCleanupInterval: viper.GetDuration("dhcp.cleanup_interval"),
-		DHCPCleanupAge:      viper.GetDuration("dhcp.cleanup_age"),
-		DHCPStatsInterval:   viper.GetDuration("dhcp.stats_interval"),
+		MetricsMeasurementAlerts:       viper.GetString("metrics.measurement_alerts"),
+		MetricsPrometheusSubnetLimit:   viper.GetInt("metrics.prometheus_subnet_limit"),
+
+		DHCPBackend:          viper.GetString("dhcp.backend"),
+		DHCPDiskPath:         viper.GetString("dhcp.disk_path"),
+		DHCPListen:           viper.GetStringSlice("dhcp.listen"),
+		DHCPListenInterfaces: viper.GetStringSlice("dhcp.listen_interfaces"),
+		DHCPReplyToSource:    viper.GetBool("dhcp.reply_to_source"),
+		DHCPGraceTTL:         viper.GetDuration("dhcp.grace_ttl"),
+		DHCPRandomTries:      viper.GetInt("dhcp.random_tries"),
+		DHCPBufferSize:       viper.GetInt("dhcp.buffer_size"),
+		DHCPWorkers:          viper.GetInt("dhcp.workers"),
+		DHCPQueueSize:        viper.GetInt("dhcp.queue_size"),
+		DHCPSocketsPerListen: viper.GetInt("dhcp.sockets_per_listen"),
+		DHCPBatchSize:        viper.GetInt("dhcp.batch_size"),
+		DHCPCleanupInterval:  viper.GetDuration("dhcp.cleanup_interval"),
+		DHCPCleanupAge:       viper.GetDuration("dhcp.cleanup_age"),
+		DHCPStatsInterval:    viper.GetDuration("dhcp.stats_interval"),
+		DHCPSegmentMatch:     viper.GetString("dhcp.segment_match"),
+
+		AlertsUtil: UtilThresholds{
+			Warning:  viper.GetFloat64("alerts.util_warning"),
+			Critical: viper.GetFloat64("alerts.util_critical"),
+		},
+		AlertsWebhook:         viper.GetString("alerts.webhook"),
+		AlertsWebhookTimeout:  viper.GetDuration("alerts.webhook_timeout"),
+		AlertsWebhookRetries:  viper.GetInt("alerts.webhook_retries"),
+		AlertsExhaustedPeriod: viper.GetDuration("alerts.exhausted_period"),
+
+		EventsEnabled:        viper.GetBool("events.enable"),
+		EventsQueueSize:      viper.GetInt("events.queue_size"),
+		EventsFile:           viper.GetString("events.file"),
+		EventsWebhook:        viper.GetString("events.webhook"),
+		EventsWebhookTimeout: viper.GetDuration("events.webhook_timeout"),
+		EventsWebhookRetries: viper.GetInt("events.webhook_retries"),
 
 		ASHosts:       viper.GetStringSlice("aerospike.hosts"),
 		ASNamespace:   viper.GetString("aerospike.namespace"),
@@ -122,6 +276,14 @@ func ConfigLoad() (o *Opts, err error) {
 		return
 	}
 
+	// Interface listeners are bound to 0.0.0.0 as well, both sockets would get the same broadcasts
+	for _, v := range o.DHCPListen {
+		if IP := net.ParseIP(v); IP != nil && IP.IsUnspecified() && len(o.DHCPListenInterfaces) > 0 {
+			err = fmt.Errorf("dhcp.listen can't contain '%s' when dhcp.listen_interfaces are defined", v)
+			return
+		}
+	}
+
 	if o.DHCPGraceTTL <= 0 {
 		err = fmt.Errorf("dhcp.grace_ttl should be > 0")
 		return
@@ -132,13 +294,81 @@ func ConfigLoad() (o *Opts, err error) {
 		return
 	}
 
-	if o.ASSetLeases == "" {
-		err = fmt.Errorf("aerospike.set_leases should be defined")
+	if o.DHCPWorkers <= 0 {
+		err = fmt.Errorf("dhcp.workers should be > 0")
+		return
+	}
+
+	if o.DHCPQueueSize <= 0 {
+		err = fmt.Errorf("dhcp.queue_size should be > 0")
+		return
+	}
+
+	if o.DHCPSocketsPerListen <= 0 {
+		err = fmt.Errorf("dhcp.sockets_per_listen should be > 0")
+		return
+	}
+
+	if o.DHCPBatchSize <= 0 {
+		err = fmt.Errorf("dhcp.batch_size should be > 0")
+		return
+	}
+
+	if o.DHCPSegmentMatch != SEGMENT_MATCH_FIRST && o.DHCPSegmentMatch != SEGMENT_MATCH_UNIQUE {
+		err = fmt.Errorf("dhcp.segment_match can be either '%s' or '%s'", SEGMENT_MATCH_FIRST, SEGMENT_MATCH_UNIQUE)
+		return
+	}
+
+	if o.EventsEnabled && o.EventsQueueSize <= 0 {
+		err = fmt.Errorf("events.queue_size should be > 0")
+		return
+	}
+
+	if err = o.AlertsUtil.Validate(); err != nil {
+		err = fmt.Errorf("alerts: %s", err)
+		return
+	}
+
+	// Sorted to keep reload comparison stable
+	var SinkNames []string
+	for Name := range viper.GetStringMap("metrics.sinks") {
+		SinkNames = append(SinkNames, Name)
+	}
+	sort.Strings(SinkNames)
+
+	for _, Name := range SinkNames {
+		var c MetricsSinkConfig
+		if c, err = MetricsSinkConfigLoad(Name, viper.Sub("metrics.sinks."+Name)); err != nil {
+			return
+		}
+
+		o.MetricsSinks = append(o.MetricsSinks, c)
+	}
+
+	if o.DHCPRateLimit, err = RateLimitsLoad(viper.Sub("dhcp.rate_limit"), RateLimits{}); err != nil {
 		return
 	}
 
-	if o.ASSetSubnets == "" {
-		err = fmt.Errorf("aerospike.set_subnets should be defined")
+	switch o.DHCPBackend {
+	case BACKEND_HASH:
+		if o.ASSetLeases == "" {
+			err = fmt.Errorf("aerospike.set_leases should be defined")
+			return
+		}
+
+		if o.ASSetSubnets == "" {
+			err = fmt.Errorf("aerospike.set_subnets should be defined")
+			return
+		}
+
+	case BACKEND_DISK:
+		if o.DHCPDiskPath == "" {
+			err = fmt.Errorf("dhcp.disk_path should be defined")
+			return
+		}
+
+	default:
+		err = fmt.Errorf("dhcp.backend can be either '%s' or '%s'", BACKEND_HASH, BACKEND_DISK)
 		return
 	}
 
@@ -152,21 +382,21 @@ func ConfigLoad() (o *Opts, err error) {
 		return
 	}
 
-	log.SetLevel(o.LogrusLevel)
-	log.Warnf("Log level: %s", o.LogrusLevel)
+	// Config check sets its own level, so only the report is printed
+	if !CheckConfig {
+		log.SetLevel(o.LogrusLevel)
+		log.Warnf("Log level: %s", o.LogrusLevel)
+	}
 
-	if o.Syslog = viper.GetString("log.syslog"); o.Syslog == "local" {
-		SyslogEnable("", "")
-	} else if o.Syslog != "" {
-		if t := strings.Split(o.Syslog, "/"); len(t) != 2 || (t[1] != "udp" && t[1] != "tcp") {
-			err = fmt.Errorf("log.syslog can be either 'local' or 'host:port/protocol'")
+	o.Syslog = viper.GetString("log.syslog")
+
+	// Logrus hooks can't be removed, so syslog is set up only on the first load
+	if !SyslogConfigured {
+		if err = SyslogInit(o.Syslog); err != nil {
 			return
-		} else {
-			if err = SyslogEnable(t[1], t[0]); err != nil {
-				err = fmt.Errorf("Unable to enable syslog: %s", err)
-				return
-			}
 		}
+
+		SyslogConfigured = true
 	}
 
 	// Load segments
@@ -181,6 +411,7 @@ func ConfigLoad() (o *Opts, err error) {
 		Seg := &Segment{
 			Id:         SegCfg.GetInt("id"),
 			Name:       s,
+			Priority:   SegCfg.GetInt("priority"),
 			DetectRule: aux.ConvertStringIPandMACToInt(SegCfg.GetString("detect_rule")),
 		}
 		Seg.StatsInit()
@@ -190,12 +421,58 @@ func ConfigLoad() (o *Opts, err error) {
 			return
 		}
 
+		if Dup, ok := o.Segments[Seg.Id]; ok {
+			err = fmt.Errorf("Segments '%s' and '%s' have the same id %d", Dup.Name, Seg.Name, Seg.Id)
+			return
+		}
+
 		if Seg.DetectExpression, err = govaluate.NewEvaluableExpressionWithFunctions(Seg.DetectRule, goValuateFunctions); err != nil {
 			return
 		}
 
+		// Errors only mean that the rule is evaluated by govaluate
+		Seg.Matcher, _ = SegmentRuleCompile(Seg.DetectRule)
+
 		Seg.DNSRandom = SegCfg.GetBool("dns_random")
 
+		// Relays expect Option-82 to be echoed (RFC 3046), so it's enabled unless explicitly disabled
+		SegCfg.SetDefault("option82_echo", true)
+		Seg.Option82Echo = SegCfg.GetBool("option82_echo")
+
+		// Clients use 50% and 87.5% if T1/T2 are not sent (RFC 2131)
+		SegCfg.SetDefault("t1_ratio", 0.5)
+		SegCfg.SetDefault("t2_ratio", 0.875)
+
+		Seg.Lease = LeasePolicy{
+			Min:      SegCfg.GetDuration("lease_ttl_min"),
+			Max:      SegCfg.GetDuration("lease_ttl_max"),
+			OfferTTL: SegCfg.GetDuration("offer_ttl"),
+			T1:       SegCfg.GetFloat64("t1_ratio"),
+			T2:       SegCfg.GetFloat64("t2_ratio"),
+		}
+
+		if err = Seg.Lease.Validate(); err != nil {
+			err = fmt.Errorf("Segment '%s': %s", s, err)
+			return
+		}
+
+		// Global thresholds are used unless overridden by the segment
+		Seg.Util = o.AlertsUtil.Merge(UtilThresholds{
+			Warning:  SegCfg.GetFloat64("util_warning"),
+			Critical: SegCfg.GetFloat64("util_critical"),
+		})
+
+		if err = Seg.Util.Validate(); err != nil {
+			err = fmt.Errorf("Segment '%s': %s", s, err)
+			return
+		}
+
+		// Global limits are used unless overridden by the segment
+		if Seg.RateLimit, err = RateLimitsLoad(SegCfg.Sub("rate_limit"), o.DHCPRateLimit); err != nil {
+			err = fmt.Errorf("Segment '%s': %s", s, err)
+			return
+		}
+
 		SegCfgAM := SegCfg.Sub("automode")
 		if SegCfgAM == nil {
 			goto result
@@ -207,14 +484,46 @@ func ConfigLoad() (o *Opts, err error) {
 			return
 		}
 
-		if Seg.AutoModeRangeStart = aux.IPStrToInt(SegCfgAM.GetString("range_start")); Seg.AutoModeRangeStart == 0 {
-			err = errors.New("Wrong range_start")
-			return
+		// Either a single range_start - range_end pair or a list of ranges
+		if SegCfgAM.IsSet("ranges") {
+			for _, v := range SegCfgAM.GetStringSlice("ranges") {
+				var r IPRange
+				if r, err = ParseIPRange(v); err != nil || r.Start == 0 {
+					err = fmt.Errorf("Wrong range '%s'", v)
+					return
+				}
+
+				Seg.AutoModeRanges = append(Seg.AutoModeRanges, r)
+			}
+
+			if len(Seg.AutoModeRanges) == 0 {
+				err = errors.New("ranges should contain at least one range")
+				return
+			}
+
+			Seg.AutoModeRangeStart, Seg.AutoModeRangeEnd = Seg.AutoModeRanges[0].Start, Seg.AutoModeRanges[0].End
+		} else {
+			if Seg.AutoModeRangeStart = aux.IPStrToInt(SegCfgAM.GetString("range_start")); Seg.AutoModeRangeStart == 0 {
+				err = errors.New("Wrong range_start")
+				return
+			}
+
+			if Seg.AutoModeRangeEnd = aux.IPStrToInt(SegCfgAM.GetString("range_end")); Seg.AutoModeRangeEnd == 0 {
+				err = errors.New("Wrong range_end")
+				return
+			}
+
+			Seg.AutoModeRanges = []IPRange{{Start: Seg.AutoModeRangeStart, End: Seg.AutoModeRangeEnd}}
 		}
 
-		if Seg.AutoModeRangeEnd = aux.IPStrToInt(SegCfgAM.GetString("range_end")); Seg.AutoModeRangeEnd == 0 {
-			err = errors.New("Wrong range_end")
-			return
+		for _, v := range SegCfgAM.GetStringSlice("exclude") {
+			var r IPRange
+			if r, err = ParseIPRange(v); err != nil || r.Start == 0 {
+				err = fmt.Errorf("Wrong exclusion '%s'", v)
+				return
+			}
+
+			Seg.AutoModeExclusions = append(Seg.AutoModeExclusions, r)
 		}
 
 		if Seg.AutoModeRouter = aux.IPStrToInt(SegCfgAM.GetString("router")); Seg.AutoModeRouter == 0 {
@@ -227,6 +536,22 @@ func ConfigLoad() (o *Opts, err error) {
 			return
 		}
 
+		for _, v := range SegCfgAM.GetStringSlice("routes") {
+			var r ClasslessRoute
+			if r, err = ParseClasslessRoute(v); err != nil {
+				err = fmt.Errorf("Segment '%s': automode routes: %s", s, err)
+				return
+			}
+
+			Seg.AutoModeRoutes = append(Seg.AutoModeRoutes, r)
+		}
+
+		// Default route is appended to the routes, so account it too
+		if n := len(ClasslessRoutesEncode(Seg.AutoModeRoutes)) + 5; len(Seg.AutoModeRoutes) > 0 && n > 255 {
+			err = errors.New("routes are longer than 255 bytes when encoded")
+			return
+		}
+
 		for _, v := range SegCfgAM.GetStringSlice("dns") {
 			if ip := net.ParseIP(v); ip != nil {
 				Seg.AutoModeDNS = append(Seg.AutoModeDNS, ip)
@@ -247,15 +572,24 @@ func ConfigLoad() (o *Opts, err error) {
 		var b bytes.Buffer
 		w := tabwriter.NewWriter(&b, 0, 0, 3, ' ', 0)
 		fmt.Fprintf(w, "Segment '%s' (id %d):\n", Seg.Name, Seg.Id)
+		fmt.Fprintf(w, " Priority:\t%d\n", Seg.Priority)
 		fmt.Fprintf(w, " Detect Rule:\t%s\n", SegCfg.GetString("detect_rule"))
 		fmt.Fprintf(w, " Detect Rule (converted):\t%s\n", Seg.DetectRule)
+		fmt.Fprintf(w, " Detect Rule (compiled):\t%t\n", Seg.Matcher != nil)
 		fmt.Fprintf(w, " DNS Random:\t%t\n", Seg.DNSRandom)
+		fmt.Fprintf(w, " Option-82 Echo:\t%t\n", Seg.Option82Echo)
+		fmt.Fprintf(w, " Lease Policy:\t%s\n", Seg.Lease)
+		fmt.Fprintf(w, " Utilization Alerts:\t%s\n", Seg.Util)
+		fmt.Fprintf(w, " Rate Limit [MAC]:\t%s\n", Seg.RateLimit.MAC)
+		fmt.Fprintf(w, " Rate Limit [Relay IP]:\t%s\n", Seg.RateLimit.RelayIP)
 		fmt.Fprintf(w, " Automode:\t%t\n", Seg.AutoMode)
 
 		if Seg.AutoMode {
 			fmt.Fprintf(w, "  Mask:\t%s\n", aux.IPIntToStr(Seg.AutoModeMask))
-			fmt.Fprintf(w, "  Range:\t%s - %s (%d hosts)\n", aux.IPIntToStr(Seg.AutoModeRangeStart), aux.IPIntToStr(Seg.AutoModeRangeEnd), Seg.AutoModeRangeEnd-Seg.AutoModeRangeStart+1)
+			fmt.Fprintf(w, "  Ranges:\t%s\n", IPRangesString(Seg.AutoModeRanges))
+			fmt.Fprintf(w, "  Exclusions:\t%s\n", IPRangesString(Seg.AutoModeExclusions))
 			fmt.Fprintf(w, "  Router:\t%s\n", aux.IPIntToStr(Seg.AutoModeRouter))
+			fmt.Fprintf(w, "  Routes:\t%s\n", strings.Join(SegCfgAM.GetStringSlice("routes"), ", "))
 			fmt.Fprintf(w, "  Lease TTL:\t%s\n", Seg.AutoModeLeaseTTL)
 			fmt.Fprintf(w, "  DNS:\t%s\n", strings.Join(SegCfgAM.GetStringSlice("dns"), ", "))
 		}
@@ -271,5 +605,15 @@ func ConfigLoad() (o *Opts, err error) {
 		return
 	}
 
+	o.SegmentsOrdered = SegmentsOrder(o.Segments)
+	for _, v := range SegmentsCheckOverlap(o.SegmentsOrdered, o.DHCPSegmentMatch) {
+		log.Warnf(v)
+	}
+
+	if o.Classes, err = ClassesLoad(); err != nil {
+		return
+	}
+	ClassesDump(o.Classes)
+
 	return
 }
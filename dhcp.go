@@ -5,13 +5,16 @@ import (
 	dhcp "mt-aux/dhcp"
 	"mt-aux/maps"
 	"net"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/ipv4"
 )
 
 const (
 	LEASE_SRC_EXISTING = "Existing"
+	LEASE_SRC_RESERVED = "Reserved"
 	LEASE_SRC_RANDOM   = "Random"
 	LEASE_SRC_RANGE    = "Range"
 )
@@ -26,12 +29,16 @@ const (
 	DROPREASON_MALFORMED_PACKET    = "MalformedPacket"
 	DROPREASON_RELAYIP_NOT_FOUND   = "RelayIPNotFound"
 	DROPREASON_UNKNOWN_SEGMENT     = "UnknownSegment"
+	DROPREASON_AMBIGUOUS_SEGMENT   = "AmbiguousSegment"
 	DROPREASON_CONCURRENT_REQUEST  = "ConcurrentRequest"
 	DROPREASON_BACKEND_ERROR       = "BackendError"
 	DROPREASON_NO_FREE_LEASES      = "NoFreeLeases"
+	DROPREASON_RESERVED_OCCUPIED   = "ReservedOccupied"
 	DROPREASON_INCORRECT_SERVER    = "IncorrectServer"
 	DROPREASON_NO_REQUESTED_IP     = "NoRequestedIP"
 	DROPREASON_UNSUPPORTED_REQUEST = "UnsupportedRequest"
+	DROPREASON_OVERLOAD            = "Overload"
+	DROPREASON_RATE_LIMITED        = "RateLimited"
 )
 
 var (
@@ -39,14 +46,29 @@ var (
 	RequestLock maps.ConcurrentMapUint64
 )
 
-// Main worker function - handles incoming DHCP packets
-func DHCPHandleRequest(p dhcp.Packet, msgType dhcp.MessageType, options dhcp.Options, LocalAddr net.IP, RemoteAddr net.IP) (d dhcp.Packet) {
+type DHCPListener struct {
+	Conn      *net.UDPConn
+	LocalAddr net.IP
+
+	// Interface-bound listeners only: directly connected clients are
+	// served from the subnet of interface's address
+	Iface   *net.Interface
+	IfaceIP uint32
+	Raw     *RawSender
+}
+
+// Main worker function - handles incoming DHCP packets.
+// Also returns dhcp.reply_to_source, as options may be swapped by reload once the lock is released
+func DHCPHandleRequest(p dhcp.Packet, msgType dhcp.MessageType, options dhcp.Options, Listener *DHCPListener, RemoteAddr net.IP) (d dhcp.Packet, ReplyToSource bool) {
 	var err error
+	LocalAddr := Listener.LocalAddr
 
 	// Pause if cache reloading is in progress
 	CacheReloadingMtx.RLock()
 	defer CacheReloadingMtx.RUnlock()
 
+	ReplyToSource = o.DHCPReplyToSource
+
 	// Initialize request context
 	Ctx := &ReqCtx{
 		RequestStart: time.Now(),
@@ -79,7 +101,12 @@ func DHCPHandleRequest(p dhcp.Packet, msgType dhcp.MessageType, options dhcp.Opt
 		goto Option82Done
 	}
 
+	// Keep it to echo back to relay in reply
+	Ctx.Option82Raw = Option82Raw
+
 	Option82 = dhcp.ParseOption82(Option82Raw)
+	Ctx.Option82 = Option82
+
 	// Check if there's an Link-Selection sub-option
 	if LinkSelection = Option82[dhcp.Option82LinkSelection]; LinkSelection == nil {
 		Ctx.LogWarnf("No Link-Selection suboption in Option-82 found")
@@ -110,6 +137,13 @@ Option82Done:
 		goto RelayIPObtained
 	}
 
+	// Directly connected client on interface-bound listener, use interface's address
+	if Listener.Iface != nil {
+		Ctx.SetRelayIP(Listener.IfaceIP)
+		Ctx.RelayIPSource = STATS_RELAYIP_INTERFACE
+		goto RelayIPObtained
+	}
+
 	// This is the case when client directly talks unicast to DHCP server
 	if msgType != dhcp.Request {
 		Ctx.LogWarnf("Cannot obtain requested IP")
@@ -133,6 +167,8 @@ Option82Done:
 	}
 
 RelayIPObtained:
+	Ctx.ParseClientAttributes()
+
 	// Drop packets with zero MAC
 	if Ctx.MAC == 0 {
 		Ctx.LogWarnf("MAC is zero, dropping request")
@@ -141,17 +177,31 @@ RelayIPObtained:
 		goto Drop
 	}
 
-	// Drop request if segment wasn't detected
-	if Ctx.SegmentEvaluate(); Ctx.Segment == nil {
+	// Drop request if segment wasn't detected or is ambiguous
+	if n := Ctx.SegmentEvaluate(); n == 0 {
 		Ctx.LogWarnf("Unable to detect segment, dropping request")
 		Stats.Inc(STATS_ERRORS_UNKNOWN_SEGMENT)
 		Ctx.DropReason = DROPREASON_UNKNOWN_SEGMENT
 		goto Drop
+	} else if n > 1 {
+		Ctx.LogWarnf("Request matches %d segments, dropping request", n)
+		Stats.Inc(STATS_ERRORS_AMBIGUOUS_SEGMENT)
+		Ctx.DropReason = DROPREASON_AMBIGUOUS_SEGMENT
+		Ctx.Segment, Ctx.SegmentCopy = nil, nil
+		goto Drop
 	}
 
 	Ctx.FillLogFields()
 	Ctx.LogDebugf("Segment '%s' detected", Ctx.Segment.Name)
 
+	// Drop clients and relays which send requests too often
+	if !Ctx.RateLimitAllow() {
+		Stats.Inc(STATS_ERRORS_RATE_LIMITED)
+		Ctx.StatsInc(STATS_ERRORS_RATE_LIMITED)
+		Ctx.DropReason = DROPREASON_RATE_LIMITED
+		goto Drop
+	}
+
 	// Find subnet
 	if Ctx.ObtainSubnet(); Ctx.Subnet == nil {
 		Ctx.LogWarnf("Relay IP '%s' does not belong to any configured subnet, dropping request", Ctx.RelayIPStr)
@@ -164,6 +214,7 @@ RelayIPObtained:
 	Ctx.StatsIncBy(uint64(Ctx.RequestSize), STATS_BYTES_IN)
 	Ctx.StatsInc(Ctx.RelayIPSource)
 	Ctx.LogDebugf("Subnet detected: %s", Ctx.Subnet.NetStr)
+	Ctx.ClassEvaluate()
 
 	// Check if we're already working on a request for this MAC
 	if !Ctx.WorkStart() {
@@ -185,14 +236,17 @@ RelayIPObtained:
 		}
 
 		if Ctx.IP == 0 {
-			Ctx.LogWarnf("No free leases found")
-			Ctx.DropReason = DROPREASON_NO_FREE_LEASES
+			// Backend could have given the reason already
+			if Ctx.DropReason == "" {
+				Ctx.LogWarnf("No free leases found")
+				Ctx.DropReason = DROPREASON_NO_FREE_LEASES
+			}
 			break
 		}
 
 		Ctx.AddDNS()
 		Ctx.LogDebugf("Offering address: %s", Ctx.IPStr)
-		return Ctx.GenerateReply(dhcp.Offer)
+		return Ctx.GenerateReply(dhcp.Offer), ReplyToSource
 
 	case dhcp.Request:
 		Ctx.StatsInc(STATS_REQUESTS_REQUEST)
@@ -219,7 +273,14 @@ RelayIPObtained:
 		if (Ctx.IP & Ctx.Subnet.Mask) != Ctx.Subnet.Net {
 			Ctx.LogDebugf("Requested IP (%s) does not match subnet (%s), NAK", Ctx.IPStr, Ctx.Subnet.NetStr)
 			Ctx.NAKReason = "IPSubnetMismatch"
-			return Ctx.GenerateReply(dhcp.NAK)
+			return Ctx.GenerateReply(dhcp.NAK), ReplyToSource
+		}
+
+		// Client with a reservation should not keep any other address
+		if Ctx.Reservation != nil && Ctx.IP != Ctx.Reservation.IP {
+			Ctx.LogDebugf("Requested IP (%s) does not match reserved IP (%s), NAK", Ctx.IPStr, aux.IPIntToStr(Ctx.Reservation.IP))
+			Ctx.NAKReason = "IPReservationMismatch"
+			return Ctx.GenerateReply(dhcp.NAK), ReplyToSource
 		}
 
 		// Try to fetch MAC from client's lease created on DISCOVER stage (or on previous REQUEST - renewal) and compare it to client's MAC
@@ -231,12 +292,12 @@ RelayIPObtained:
 
 		if Ctx.Lease == nil {
 			Ctx.NAKReason = "LeaseNotFound"
-			return Ctx.GenerateReply(dhcp.NAK)
+			return Ctx.GenerateReply(dhcp.NAK), ReplyToSource
 		}
 
 		Ctx.LogDebugf("ACKing lease: %s", Ctx.IPStr)
 		Ctx.AddDNS()
-		return Ctx.GenerateReply(dhcp.ACK)
+		return Ctx.GenerateReply(dhcp.ACK), ReplyToSource
 
 	case dhcp.Release:
 		Ctx.StatsInc(STATS_REQUESTS_RELEASE)
@@ -254,7 +315,7 @@ RelayIPObtained:
 		// Delete lease if client's MAC matches lease's MAC
 		DHCPBackend.LeaseCheckAndDelete(Ctx)
 
-		return Ctx.GenerateReply(dhcp.Drop)
+		return Ctx.GenerateReply(dhcp.Drop), ReplyToSource
 
 	case dhcp.Decline:
 		Ctx.StatsInc(STATS_REQUESTS_DECLINE)
@@ -280,7 +341,7 @@ RelayIPObtained:
 		Ctx.AddDNS()
 		Ctx.WorkFinish()
 
-		return Ctx.GenerateReply(dhcp.ACK)
+		return Ctx.GenerateReply(dhcp.ACK), ReplyToSource
 
 	default:
 		Ctx.StatsInc(STATS_ERRORS_OTHER)
@@ -289,11 +350,11 @@ RelayIPObtained:
 	}
 
 Drop:
-	return Ctx.GenerateReply(dhcp.Drop)
+	return Ctx.GenerateReply(dhcp.Drop), ReplyToSource
 }
 
 // Gets & parses DHCP packets from buffer and dispatches them to work
-func DHCPHandleConnection(Conn *net.UDPConn, Buffer []byte, RemoteAddr *net.UDPAddr, LocalAddr net.IP) {
+func DHCPHandleConnection(Listener *DHCPListener, Buffer []byte, RemoteAddr *net.UDPAddr) {
 	var (
 		RequestType dhcp.MessageType
 		n           int
@@ -327,10 +388,18 @@ func DHCPHandleConnection(Conn *net.UDPConn, Buffer []byte, RemoteAddr *net.UDPA
 	}
 
 	// Process DHCP request
-	if res := DHCPHandleRequest(Packet, RequestType, options, LocalAddr, RemoteAddr.IP); res != nil {
-		if n, err = Conn.WriteToUDP(res, RemoteAddr); err != nil {
+	if res, ReplyToSource := DHCPHandleRequest(Packet, RequestType, options, Listener, RemoteAddr.IP); res != nil {
+		Dst, ToCHAddr := ReplyDestination(Packet, res, RemoteAddr, Listener.Raw != nil, ReplyToSource)
+
+		if ToCHAddr {
+			n, err = Listener.Raw.Send(res, Packet.CHAddr(), Listener.LocalAddr, Dst)
+		} else {
+			n, err = Listener.Conn.WriteToUDP(res, Dst)
+		}
+
+		if err != nil {
 			Stats.Inc(STATS_ERRORS_OTHER)
-			log.Errorf("Unable to send packet to %s, error: %s", RemoteAddr.IP.String(), err)
+			log.Errorf("Unable to send packet to %s, error: %s", Dst.String(), err)
 			return
 		}
 
@@ -345,59 +414,158 @@ func init() {
 	RequestLock = maps.NewConcurrentMapUint64()
 }
 
-// Initializes DHCP socket and handles requests
+// Initializes DHCP sockets and handles requests
 func DHCPServe(LocalAddr net.IP) {
 	var (
-		RemoteAddr *net.UDPAddr
-		Conn       *net.UDPConn
-
-		n   int
+		wg  sync.WaitGroup
 		err error
 	)
 
-	if Conn, err = net.ListenUDP("udp4", &net.UDPAddr{
-		IP:   LocalAddr,
-		Port: 67,
-	}); err != nil {
-		log.Fatalf("ListenUDP error: %s", err)
+	for i := 0; i < o.DHCPSocketsPerListen; i++ {
+		Listener := &DHCPListener{
+			LocalAddr: LocalAddr,
+		}
+
+		if Listener.Conn, err = DHCPListenUDP(&net.UDPAddr{
+			IP:   LocalAddr,
+			Port: DHCP_PORT_SERVER,
+		}, o.DHCPSocketsPerListen > 1); err != nil {
+			log.Fatalf("ListenUDP error: %s", err)
+		}
+
+		wg.Add(1)
+		go func(Listener *DHCPListener) {
+			defer wg.Done()
+			DHCPReceive(Listener)
+		}(Listener)
+	}
+
+	log.Warnf("Listening to %s (%d sockets)", LocalAddr.String(), o.DHCPSocketsPerListen)
+	wg.Wait()
+}
+
+// Initializes DHCP socket bound to the interface and handles requests
+func DHCPServeInterface(Name string) {
+	Listener, err := DHCPListenInterface(Name)
+	if err != nil {
+		log.Fatalf("Unable to listen to interface %s: %s", Name, err)
 	}
 
-	log.Warnf("Listening to %s", LocalAddr.String())
+	log.Warnf("Listening to interface %s (%s)", Name, Listener.LocalAddr.String())
+	DHCPReceive(Listener)
+}
+
+// Reads DHCP packets from listener's socket and dispatches them for processing
+func DHCPReceive(Listener *DHCPListener) {
+	var (
+		RemoteAddr *net.UDPAddr
+		Conn       = Listener.Conn
+		Buffer     *[]byte
+
+		n   int
+		err error
+	)
 
 	// Set I/O buffers to handle traffic spikes
 	Conn.SetReadBuffer(o.DHCPBufferSize)
 	Conn.SetWriteBuffer(o.DHCPBufferSize)
 
-	// Main working loop: receives DHCP packets and dispatches them to goroutines for processing
+	if o.DHCPBatchSize > 1 {
+		DHCPReceiveBatch(Listener)
+		return
+	}
+
+	// Main working loop: receives DHCP packets and dispatches them to workers for processing
 	for {
-		// It seems that DHCP packets cannot be larger than 576 bytes
-		Buffer := make([]byte, 576)
-		n, RemoteAddr, err = Conn.ReadFromUDP(Buffer)
-		Stats.Inc(STATS_REQUESTS_TOTAL)
-		Stats.Inc(STATS_PACKETS_IN)
-		Stats.IncBy(uint64(n), STATS_BYTES_IN)
-
-		// Abort if error and it's not temporary
-		if err != nil {
-			if !err.(*net.OpError).Temporary() {
-				log.Errorf("Fatal ReadFromUDP() error: %s", err)
+		// Buffer is kept for the next read if the packet wasn't queued
+		if Buffer == nil {
+			Buffer = DHCPBufferPool.Get().(*[]byte)
+		}
+
+		if n, RemoteAddr, err = Conn.ReadFromUDP(*Buffer); err != nil {
+			if !DHCPReceiveError(err) {
 				break
-			} else {
-				log.Warnf("Temporary ReadFromUDP() error: %s", err)
-				Stats.Inc(STATS_ERRORS_OTHER)
-				continue
+			}
+
+			continue
+		}
+
+		if DHCPPacketReceived(Listener, Buffer, n, RemoteAddr) {
+			Buffer = nil
+		}
+	}
+}
+
+// Same as DHCPReceive, but reads up to dhcp.batch_size packets per syscall (recvmmsg on Linux)
+func DHCPReceiveBatch(Listener *DHCPListener) {
+	var (
+		n   int
+		err error
+	)
+
+	Conn := ipv4.NewPacketConn(Listener.Conn)
+	Messages := make([]ipv4.Message, o.DHCPBatchSize)
+	Buffers := make([]*[]byte, o.DHCPBatchSize)
+
+	for {
+		// Replace buffers which were queued to workers
+		for i := range Messages {
+			if Buffers[i] == nil {
+				Buffers[i] = DHCPBufferPool.Get().(*[]byte)
+				Messages[i].Buffers = [][]byte{*Buffers[i]}
 			}
 		}
 
-		// Skip too small packets
-		if n < 240 {
-			Stats.Inc(STATS_ERRORS_MALFORMED_PACKET)
-			log.Warnf("Packet from %s is too small to be DHCP (%d bytes) - dropping", RemoteAddr.IP.String(), n)
+		if n, err = Conn.ReadBatch(Messages, 0); err != nil {
+			if !DHCPReceiveError(err) {
+				break
+			}
+
 			continue
 		}
 
-		// Dispatch work to goroutine
-		Buffer = Buffer[:n]
-		go DHCPHandleConnection(Conn, Buffer, RemoteAddr, LocalAddr)
+		for i := 0; i < n; i++ {
+			RemoteAddr, ok := Messages[i].Addr.(*net.UDPAddr)
+			if !ok {
+				continue
+			}
+
+			if DHCPPacketReceived(Listener, Buffers[i], Messages[i].N, RemoteAddr) {
+				Buffers[i] = nil
+			}
+		}
+	}
+}
+
+// Returns false if the error is fatal and receiving should be stopped
+func DHCPReceiveError(err error) bool {
+	if e, ok := err.(net.Error); !ok || !e.Temporary() {
+		log.Errorf("Fatal ReadFromUDP() error: %s", err)
+		return false
+	}
+
+	log.Warnf("Temporary ReadFromUDP() error: %s", err)
+	Stats.Inc(STATS_ERRORS_OTHER)
+	return true
+}
+
+// Accounts received packet and queues it to workers, returns true if the buffer was queued
+func DHCPPacketReceived(Listener *DHCPListener, Buffer *[]byte, n int, RemoteAddr *net.UDPAddr) bool {
+	Stats.Inc(STATS_REQUESTS_TOTAL)
+	Stats.Inc(STATS_PACKETS_IN)
+	Stats.IncBy(uint64(n), STATS_BYTES_IN)
+
+	// Skip too small packets
+	if n < 240 {
+		Stats.Inc(STATS_ERRORS_MALFORMED_PACKET)
+		log.Warnf("Packet from %s is too small to be DHCP (%d bytes) - dropping", RemoteAddr.IP.String(), n)
+		return false
 	}
+
+	return DHCPDispatch(DHCPJob{
+		Listener:   Listener,
+		Buffer:     Buffer,
+		Size:       n,
+		RemoteAddr: RemoteAddr,
+	})
 }
@@ -0,0 +1,156 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	aux "mt-aux"
+	"net"
+	"syscall"
+)
+
+// Sends IPv4/UDP packets directly to client's hardware address through AF_PACKET socket.
+// It's needed to unicast OFFER to the client which does not have an address yet,
+// because kernel would try to resolve yiaddr with ARP which client can't answer
+type RawSender struct {
+	fd      int
+	ifindex int
+}
+
+func NewRawSender(Iface *net.Interface) (r *RawSender, err error) {
+	r = &RawSender{
+		ifindex: Iface.Index,
+	}
+
+	if r.fd, err = syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM, int(htons(syscall.ETH_P_IP))); err != nil {
+		return nil, fmt.Errorf("Unable to create AF_PACKET socket: %s", err)
+	}
+
+	return
+}
+
+func (r *RawSender) Send(Payload []byte, CHAddr net.HardwareAddr, Src net.IP, Dst *net.UDPAddr) (n int, err error) {
+	b := make([]byte, 28+len(Payload))
+
+	// IPv4 header
+	b[0] = 0x45 // Version 4, 20 bytes header
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+	b[8] = 64 // TTL
+	b[9] = syscall.IPPROTO_UDP
+	copy(b[12:16], Src.To4())
+	copy(b[16:20], Dst.IP.To4())
+	binary.BigEndian.PutUint16(b[10:], checksumFold(checksumAdd(b[:20], 0)))
+
+	// UDP header
+	binary.BigEndian.PutUint16(b[20:], DHCP_PORT_SERVER)
+	binary.BigEndian.PutUint16(b[22:], uint16(Dst.Port))
+	binary.BigEndian.PutUint16(b[24:], uint16(8+len(Payload)))
+	copy(b[28:], Payload)
+
+	// UDP checksum covers pseudo header: addresses, protocol and UDP length
+	sum := checksumAdd(b[12:20], uint32(syscall.IPPROTO_UDP)+uint32(8+len(Payload)))
+	if c := checksumFold(checksumAdd(b[20:], sum)); c != 0 {
+		binary.BigEndian.PutUint16(b[26:], c)
+	} else {
+		binary.BigEndian.PutUint16(b[26:], 0xffff)
+	}
+
+	sa := &syscall.SockaddrLinklayer{
+		Protocol: htons(syscall.ETH_P_IP),
+		Ifindex:  r.ifindex,
+		Halen:    uint8(len(CHAddr)),
+	}
+	copy(sa.Addr[:], CHAddr)
+
+	if err = syscall.Sendto(r.fd, b, 0, sa); err != nil {
+		return
+	}
+
+	return len(Payload), nil
+}
+
+// Opens UDP socket bound to the interface and raw socket for unicast replies
+func DHCPListenInterface(Name string) (Listener *DHCPListener, err error) {
+	var (
+		Addrs []net.Addr
+		Conn  net.PacketConn
+	)
+
+	Listener = &DHCPListener{}
+	if Listener.Iface, err = net.InterfaceByName(Name); err != nil {
+		return
+	}
+
+	if Addrs, err = Listener.Iface.Addrs(); err != nil {
+		return
+	}
+
+	// First IPv4 address of the interface is used as Relay IP & Server ID
+	for _, a := range Addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.To4() != nil {
+			Listener.LocalAddr = n.IP.To4()
+			break
+		}
+	}
+
+	if Listener.LocalAddr == nil {
+		err = errors.New("Interface has no IPv4 address")
+		return
+	}
+
+	Listener.IfaceIP = aux.IPNetToInt(Listener.LocalAddr)
+
+	// Broadcasts are received only by sockets bound to 0.0.0.0,
+	// so several interfaces share the port and are separated by SO_BINDTODEVICE
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) (err error) {
+			if cerr := c.Control(func(fd uintptr) {
+				if err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+					return
+				}
+
+				err = syscall.BindToDevice(int(fd), Name)
+			}); cerr != nil {
+				return cerr
+			}
+
+			return
+		},
+	}
+
+	if Conn, err = lc.ListenPacket(context.Background(), "udp4", fmt.Sprintf("0.0.0.0:%d", DHCP_PORT_SERVER)); err != nil {
+		return
+	}
+
+	Listener.Conn = Conn.(*net.UDPConn)
+	Listener.Raw, err = NewRawSender(Listener.Iface)
+	return
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+func checksumAdd(b []byte, sum uint32) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+
+	return sum
+}
+
+func checksumFold(sum uint32) uint16 {
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+
+	return ^uint16(sum)
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+type RawSender struct{}
+
+func (r *RawSender) Send(Payload []byte, CHAddr net.HardwareAddr, Src net.IP, Dst *net.UDPAddr) (int, error) {
+	return 0, errors.New("Raw sockets are supported only on Linux")
+}
+
+func DHCPListenInterface(Name string) (*DHCPListener, error) {
+	return nil, errors.New("Interface-bound listening is supported only on Linux")
+}
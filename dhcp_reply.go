@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/binary"
+	dhcp "mt-aux/dhcp"
+	"net"
+)
+
+const (
+	DHCP_PORT_SERVER = 67
+	DHCP_PORT_CLIENT = 68
+
+	DHCP_MIN_MESSAGE_SIZE = 576  // Every client must accept it (RFC 2131)
+	DHCP_MAX_MESSAGE_SIZE = 1500 // Avoid IP fragmentation regardless of what client allows
+	DHCP_IPUDP_HEADERS    = 28
+	DHCP_OPTIONS_OFFSET   = 240
+	DHCP_MAX_OPTION_SIZE  = 255
+	BOOTP_MIN_SIZE        = 300
+)
+
+// Values of Option Overload (52)
+const (
+	OVERLOAD_FILE  = 1
+	OVERLOAD_SNAME = 2
+)
+
+// Builds reply to Request. Mandatory options go first, then Options ordered and filtered
+// by client's Parameter Request List, Tail (Relay Agent Information) is always the last one.
+// Options that don't fit into the size client accepts are overloaded into file & sname fields (RFC 2131),
+// those that don't fit at all are dropped and returned
+func BuildReply(Request dhcp.Packet, RequestOptions dhcp.Options, Mandatory, Options, Tail []dhcp.Option, YIAddr net.IP) (Reply dhcp.Packet, Dropped []dhcp.OptionCode) {
+	var (
+		// Space left in options, file & sname fields, each needs 1 byte for End
+		Free     = [3]int{ReplyMaxSize(RequestOptions) - DHCP_OPTIONS_OFFSET - 1, 128 - 1, 64 - 1}
+		Fields   [3][]byte
+		Overload byte
+	)
+
+	// Tail and possible Option Overload are always in options field
+	for _, Opt := range Tail {
+		Free[0] -= 2 + len(Opt.Value)
+	}
+	Free[0] -= 3
+
+	for _, Opt := range Mandatory {
+		Fields[0] = append(Fields[0], byte(Opt.Code), byte(len(Opt.Value)))
+		Fields[0] = append(Fields[0], Opt.Value...)
+		Free[0] -= 2 + len(Opt.Value)
+	}
+
+	for _, Opt := range ReplyOptionsOrder(Options, Mandatory, RequestOptions[dhcp.OptionParameterRequestList]) {
+		// Long options are split into several instances (RFC 3396)
+		var Chunks [][]byte
+		for v := Opt.Value; len(v) > 0; {
+			n := len(v)
+			if n > DHCP_MAX_OPTION_SIZE {
+				n = DHCP_MAX_OPTION_SIZE
+			}
+
+			Chunks = append(Chunks, v[:n])
+			v = v[n:]
+		}
+
+		// Find the place for every chunk first, so the option is never sent partially.
+		// Receiver concatenates options, file & sname fields in that order (RFC 3396),
+		// so a chunk can't go to a field before the one of the previous chunk
+		Place, F := make([]int, len(Chunks)), Free
+	Placing:
+		for i, Chunk := range Chunks {
+			f := 0
+			if i > 0 {
+				f = Place[i-1]
+			}
+
+			for ; f < len(F); f++ {
+				if 2+len(Chunk) <= F[f] {
+					F[f] -= 2 + len(Chunk)
+					Place[i] = f
+					continue Placing
+				}
+			}
+
+			Dropped = append(Dropped, Opt.Code)
+			Place = nil
+			break
+		}
+
+		if Place == nil {
+			continue
+		}
+
+		for i, Chunk := range Chunks {
+			f := Place[i]
+			Fields[f] = append(Fields[f], byte(Opt.Code), byte(len(Chunk)))
+			Fields[f] = append(Fields[f], Chunk...)
+
+			switch f {
+			case 1:
+				Overload |= OVERLOAD_FILE
+			case 2:
+				Overload |= OVERLOAD_SNAME
+			}
+		}
+
+		Free = F
+	}
+
+	Reply = dhcp.NewPacket(dhcp.BootReply)
+	Reply.SetXId(Request.XId())
+	Reply.SetFlags(Request.Flags())
+	Reply.SetGIAddr(Request.GIAddr())
+	Reply.SetCHAddr(Request.CHAddr())
+	if YIAddr != nil {
+		Reply.SetYIAddr(YIAddr)
+	}
+
+	Reply = append(Reply[:DHCP_OPTIONS_OFFSET], Fields[0]...)
+	if Overload > 0 {
+		Reply = append(Reply, byte(dhcp.OptionOverload), 1, Overload)
+	}
+
+	for _, Opt := range Tail {
+		Reply = append(Reply, byte(Opt.Code), byte(len(Opt.Value)))
+		Reply = append(Reply, Opt.Value...)
+	}
+	Reply = append(Reply, byte(dhcp.End))
+
+	// Rest of the fields is already zeroed, which is Pad
+	if Overload&OVERLOAD_FILE > 0 {
+		copy(Reply[108:236], append(Fields[1], byte(dhcp.End)))
+	}
+
+	if Overload&OVERLOAD_SNAME > 0 {
+		copy(Reply[44:108], append(Fields[2], byte(dhcp.End)))
+	}
+
+	// Some old clients drop packets smaller than minimal BOOTP message
+	if len(Reply) < BOOTP_MIN_SIZE {
+		Reply = append(Reply, make([]byte, BOOTP_MIN_SIZE-len(Reply))...)
+	}
+
+	return
+}
+
+// Maximum size of DHCP message client accepts: option 57 includes IP & UDP headers
+func ReplyMaxSize(RequestOptions dhcp.Options) int {
+	Size := DHCP_MIN_MESSAGE_SIZE
+
+	if v := RequestOptions[dhcp.OptionMaximumDHCPMessageSize]; len(v) == 2 {
+		if m := int(binary.BigEndian.Uint16(v)); m > Size {
+			Size = m
+		}
+	}
+
+	if Size > DHCP_MAX_MESSAGE_SIZE {
+		Size = DHCP_MAX_MESSAGE_SIZE
+	}
+
+	return Size - DHCP_IPUDP_HEADERS
+}
+
+// Merges options with the same code into one and orders them by Parameter Request List,
+// options which weren't requested are skipped. Without PRL all options are sent in configured order
+func ReplyOptionsOrder(Options, Mandatory []dhcp.Option, PRL []byte) (Ordered []dhcp.Option) {
+	Index := map[dhcp.OptionCode]int{}
+
+	for _, Opt := range Mandatory {
+		Index[Opt.Code] = -1
+	}
+
+	for _, Opt := range Options {
+		i, ok := Index[Opt.Code]
+
+		switch {
+		case !ok:
+			Index[Opt.Code] = len(Ordered)
+			Ordered = append(Ordered, Opt)
+
+		case i >= 0:
+			// Values may be shared with subnet, so don't append in place
+			Ordered[i].Value = append(append([]byte{}, Ordered[i].Value...), Opt.Value...)
+		}
+	}
+
+	if PRL == nil {
+		return
+	}
+
+	Requested := make([]dhcp.Option, 0, len(PRL))
+	for _, Code := range PRL {
+		if i, ok := Index[dhcp.OptionCode(Code)]; ok && i >= 0 {
+			Requested = append(Requested, Ordered[i])
+			// Client may request the same option twice
+			Index[dhcp.OptionCode(Code)] = -1
+		}
+	}
+
+	return Requested
+}
+
+// Chooses where to send the reply according to RFC 2131 section 4.1
+// ToCHAddr means that the reply should be unicast to client's hardware address,
+// which is possible only when raw sockets are available (CanUnicast).
+// ToSource (dhcp.reply_to_source) sends all replies back to the packet's source address
+func ReplyDestination(Request, Reply dhcp.Packet, RemoteAddr *net.UDPAddr, CanUnicast, ToSource bool) (Dst *net.UDPAddr, ToCHAddr bool) {
+	if ToSource {
+		return RemoteAddr, false
+	}
+
+	// Relayed request - reply goes to relay agent's server port
+	if GIAddr := Request.GIAddr(); !GIAddr.Equal(net.IPv4zero) {
+		return &net.UDPAddr{
+			IP:   net.IPv4(GIAddr[0], GIAddr[1], GIAddr[2], GIAddr[3]),
+			Port: DHCP_PORT_SERVER,
+		}, false
+	}
+
+	// NAKs to directly connected clients are always broadcast
+	if PacketMessageType(Reply) == dhcp.NAK {
+		return &net.UDPAddr{
+			IP:   net.IPv4bcast,
+			Port: DHCP_PORT_CLIENT,
+		}, false
+	}
+
+	// Client already has an address (renewing or INFORM) - unicast to it
+	if CIAddr := Request.CIAddr(); !CIAddr.Equal(net.IPv4zero) {
+		return &net.UDPAddr{
+			IP:   net.IPv4(CIAddr[0], CIAddr[1], CIAddr[2], CIAddr[3]),
+			Port: DHCP_PORT_CLIENT,
+		}, false
+	}
+
+	// Client has no address yet and can receive unicast - send to yiaddr & chaddr
+	if YIAddr := Reply.YIAddr(); CanUnicast && !Request.Broadcast() && !YIAddr.Equal(net.IPv4zero) {
+		return &net.UDPAddr{
+			IP:   net.IPv4(YIAddr[0], YIAddr[1], YIAddr[2], YIAddr[3]),
+			Port: DHCP_PORT_CLIENT,
+		}, true
+	}
+
+	// Client asked for broadcast or we can't unicast to it without ARP entry
+	return &net.UDPAddr{
+		IP:   net.IPv4bcast,
+		Port: DHCP_PORT_CLIENT,
+	}, false
+}
+
+// Scans options for DHCP Message Type without allocating an options map
+func PacketMessageType(p dhcp.Packet) dhcp.MessageType {
+	if len(p) < 240 {
+		return 0
+	}
+
+	for opts := p[240:]; len(opts) >= 2 && dhcp.OptionCode(opts[0]) != dhcp.End; {
+		if dhcp.OptionCode(opts[0]) == dhcp.Pad {
+			opts = opts[1:]
+			continue
+		}
+
+		size := int(opts[1])
+		if len(opts) < 2+size {
+			break
+		}
+
+		if dhcp.OptionCode(opts[0]) == dhcp.OptionDHCPMessageType && size == 1 {
+			return dhcp.MessageType(opts[2])
+		}
+
+		opts = opts[2+size:]
+	}
+
+	return 0
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"flag"
+	dhcp "mt-aux/dhcp"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var UpdateGolden = flag.Bool("update", false, "Rewrite golden files in testdata")
+
+var (
+	TestMAC    = net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+	TestXId    = []byte{0xde, 0xad, 0xbe, 0xef}
+	TestYIAddr = net.IPv4(10, 0, 0, 10).To4()
+)
+
+// Fills option with a recognizable pattern of the given size
+func FillOption(Code dhcp.OptionCode, Size int) dhcp.Option {
+	v := make([]byte, Size)
+	for i := range v {
+		v[i] = byte(Code) + byte(i)
+	}
+
+	return dhcp.Option{Code: Code, Value: v}
+}
+
+func MakeRequest(Options ...dhcp.Option) (dhcp.Packet, dhcp.Options) {
+	Options = append([]dhcp.Option{{Code: dhcp.OptionDHCPMessageType, Value: []byte{byte(dhcp.Discover)}}}, Options...)
+	p := dhcp.RequestPacket(dhcp.Discover, TestMAC, nil, TestXId, false, Options)
+	return p, p.ParseOptions()
+}
+
+func MandatoryOptions() []dhcp.Option {
+	return []dhcp.Option{
+		{Code: dhcp.OptionDHCPMessageType, Value: []byte{byte(dhcp.Offer)}},
+		{Code: dhcp.OptionServerIdentifier, Value: []byte{10, 0, 0, 1}},
+		{Code: dhcp.OptionIPAddressLeaseTime, Value: []byte{0, 0, 0x0e, 0x10}},
+	}
+}
+
+// Decodes options the way RFC 3396 client does: options field, then file, then sname,
+// values of the same code are concatenated in that order
+func DecodeReply(t *testing.T, p dhcp.Packet) (Opts map[dhcp.OptionCode][]byte, Order []dhcp.OptionCode) {
+	Opts = map[dhcp.OptionCode][]byte{}
+
+	Parse := func(b []byte, Field string) {
+		for len(b) > 0 {
+			Code := dhcp.OptionCode(b[0])
+			switch Code {
+			case dhcp.End:
+				return
+			case dhcp.Pad:
+				b = b[1:]
+				continue
+			}
+
+			if len(b) < 2 || len(b) < 2+int(b[1]) {
+				t.Fatalf("%s: option %d is truncated", Field, Code)
+			}
+
+			if _, ok := Opts[Code]; !ok {
+				Order = append(Order, Code)
+			}
+
+			Opts[Code] = append(Opts[Code], b[2:2+int(b[1])]...)
+			b = b[2+int(b[1]):]
+		}
+
+		t.Fatalf("%s: no End option", Field)
+	}
+
+	Parse(p[DHCP_OPTIONS_OFFSET:], "options")
+
+	var Overload byte
+	if v := Opts[dhcp.OptionOverload]; len(v) == 1 {
+		Overload = v[0]
+	}
+
+	if Overload&OVERLOAD_FILE > 0 {
+		Parse(p[108:236], "file")
+	}
+
+	if Overload&OVERLOAD_SNAME > 0 {
+		Parse(p[44:108], "sname")
+	}
+
+	return
+}
+
+func CompareGolden(t *testing.T, Name string, p dhcp.Packet) {
+	Path := filepath.Join("testdata", "reply", Name+".hex")
+
+	var Dump strings.Builder
+	for b := []byte(p); len(b) > 0; {
+		n := 16
+		if len(b) < n {
+			n = len(b)
+		}
+
+		Dump.WriteString(hex.EncodeToString(b[:n]) + "\n")
+		b = b[n:]
+	}
+
+	if *UpdateGolden {
+		if err := os.WriteFile(Path, []byte(Dump.String()), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	Golden, err := os.ReadFile(Path)
+	if err != nil {
+		t.Fatalf("Unable to read golden file (run with -update to create): %s", err)
+	}
+
+	Expected, err := hex.DecodeString(strings.Replace(string(Golden), "\n", "", -1))
+	if err != nil {
+		t.Fatalf("Unable to decode golden file %s: %s", Path, err)
+	}
+
+	if !bytes.Equal(p, Expected) {
+		t.Errorf("Reply differs from %s:\n got:\n%s", Path, Dump.String())
+	}
+}
+
+func TestBuildReply(t *testing.T) {
+	Router := dhcp.Option{Code: dhcp.OptionRouter, Value: []byte{10, 0, 0, 1}}
+	DNS := dhcp.Option{Code: dhcp.OptionDomainNameServer, Value: []byte{8, 8, 8, 8, 8, 8, 4, 4}}
+	Domain := dhcp.Option{Code: dhcp.OptionDomainName, Value: []byte("example.com")}
+	Tail := []dhcp.Option{{Code: dhcp.OptionRelayAgentInformation, Value: []byte{1, 2, 0, 1}}}
+
+	// Options overflow 576 byte message into file & sname
+	Big := []dhcp.Option{FillOption(224, 140), FillOption(225, 140), FillOption(226, 120), FillOption(227, 60)}
+
+	tests := []struct {
+		Name     string
+		Request  []dhcp.Option
+		Options  []dhcp.Option
+		Tail     []dhcp.Option
+		Order    []dhcp.OptionCode
+		Overload byte
+		Dropped  []dhcp.OptionCode
+		Size     int
+	}{
+		{
+			Name:    "no_prl",
+			Options: []dhcp.Option{Router, DNS, Domain},
+			Order:   []dhcp.OptionCode{53, 54, 51, 3, 6, 15},
+			Size:    BOOTP_MIN_SIZE,
+		},
+
+		{
+			Name:    "prl",
+			Request: []dhcp.Option{{Code: dhcp.OptionParameterRequestList, Value: []byte{15, 6, 6, 42, 3}}},
+			Options: []dhcp.Option{Router, DNS, Domain},
+			Tail:    Tail,
+			Order:   []dhcp.OptionCode{53, 54, 51, 15, 6, 3, 82},
+			Size:    BOOTP_MIN_SIZE,
+		},
+
+		{
+			// Below the minimum, so 576 is used anyway
+			Name:     "max_size_below_min",
+			Request:  []dhcp.Option{{Code: dhcp.OptionMaximumDHCPMessageSize, Value: []byte{0x01, 0x2c}}},
+			Options:  Big,
+			Order:    []dhcp.OptionCode{53, 54, 51, 224, 225, 52, 226, 227},
+			Overload: OVERLOAD_FILE | OVERLOAD_SNAME,
+			Size:     DHCP_OPTIONS_OFFSET + 15 + 2*142 + 3 + 1,
+		},
+
+		{
+			Name:     "overload",
+			Options:  append(Big, FillOption(229, 20)),
+			Order:    []dhcp.OptionCode{53, 54, 51, 224, 225, 52, 226, 227},
+			Overload: OVERLOAD_FILE | OVERLOAD_SNAME,
+			Dropped:  []dhcp.OptionCode{229},
+			Size:     DHCP_OPTIONS_OFFSET + 15 + 2*142 + 3 + 1,
+		},
+
+		{
+			// First 255 byte chunk fills the options field, the rest goes to file
+			Name:     "split_overload",
+			Options:  []dhcp.Option{FillOption(224, 300)},
+			Order:    []dhcp.OptionCode{53, 54, 51, 224, 52},
+			Overload: OVERLOAD_FILE,
+			Size:     DHCP_OPTIONS_OFFSET + 15 + 257 + 3 + 1,
+		},
+
+		{
+			Name:    "split",
+			Request: []dhcp.Option{{Code: dhcp.OptionMaximumDHCPMessageSize, Value: []byte{0x05, 0xdc}}},
+			Options: []dhcp.Option{Router, FillOption(224, 600)},
+			Order:   []dhcp.OptionCode{53, 54, 51, 3, 224},
+			Size:    DHCP_OPTIONS_OFFSET + 15 + 6 + 600 + 3*2 + 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			Request, RequestOptions := MakeRequest(tt.Request...)
+			Reply, Dropped := BuildReply(Request, RequestOptions, MandatoryOptions(), tt.Options, tt.Tail, TestYIAddr)
+
+			if len(Reply) != tt.Size {
+				t.Errorf("Reply size is %d, expected %d", len(Reply), tt.Size)
+			}
+
+			if len(Reply) > ReplyMaxSize(RequestOptions) {
+				t.Errorf("Reply size %d exceeds %d", len(Reply), ReplyMaxSize(RequestOptions))
+			}
+
+			if string(Dropped) != string(tt.Dropped) {
+				t.Errorf("Dropped %v, expected %v", Dropped, tt.Dropped)
+			}
+
+			if Reply.XId()[0] != TestXId[0] || !bytes.Equal(Reply.CHAddr(), TestMAC) || !Reply.YIAddr().Equal(TestYIAddr) {
+				t.Errorf("Header fields aren't copied from request")
+			}
+
+			Opts, Order := DecodeReply(t, Reply)
+			if string(Order) != string(tt.Order) {
+				t.Errorf("Options order %v, expected %v", Order, tt.Order)
+			}
+
+			var Overload byte
+			if v := Opts[dhcp.OptionOverload]; len(v) == 1 {
+				Overload = v[0]
+			}
+
+			if Overload != tt.Overload {
+				t.Errorf("Overload %d, expected %d", Overload, tt.Overload)
+			}
+
+			// Values survive splitting and overloading intact
+			for _, Opt := range append(MandatoryOptions(), append(tt.Options, tt.Tail...)...) {
+				if v, ok := Opts[Opt.Code]; ok && !bytes.Equal(v, Opt.Value) {
+					t.Errorf("Option %d value differs after decoding", Opt.Code)
+				}
+			}
+
+			CompareGolden(t, tt.Name, Reply)
+		})
+	}
+}
+
+func TestReplyMaxSize(t *testing.T) {
+	for _, tt := range []struct {
+		Value []byte
+		Size  int
+	}{
+		{nil, 576},
+		{[]byte{0x01, 0x2c}, 576},
+		{[]byte{0x02, 0x40}, 576},
+		{[]byte{0x04, 0x00}, 1024},
+		{[]byte{0x05, 0xdc}, 1500},
+		{[]byte{0xff, 0xff}, 1500},
+		{[]byte{0x04}, 576},
+	} {
+		Opts := dhcp.Options{}
+		if tt.Value != nil {
+			Opts[dhcp.OptionMaximumDHCPMessageSize] = tt.Value
+		}
+
+		if s := ReplyMaxSize(Opts); s != tt.Size-DHCP_IPUDP_HEADERS {
+			t.Errorf("ReplyMaxSize(%x) = %d, expected %d", tt.Value, s, tt.Size-DHCP_IPUDP_HEADERS)
+		}
+	}
+}
+
+func TestReplyDestination(t *testing.T) {
+	var (
+		Relay  = net.IPv4(10, 0, 0, 1).To4()
+		CIAddr = net.IPv4(10, 0, 0, 20).To4()
+		Source = &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1067}
+		Bcast  = &net.UDPAddr{IP: net.IPv4bcast, Port: DHCP_PORT_CLIENT}
+	)
+
+	for _, tt := range []struct {
+		Name       string
+		GIAddr     net.IP
+		CIAddr     net.IP
+		Broadcast  bool
+		Reply      dhcp.MessageType
+		CanUnicast bool
+		ToSource   bool
+		Dst        *net.UDPAddr
+		ToCHAddr   bool
+	}{
+		{"to_source", Relay, nil, false, dhcp.Offer, true, true, Source, false},
+		{"to_source_nak", nil, nil, true, dhcp.NAK, true, true, Source, false},
+		{"giaddr", Relay, nil, false, dhcp.Offer, true, false, &net.UDPAddr{IP: Relay, Port: DHCP_PORT_SERVER}, false},
+		{"giaddr_broadcast", Relay, nil, true, dhcp.Offer, true, false, &net.UDPAddr{IP: Relay, Port: DHCP_PORT_SERVER}, false},
+		{"giaddr_nak", Relay, CIAddr, false, dhcp.NAK, true, false, &net.UDPAddr{IP: Relay, Port: DHCP_PORT_SERVER}, false},
+		{"nak", nil, CIAddr, false, dhcp.NAK, true, false, Bcast, false},
+		{"ciaddr", nil, CIAddr, false, dhcp.ACK, true, false, &net.UDPAddr{IP: CIAddr, Port: DHCP_PORT_CLIENT}, false},
+		{"ciaddr_broadcast", nil, CIAddr, true, dhcp.ACK, false, false, &net.UDPAddr{IP: CIAddr, Port: DHCP_PORT_CLIENT}, false},
+		{"chaddr", nil, nil, false, dhcp.Offer, true, false, &net.UDPAddr{IP: TestYIAddr, Port: DHCP_PORT_CLIENT}, true},
+		{"broadcast_flag", nil, nil, true, dhcp.Offer, true, false, Bcast, false},
+		{"no_raw_socket", nil, nil, false, dhcp.Offer, false, false, Bcast, false},
+	} {
+		t.Run(tt.Name, func(t *testing.T) {
+			Request, _ := MakeRequest()
+			Request.SetBroadcast(tt.Broadcast)
+			if tt.GIAddr != nil {
+				Request.SetGIAddr(tt.GIAddr)
+			}
+			if tt.CIAddr != nil {
+				Request.SetCIAddr(tt.CIAddr)
+			}
+
+			YIAddr := TestYIAddr
+			if tt.Reply == dhcp.NAK {
+				YIAddr = nil
+			}
+			Reply := dhcp.ReplyPacket(Request, tt.Reply, Relay, YIAddr, 0, nil)
+
+			Dst, ToCHAddr := ReplyDestination(Request, Reply, Source, tt.CanUnicast, tt.ToSource)
+			if !Dst.IP.Equal(tt.Dst.IP) || Dst.Port != tt.Dst.Port || ToCHAddr != tt.ToCHAddr {
+				t.Fatalf("Reply goes to %s (chaddr %t), expected %s (chaddr %t)", Dst, ToCHAddr, tt.Dst, tt.ToCHAddr)
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Opens DHCP socket, with ReusePort several sockets can be bound to the same address
+// and kernel spreads incoming packets between them
+func DHCPListenUDP(Addr *net.UDPAddr, ReusePort bool) (Conn *net.UDPConn, err error) {
+	var PC net.PacketConn
+
+	if !ReusePort {
+		return net.ListenUDP("udp4", Addr)
+	}
+
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) (err error) {
+			if cerr := c.Control(func(fd uintptr) {
+				err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			}); cerr != nil {
+				return cerr
+			}
+
+			return
+		},
+	}
+
+	if PC, err = lc.ListenPacket(context.Background(), "udp4", Addr.String()); err != nil {
+		return
+	}
+
+	return PC.(*net.UDPConn), nil
+}
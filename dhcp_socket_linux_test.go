@@ -0,0 +1,125 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"mt-aux/dhcp"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const LOADTEST_SENDERS = 64 // Kernel spreads packets between sockets by source address & port
+
+func TestDHCPListenUDPReusePort(t *testing.T) {
+	Conns := LoadTestListen(t, 4)
+	for _, c := range Conns {
+		c.Close()
+	}
+}
+
+// Opens N sockets bound to the same loopback port
+func LoadTestListen(tb testing.TB, N int) (Conns []*net.UDPConn) {
+	Addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+	for i := 0; i < N; i++ {
+		c, err := DHCPListenUDP(Addr, true)
+		if err != nil {
+			tb.Fatalf("Unable to open socket %d: %s", i, err)
+		}
+
+		c.SetReadBuffer(4 << 20)
+		Conns = append(Conns, c)
+		Addr = c.LocalAddr().(*net.UDPAddr)
+	}
+
+	return
+}
+
+// Received packets per second with the given number of sockets per listen address,
+// each socket is read by its own goroutine which parses the packet like the server does
+func BenchmarkReusePortReceive(b *testing.B) {
+	Packet, _ := MakeRequest()
+
+	for _, Sockets := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("sockets=%d", Sockets), func(b *testing.B) {
+			var (
+				Received uint64
+				wg       sync.WaitGroup
+			)
+
+			Conns := LoadTestListen(b, Sockets)
+			Dst := Conns[0].LocalAddr().(*net.UDPAddr)
+
+			for _, c := range Conns {
+				wg.Add(1)
+				go func(c *net.UDPConn) {
+					defer wg.Done()
+					Buffer := make([]byte, DHCP_BUFFER_SIZE)
+
+					for {
+						n, _, err := c.ReadFromUDP(Buffer)
+						if err != nil {
+							return
+						}
+
+						if p := dhcp.Packet(Buffer[:n]); PacketMessageType(p) != 0 {
+							p.ParseOptions()
+							atomic.AddUint64(&Received, 1)
+						}
+					}
+				}(c)
+			}
+
+			var Senders sync.WaitGroup
+			b.ResetTimer()
+			TimeStart := time.Now()
+
+			for s := 0; s < LOADTEST_SENDERS; s++ {
+				Senders.Add(1)
+				go func(Count int) {
+					defer Senders.Done()
+
+					c, err := net.DialUDP("udp4", nil, Dst)
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					defer c.Close()
+
+					for i := 0; i < Count; i++ {
+						c.Write(Packet)
+					}
+				}(b.N/LOADTEST_SENDERS + 1)
+			}
+
+			Senders.Wait()
+
+			// Let readers drain socket buffers
+			for Last := uint64(0); ; {
+				time.Sleep(20 * time.Millisecond)
+				if Cur := atomic.LoadUint64(&Received); Cur == Last {
+					break
+				} else {
+					Last = Cur
+				}
+			}
+
+			Elapsed := time.Since(TimeStart)
+			b.StopTimer()
+
+			for _, c := range Conns {
+				c.Close()
+			}
+			wg.Wait()
+
+			Sent := float64(LOADTEST_SENDERS * (b.N/LOADTEST_SENDERS + 1))
+			b.ReportMetric(float64(Received)/Elapsed.Seconds(), "pps")
+			b.ReportMetric(100*(1-float64(Received)/Sent), "%lost")
+		})
+	}
+}
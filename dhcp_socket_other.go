@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+func DHCPListenUDP(Addr *net.UDPAddr, ReusePort bool) (*net.UDPConn, error) {
+	if ReusePort {
+		return nil, errors.New("Several sockets per address are supported only on Linux")
+	}
+
+	return net.ListenUDP("udp4", Addr)
+}
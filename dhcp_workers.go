@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// It seems that DHCP packets cannot be larger than 576 bytes
+const DHCP_BUFFER_SIZE = 576
+
+// Received packet waiting in the queue for a free worker
+type DHCPJob struct {
+	Listener   *DHCPListener
+	Buffer     *[]byte
+	Size       int
+	RemoteAddr *net.UDPAddr
+}
+
+var (
+	DHCPQueue chan DHCPJob
+
+	DHCPBufferPool = sync.Pool{
+		New: func() interface{} {
+			b := make([]byte, DHCP_BUFFER_SIZE)
+			return &b
+		},
+	}
+)
+
+// Starts fixed number of workers, so packet storms are limited by the queue size
+// instead of spawning unbounded number of goroutines
+func DHCPWorkersStart() {
+	DHCPQueue = make(chan DHCPJob, o.DHCPQueueSize)
+
+	for i := 0; i < o.DHCPWorkers; i++ {
+		go DHCPWorker()
+	}
+
+	log.Warnf("%d DHCP workers started (queue size %d)", o.DHCPWorkers, o.DHCPQueueSize)
+}
+
+func DHCPWorker() {
+	for Job := range DHCPQueue {
+		DHCPHandleConnection(Job.Listener, (*Job.Buffer)[:Job.Size], Job.RemoteAddr)
+
+		// Request context drops references to the buffer in GenerateReply, so it can be reused
+		DHCPBufferPool.Put(Job.Buffer)
+	}
+}
+
+// Queues the packet for processing, returns false if all workers are busy and the queue is full
+func DHCPDispatch(Job DHCPJob) bool {
+	select {
+	case DHCPQueue <- Job:
+		return true
+	default:
+		Stats.Inc(STATS_ERRORS_OVERLOAD)
+		log.Debugf("Worker queue is full - dropping packet from %s (%s)", Job.RemoteAddr.IP.String(), DROPREASON_OVERLOAD)
+		return false
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	aux "mt-aux"
+	"mt-aux/dhcp"
+	"net"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const TEST_RELAY_IP = "10.0.0.1"
+
+// Configured segment with a subnet served through TEST_RELAY_IP, replies go back to the packet's source
+type TestServer struct {
+	Segment  *Segment
+	Subnet   *Subnet
+	Listener *DHCPListener
+}
+
+func NewTestServer(tb testing.TB) (s *TestServer) {
+	InitTestOpts()
+	o.DHCPReplyToSource = true
+
+	s = &TestServer{}
+	s.Segment, s.Subnet = NewTestSegment("10.0.0.0", "10.0.0.10", "10.0.0.250")
+	s.Segment.Masks = []uint32{s.Subnet.Mask}
+	s.Segment.Matcher = func(c *ReqCtx) bool { return true }
+	s.Subnet.DHCPOptions = []dhcp.Option{{Code: dhcp.OptionRouter, Value: []byte{10, 0, 0, 1}}}
+
+	Storage := &TestLeaseStorage{Leases: map[uint32]uint64{}}
+	DHCPBackend = &BackendHash{LeaseStore: Storage.Store, LeaseRemove: Storage.Remove}
+
+	Conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { Conn.Close() })
+
+	s.Listener = &DHCPListener{
+		Conn:      Conn,
+		LocalAddr: net.IPv4(127, 0, 0, 1).To4(),
+	}
+
+	return
+}
+
+// Request from client MAC relayed through TEST_RELAY_IP
+func RelayedRequest(Type dhcp.MessageType, MAC uint64, Options ...dhcp.Option) dhcp.Packet {
+	Options = append([]dhcp.Option{{Code: dhcp.OptionDHCPMessageType, Value: []byte{byte(Type)}}}, Options...)
+	CHAddr := net.HardwareAddr{byte(MAC >> 40), byte(MAC >> 32), byte(MAC >> 24), byte(MAC >> 16), byte(MAC >> 8), byte(MAC)}
+	p := dhcp.RequestPacket(Type, CHAddr, nil, TestXId, false, Options)
+	p.SetGIAddr(net.ParseIP(TEST_RELAY_IP).To4())
+	return p
+}
+
+func TestGenerateReplyReleasesRequestBuffer(t *testing.T) {
+	s := NewTestServer(t)
+	p := RelayedRequest(dhcp.Discover, 0x020000000001)
+
+	c := NewTestCtx(s.Segment, s.Subnet, 0x020000000001, dhcp.Discover)
+	c.Packet, c.RequestOptions = &p, p.ParseOptions()
+	c.Option82Raw, c.Option82 = []byte{1, 1, 0}, map[uint8][]byte{1: {0}}
+	c.SetRequestedIP(aux.IPStrToInt("10.0.0.10"))
+
+	if Reply := c.GenerateReply(dhcp.Offer); Reply == nil {
+		t.Fatalf("No reply generated")
+	}
+
+	if c.Packet != nil || c.RequestOptions != nil || c.Option82Raw != nil || c.Option82 != nil {
+		t.Fatalf("Request context still refers to the request buffer")
+	}
+}
+
+// DISCOVERs from 200 clients offered at 100k pps through the worker pool,
+// reports processed rate, overload drops and heap in use
+func BenchmarkDHCPWorkers(b *testing.B) {
+	const (
+		Rate    = 100000
+		Tick    = 10 * time.Millisecond
+		Clients = 200
+	)
+
+	s := NewTestServer(b)
+	o.DHCPWorkers, o.DHCPQueueSize = 16*runtime.NumCPU(), 4096
+	DHCPWorkersStart()
+	defer close(DHCPQueue)
+
+	// Replies are counted by the client side
+	var Replies uint64
+	Client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	Client.SetReadBuffer(8 << 20)
+	defer Client.Close()
+
+	go func() {
+		Buffer := make([]byte, 1500)
+		for {
+			if _, _, err := Client.ReadFromUDP(Buffer); err != nil {
+				return
+			}
+
+			atomic.AddUint64(&Replies, 1)
+		}
+	}()
+
+	var Packets []dhcp.Packet
+	for i := 0; i < Clients; i++ {
+		Packets = append(Packets, RelayedRequest(dhcp.Discover, 0x020000000000+uint64(i)))
+	}
+
+	ClientAddr := Client.LocalAddr().(*net.UDPAddr)
+	Dropped := 0
+
+	var Mem runtime.MemStats
+	b.ReportAllocs()
+	b.ResetTimer()
+	TimeStart := time.Now()
+
+	Ticker := time.NewTicker(Tick)
+	for Sent := 0; Sent < b.N; {
+		for i := 0; i < Rate*int(Tick)/int(time.Second) && Sent < b.N; i, Sent = i+1, Sent+1 {
+			p := Packets[Sent%Clients]
+			Buffer := DHCPBufferPool.Get().(*[]byte)
+			n := copy(*Buffer, p)
+
+			if !DHCPDispatch(DHCPJob{Listener: s.Listener, Buffer: Buffer, Size: n, RemoteAddr: ClientAddr}) {
+				DHCPBufferPool.Put(Buffer)
+				Dropped++
+			}
+		}
+
+		<-Ticker.C
+	}
+	Ticker.Stop()
+
+	// Wait for the queue to drain and the last replies to arrive
+	for Last := uint64(0); ; {
+		time.Sleep(20 * time.Millisecond)
+		if Cur := atomic.LoadUint64(&Replies); len(DHCPQueue) == 0 && Cur == Last {
+			break
+		} else {
+			Last = Cur
+		}
+	}
+
+	Elapsed := time.Since(TimeStart)
+	b.StopTimer()
+	runtime.ReadMemStats(&Mem)
+
+	b.ReportMetric(float64(atomic.LoadUint64(&Replies))/Elapsed.Seconds(), "replies/s")
+	b.ReportMetric(100*float64(Dropped)/float64(b.N), "%overload")
+	b.ReportMetric(float64(Mem.HeapInuse)/(1<<20), "heapMB")
+}
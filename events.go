@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	aux "mt-aux"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	fh "github.com/valyala/fasthttp"
+)
+
+const (
+	LEASE_EVENT_GRANT   = "grant"
+	LEASE_EVENT_RENEW   = "renew"
+	LEASE_EVENT_RELEASE = "release"
+	LEASE_EVENT_DECLINE = "decline"
+	LEASE_EVENT_EXPIRE  = "expire"
+
+	EVENTS_SUBSCRIBER_QUEUE_SIZE = 1000
+	EVENTS_KEEPALIVE             = 15 * time.Second
+)
+
+var (
+	LeaseEvents        chan *LeaseEvent // nil if events are disabled
+	LeaseEventsDropped uint64
+	LeaseEventsWebhook *Webhook
+	LeaseEventsFile    *os.File
+
+	// Event stream (SSE) clients
+	LeaseEventsSubscribers    = map[chan []byte]*LeaseEventsFilter{}
+	LeaseEventsSubscribersMtx sync.RWMutex
+)
+
+// Holds only copies of request data, request context and packet buffer are reused after the reply
+type LeaseEvent struct {
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	ServerID string    `json:"server_id"`
+
+	MAC       string    `json:"mac"`
+	IP        string    `json:"ip"`
+	Subnet    string    `json:"subnet"`
+	SegmentId int       `json:"segment_id"`
+	Segment   string    `json:"segment"`
+	Expires   time.Time `json:"expires"`
+
+	// Not known for expire events
+	RelayIP      string `json:"relay_ip,omitempty"`
+	Hostname     string `json:"hostname,omitempty"`
+	CircuitID    string `json:"circuit_id,omitempty"`
+	RemoteID     string `json:"remote_id,omitempty"`
+	SubscriberID string `json:"subscriber_id,omitempty"`
+}
+
+func LeaseEventsInit() (err error) {
+	if !o.EventsEnabled {
+		return
+	}
+
+	if o.EventsFile != "" {
+		if LeaseEventsFile, err = os.OpenFile(o.EventsFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+			return fmt.Errorf("Unable to open events file: %s", err)
+		}
+
+		log.Warnf("Lease events: Writing to %s", o.EventsFile)
+	}
+
+	if o.EventsWebhook != "" {
+		LeaseEventsWebhook = NewWebhook("events", o.EventsWebhook, o.EventsWebhookTimeout, o.EventsWebhookRetries)
+		log.Warnf("Lease events: Sending to webhook %s", o.EventsWebhook)
+	}
+
+	LeaseEvents = make(chan *LeaseEvent, o.EventsQueueSize)
+	go LeaseEventsWorker()
+	return
+}
+
+// Never blocks request processing, events are dropped if the worker can't keep up
+func LeaseEventSend(e *LeaseEvent) {
+	if LeaseEvents == nil {
+		return
+	}
+
+	select {
+	case LeaseEvents <- e:
+	default:
+		if atomic.AddUint64(&LeaseEventsDropped, 1)%1000 == 1 {
+			log.Errorf("Lease events: queue is full, %d events dropped so far", atomic.LoadUint64(&LeaseEventsDropped))
+		}
+	}
+}
+
+// Builds an event from the request (it assumes an already locked subnet)
+func (c *ReqCtx) LeaseEvent(Type string, Lease *Lease) *LeaseEvent {
+	return &LeaseEvent{
+		Type:     Type,
+		Time:     c.RequestStart,
+		ServerID: o.ServerID,
+
+		MAC:       c.MACStr,
+		IP:        aux.IPIntToStr(Lease.IP),
+		Subnet:    c.Subnet.NetStr,
+		SegmentId: c.Segment.Id,
+		Segment:   c.Segment.Name,
+		Expires:   Lease.Expires,
+
+		RelayIP:      c.RelayIPStr,
+		Hostname:     c.Hostname,
+		CircuitID:    c.CircuitID,
+		RemoteID:     c.RemoteID,
+		SubscriberID: c.SubscriberID,
+	}
+}
+
+func LeaseEventExpire(Segment *Segment, Subnet *Subnet, Lease Lease) *LeaseEvent {
+	return &LeaseEvent{
+		Type:     LEASE_EVENT_EXPIRE,
+		Time:     time.Now(),
+		ServerID: o.ServerID,
+
+		MAC:       aux.MACIntToStr(Lease.MAC),
+		IP:        aux.IPIntToStr(Lease.IP),
+		Subnet:    Subnet.NetStr,
+		SegmentId: Segment.Id,
+		Segment:   Segment.Name,
+		Expires:   Lease.Expires,
+	}
+}
+
+func LeaseEventsWorker() {
+	for e := range LeaseEvents {
+		if LeaseEventsWebhook != nil {
+			LeaseEventsWebhook.Send(e)
+		}
+
+		if LeaseEventsFile == nil && LeaseEventsSubscribersCount() == 0 {
+			continue
+		}
+
+		js, err := json.Marshal(e)
+		if err != nil {
+			log.Errorf("Lease events: unable to marshal event: %s", err)
+			continue
+		}
+
+		if LeaseEventsFile != nil {
+			if _, err = LeaseEventsFile.Write(append(js, '\n')); err != nil {
+				log.Errorf("Lease events: unable to write to %s: %s", o.EventsFile, err)
+			}
+		}
+
+		LeaseEventsSubscribersMtx.RLock()
+		for Ch, f := range LeaseEventsSubscribers {
+			if !f.Match(e) {
+				continue
+			}
+
+			// Slow clients lose events rather than delay others
+			select {
+			case Ch <- js:
+			default:
+			}
+		}
+		LeaseEventsSubscribersMtx.RUnlock()
+	}
+}
+
+// Event stream filter from query arguments, empty ones match everything
+type LeaseEventsFilter struct {
+	Types   map[string]bool
+	Segment string
+}
+
+func (f *LeaseEventsFilter) Match(e *LeaseEvent) bool {
+	return (len(f.Types) == 0 || f.Types[e.Type]) && (f.Segment == "" || f.Segment == e.Segment)
+}
+
+func LeaseEventsSubscribersCount() int {
+	LeaseEventsSubscribersMtx.RLock()
+	defer LeaseEventsSubscribersMtx.RUnlock()
+	return len(LeaseEventsSubscribers)
+}
+
+// Streams lease events as Server-Sent Events, can be filtered by ?type=grant,renew and ?segment=NAME
+func HTTPLeaseEvents(ctx *fh.RequestCtx) {
+	if LeaseEvents == nil {
+		ctx.SetStatusCode(503)
+		ctx.WriteString("Lease events are disabled")
+		return
+	}
+
+	f := &LeaseEventsFilter{
+		Types:   map[string]bool{},
+		Segment: string(ctx.QueryArgs().Peek("segment")),
+	}
+
+	if v := ctx.QueryArgs().Peek("type"); len(v) > 0 {
+		for _, t := range strings.Split(string(v), ",") {
+			f.Types[strings.TrimSpace(t)] = true
+		}
+	}
+
+	Ch := make(chan []byte, EVENTS_SUBSCRIBER_QUEUE_SIZE)
+
+	LeaseEventsSubscribersMtx.Lock()
+	LeaseEventsSubscribers[Ch] = f
+	LeaseEventsSubscribersMtx.Unlock()
+
+	ctx.SetContentType("text/event-stream")
+	ctx.Response.Header.Set("Cache-Control", "no-cache")
+
+	ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+		var err error
+
+		defer func() {
+			LeaseEventsSubscribersMtx.Lock()
+			delete(LeaseEventsSubscribers, Ch)
+			LeaseEventsSubscribersMtx.Unlock()
+		}()
+
+		// Keepalives also detect disconnected clients
+		Ticker := time.NewTicker(EVENTS_KEEPALIVE)
+		defer Ticker.Stop()
+
+		// Send headers right away, clients would wait for the first event otherwise
+		if _, err = w.WriteString(": connected\n\n"); err == nil {
+			err = w.Flush()
+		}
+
+		for err == nil {
+			select {
+			case js := <-Ch:
+				_, err = fmt.Fprintf(w, "data: %s\n\n", js)
+			case <-Ticker.C:
+				_, err = w.WriteString(": keepalive\n\n")
+			}
+
+			if err == nil {
+				err = w.Flush()
+			}
+		}
+	})
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	dhcp "mt-aux/dhcp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Bucket bounds in seconds
+var (
+	HistogramBucketsRequest = []float64{0.00005, 0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 1}
+	HistogramBucketsCleanup = []float64{0.00001, 0.0001, 0.001, 0.01, 0.1, 1, 10}
+	// DISCOVER -> REQUEST includes client's and relay's delays
+	HistogramBucketsTransaction = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+)
+
+var (
+	HistogramRequests     = NewHistogram(HistogramBucketsRequest)
+	HistogramCleanup      = NewHistogram(HistogramBucketsCleanup)
+	HistogramTransactions = NewHistogram(HistogramBucketsTransaction)
+
+	// Maps are filled once in init() and are read-only afterwards
+	HistogramsRequestType = map[dhcp.MessageType]*Histogram{}
+	HistogramsResponse    = map[dhcp.MessageType]*Histogram{}
+)
+
+var (
+	HistogramRequestTypes = []dhcp.MessageType{dhcp.Discover, dhcp.Request, dhcp.Decline, dhcp.Release, dhcp.Inform}
+	HistogramResponses    = []dhcp.MessageType{dhcp.Offer, dhcp.ACK, dhcp.NAK, dhcp.Drop}
+)
+
+func init() {
+	for _, t := range HistogramRequestTypes {
+		HistogramsRequestType[t] = NewHistogram(HistogramBucketsRequest)
+	}
+
+	for _, t := range HistogramResponses {
+		HistogramsResponse[t] = NewHistogram(HistogramBucketsRequest)
+	}
+}
+
+// Lock-free histogram of durations, buckets are not cumulative until written
+type Histogram struct {
+	Bounds []float64
+	Counts []uint64 // Last one is for values above all bounds
+	SumNs  uint64
+}
+
+func NewHistogram(Bounds []float64) *Histogram {
+	return &Histogram{
+		Bounds: Bounds,
+		Counts: make([]uint64, len(Bounds)+1),
+	}
+}
+
+func (h *Histogram) Observe(d time.Duration) {
+	v, i := d.Seconds(), 0
+	for ; i < len(h.Bounds) && v > h.Bounds[i]; i++ {
+	}
+
+	atomic.AddUint64(&h.Counts[i], 1)
+	atomic.AddUint64(&h.SumNs, uint64(d.Nanoseconds()))
+}
+
+// Writes histogram in Prometheus text format, Labels are already formatted ('a="b",c="d"') or empty
+func (h *Histogram) WritePrometheus(w io.Writer, Name, Labels string) {
+	var Cumulative uint64
+
+	if Labels != "" {
+		Labels += ","
+	}
+
+	for i, b := range h.Bounds {
+		Cumulative += atomic.LoadUint64(&h.Counts[i])
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", Name, Labels, strconv.FormatFloat(b, 'g', -1, 64), Cumulative)
+	}
+
+	Cumulative += atomic.LoadUint64(&h.Counts[len(h.Bounds)])
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", Name, Labels, Cumulative)
+
+	if Labels != "" {
+		Labels = "{" + strings.TrimSuffix(Labels, ",") + "}"
+	}
+
+	fmt.Fprintf(w, "%s_sum%s %g\n", Name, Labels, float64(atomic.LoadUint64(&h.SumNs))/1e9)
+	fmt.Fprintf(w, "%s_count%s %d\n", Name, Labels, Cumulative)
+}
+
+// Estimates quantile q (0..1) by linear interpolation inside the bucket,
+// values above the last bound are reported as the last bound
+func (h *Histogram) Quantile(q float64) time.Duration {
+	var (
+		Counts = make([]uint64, len(h.Counts))
+		Total  uint64
+	)
+
+	for i := range h.Counts {
+		Counts[i] = atomic.LoadUint64(&h.Counts[i])
+		Total += Counts[i]
+	}
+
+	if Total == 0 {
+		return 0
+	}
+
+	var (
+		Rank       = q * float64(Total)
+		Cumulative float64
+		Lower      float64
+	)
+
+	for i, b := range h.Bounds {
+		c := float64(Counts[i])
+		if c > 0 && Cumulative+c >= Rank {
+			return time.Duration((Lower + (b-Lower)*(Rank-Cumulative)/c) * 1e9)
+		}
+
+		Cumulative += c
+		Lower = b
+	}
+
+	return time.Duration(Lower * 1e9)
+}
+
+type HistogramSummary struct {
+	Count  uint64  `json:"count"`
+	MeanMs float64 `json:"mean_ms"`
+	P50Ms  float64 `json:"p50_ms"`
+	P90Ms  float64 `json:"p90_ms"`
+	P99Ms  float64 `json:"p99_ms"`
+}
+
+func (h *Histogram) Summary() (s HistogramSummary) {
+	for i := range h.Counts {
+		s.Count += atomic.LoadUint64(&h.Counts[i])
+	}
+
+	if s.Count == 0 {
+		return
+	}
+
+	Ms := func(d time.Duration) float64 {
+		return float64(d.Nanoseconds()/1000) / 1000
+	}
+
+	s.MeanMs = Ms(time.Duration(atomic.LoadUint64(&h.SumNs) / s.Count))
+	s.P50Ms = Ms(h.Quantile(0.5))
+	s.P90Ms = Ms(h.Quantile(0.9))
+	s.P99Ms = Ms(h.Quantile(0.99))
+	return
+}
+
+func (s HistogramSummary) String() string {
+	return fmt.Sprintf("count %d, mean %.3fms, p50 %.3fms, p90 %.3fms, p99 %.3fms", s.Count, s.MeanMs, s.P50Ms, s.P90Ms, s.P99Ms)
+}
+
+// Latency summaries for /stats/json
+type StatsLatencyStruct struct {
+	Total        HistogramSummary            `json:"total"`
+	Transactions HistogramSummary            `json:"transactions"`
+	Requests     map[string]HistogramSummary `json:"requests"`
+	Responses    map[string]HistogramSummary `json:"responses"`
+}
+
+func HistogramsLatency() *StatsLatencyStruct {
+	l := &StatsLatencyStruct{
+		Total:        HistogramRequests.Summary(),
+		Transactions: HistogramTransactions.Summary(),
+		Requests:     map[string]HistogramSummary{},
+		Responses:    map[string]HistogramSummary{},
+	}
+
+	for _, t := range HistogramRequestTypes {
+		l.Requests[t.String()] = HistogramsRequestType[t].Summary()
+	}
+
+	for _, t := range HistogramResponses {
+		l.Responses[t.String()] = HistogramsResponse[t].Summary()
+	}
+
+	return l
+}
+
+// Observes request processing time in all the relevant histograms
+func (c *ReqCtx) HistogramsObserve() {
+	HistogramRequests.Observe(c.RequestDuration)
+
+	if h, ok := HistogramsRequestType[c.DHCPRequest]; ok {
+		h.Observe(c.RequestDuration)
+	}
+
+	if h, ok := HistogramsResponse[c.DHCPResponse]; ok {
+		h.Observe(c.RequestDuration)
+	}
+
+	if c.Segment != nil {
+		c.Segment.Latency.Observe(c.RequestDuration)
+	}
+
+	// Lease copy is made when it's updated by REQUEST
+	if c.DHCPResponse == dhcp.ACK && c.LeaseCopy != nil && c.LeaseCopy.Discover {
+		HistogramTransactions.Observe(c.LeaseCopy.TxDuration())
+	}
+}
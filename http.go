@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net"
 	"runtime"
+	"time"
 
 	"encoding/json"
 
@@ -20,8 +21,12 @@ var (
 func HTTPInit() (err error) {
 	// Admin API
 	HTTPRouter.GET("/stats/:type", HTTPStatsDump)
+	HTTPRouter.GET("/metrics", HTTPPrometheus)
 	HTTPRouter.GET("/leases/dump", HTTPLeasesDump)
 	HTTPRouter.GET("/leases/reload", HTTPLeasesReload)
+	HTTPRouter.GET("/events", HTTPLeaseEvents)
+	HTTPRouter.GET("/config/reload", HTTPConfigReload)
+	HTTPRouter.GET("/ratelimit/throttled", HTTPRateLimitThrottled)
 	HTTPRouter.GET("/log/level/:level", HTTPSetLogLevel)
 	HTTPRouter.GET("/log/tickers", HTTPToggleTickers)
 	HTTPRouter.GET("/selftest", HTTPSelfTest)
@@ -66,6 +71,20 @@ func HTTPStatsDump(ctx *fh.RequestCtx) {
 		ctx.WriteString(StatsDumpSegments())
 	case "subnets":
 		ctx.WriteString(StatsDumpSubnets())
+	case "exhausted":
+		// Subnets without free addresses during the last alerts.exhausted_period (or ?period=)
+		Period := o.AlertsExhaustedPeriod
+
+		if v := ctx.QueryArgs().Peek("period"); len(v) > 0 {
+			var err error
+			if Period, err = time.ParseDuration(string(v)); err != nil {
+				ctx.SetStatusCode(400)
+				ctx.WriteString("Unable to parse period: " + err.Error())
+				return
+			}
+		}
+
+		ctx.WriteString(AlertsDumpExhausted(Period))
 	case "json":
 		js, _ := json.MarshalIndent(StatsDumpStruct(), "", "   ")
 		ctx.SetContentType("application/json")
@@ -76,10 +95,31 @@ func HTTPStatsDump(ctx *fh.RequestCtx) {
 	}
 }
 
+func HTTPPrometheus(ctx *fh.RequestCtx) {
+	ctx.SetContentType("text/plain; version=0.0.4")
+	ctx.WriteString(PrometheusDump())
+}
+
 func HTTPLeasesDump(ctx *fh.RequestCtx) {
 	ctx.WriteString(StatsDumpLeases())
 }
 
+// Lists MACs & Relay IPs which were rate limited during the last minute (or ?period=, up to an hour)
+func HTTPRateLimitThrottled(ctx *fh.RequestCtx) {
+	Period := time.Minute
+
+	if v := ctx.QueryArgs().Peek("period"); len(v) > 0 {
+		var err error
+		if Period, err = time.ParseDuration(string(v)); err != nil {
+			ctx.SetStatusCode(400)
+			ctx.WriteString("Unable to parse period: " + err.Error())
+			return
+		}
+	}
+
+	ctx.WriteString(RateLimitDumpThrottled(Period))
+}
+
 func HTTPLeasesReload(ctx *fh.RequestCtx) {
 	if err, Duration := CacheReload(); err != nil {
 		ctx.SetStatusCode(500)
@@ -89,6 +129,15 @@ func HTTPLeasesReload(ctx *fh.RequestCtx) {
 	}
 }
 
+func HTTPConfigReload(ctx *fh.RequestCtx) {
+	if Diff, err := ConfigReload(); err != nil {
+		ctx.SetStatusCode(500)
+		ctx.WriteString("Unable to reload configuration: " + err.Error())
+	} else {
+		ctx.WriteString(Diff.String())
+	}
+}
+
 func HTTPSetLogLevel(ctx *fh.RequestCtx) {
 	if l, err := log.ParseLevel(ctx.UserValue("level").(string)); err == nil {
 		log.SetLevel(l)
@@ -106,18 +155,7 @@ func HTTPToggleTickers(ctx *fh.RequestCtx) {
 }
 
 func HTTPSelfTest(ctx *fh.RequestCtx) {
-	var err error
-
-	if err = as.SelfTest(); err != nil {
-		goto out
-	}
-
-	if _, err = as.Get(as.Rpolicy(), as.Key(o.ASSetLeases, "testbullshit")); err != nil {
-		goto out
-	}
-
-out:
-	if err != nil {
+	if err := DHCPBackend.SelfTest(); err != nil {
 		ctx.SetStatusCode(500)
 	} else {
 		ctx.SetStatusCode(204)
@@ -2,10 +2,12 @@ package main
 
 import (
 	"bytes"
+	"flag"
 	"fmt"
 	aux "mt-aux"
 	dhcp "mt-aux/dhcp"
 	mtspike "mt-aux/spike"
+	"strconv"
 	"strings"
 	"text/tabwriter"
 
@@ -65,12 +67,12 @@ func MySQLConnect() (db *sqlx.DB, err error) {
 	return
 }
 
-func LoadSegments() (err error) {
-	for _, s := range o.Segments {
+func LoadSegments(Segments map[int]*Segment) (err error) {
+	for _, s := range Segments {
 		log.Warnf("Loading subnets for segment '%s'", s.Name)
 
 		TimeStart := time.Now()
-		if s.Subnets, s.Masks, err = LoadSubnetsFromSegment(s.Id); err != nil {
+		if s.Subnets, s.Masks, err = LoadSubnetsFromSegment(s); err != nil {
 			return
 		}
 
@@ -88,7 +90,7 @@ func LoadSegments() (err error) {
 	return nil
 }
 
-func LoadSubnetsFromSegment(SegmentId int) (Subnets map[uint32]*Subnet, Masks []uint32, err error) {
+func LoadSubnetsFromSegment(Segment *Segment) (Subnets map[uint32]*Subnet, Masks []uint32, err error) {
 	Subnets = make(map[uint32]*Subnet)
 	MasksMap := make(map[uint32]bool)
 
@@ -106,7 +108,7 @@ func LoadSubnetsFromSegment(SegmentId int) (Subnets map[uint32]*Subnet, Masks []
 	var rows1 *sql.Rows
 	rows1, err = db.Query(
 		"SELECT `subnet_id`, `subnet`, `mask`, `range_start`, `range_end` FROM `dhcp_subnets` WHERE `segment_id` = ? AND `enabled` = 1",
-		SegmentId)
+		Segment.Id)
 
 	if err != nil {
 		err = fmt.Errorf("Query1 error: %s", err)
@@ -130,6 +132,9 @@ func LoadSubnetsFromSegment(SegmentId int) (Subnets map[uint32]*Subnet, Masks []
 			LeasesByIP:  map[uint32]*Lease{},
 			LeasesByMAC: map[uint64]*Lease{},
 
+			Reservations:   map[uint64]*Reservation{},
+			ReservationsIP: map[uint32]*Reservation{},
+
 			Net:        NetInt,
 			NetStr:     fmt.Sprintf("%s/%d", NetStr, aux.InetMaskToCIDRBits(aux.IPStrToInt(Mask))),
 			Mask:       aux.IPStrToInt(Mask),
@@ -137,6 +142,7 @@ func LoadSubnetsFromSegment(SegmentId int) (Subnets map[uint32]*Subnet, Masks []
 			RangeEnd:   aux.IPStrToInt(RangeEnd),
 		}
 		Net.StatsInit()
+		Net.Ranges = []IPRange{{Start: Net.RangeStart, End: Net.RangeEnd}}
 
 		Net.DHCPOptions = append(Net.DHCPOptions, dhcp.Option{
 			Code:  dhcp.OptionSubnetMask,
@@ -146,31 +152,16 @@ func LoadSubnetsFromSegment(SegmentId int) (Subnets map[uint32]*Subnet, Masks []
 		// Collect distinct masks
 		MasksMap[Net.Mask] = true
 
-		var rows2 *sql.Rows
 		// Fetch all options, prefer subnet-specific over common
-		rows2, err = db.Query(
-			"SELECT `opt`, `value` FROM "+
-				"(SELECT `opt`, `value`, `ord` FROM `dhcp_opts_subnet` WHERE `subnet_id` = ? "+
-				"UNION "+
-				"SELECT `opt`, `value`, `ord` FROM `dhcp_opts_common` WHERE `opt` NOT IN "+
-				"(SELECT `opt` FROM `dhcp_opts_subnet` WHERE `subnet_id` = ?)) "+
-				"AS `t1` "+
-				"ORDER BY `t1`.`opt` ASC, `t1`.`ord` ASC", SubnetID, SubnetID)
-
-		if err != nil {
-			err = fmt.Errorf("Query2 error: %s", err)
+		var Options []OptionRow
+		if Options, err = LoadSubnetOptions(db, SubnetID); err != nil {
 			return
 		}
-		defer rows2.Close()
 
-		for rows2.Next() {
-			var opt, value string
-			if err = rows2.Scan(&opt, &value); err != nil {
-				log.Errorf("rows2.Scan() error: %s", err)
-				return
-			}
+		for _, Opt := range Options {
+			opt, value := Opt.Name, Opt.Value
 
-			switch opt {
+			switch OptionName(opt) {
 			case "router":
 				if Net.Router = aux.IPStrToInt(value); Net.Router == 0 {
 					break
@@ -195,17 +186,96 @@ func LoadSubnetsFromSegment(SegmentId int) (Subnets map[uint32]*Subnet, Masks []
 					err = fmt.Errorf("Unable to parse 'lease_ttl' '%s' as duration", value)
 					return
 				}
+
+			case "lease_ttl_min", "lease_ttl_max", "offer_ttl":
+				var d time.Duration
+				if d, err = time.ParseDuration(value); err != nil || d <= 0 {
+					err = fmt.Errorf("Unable to parse '%s' '%s' as duration", opt, value)
+					return
+				}
+
+				switch opt {
+				case "lease_ttl_min":
+					Net.Lease.Min = d
+				case "lease_ttl_max":
+					Net.Lease.Max = d
+				case "offer_ttl":
+					Net.Lease.OfferTTL = d
+				}
+
+			case "util_warning", "util_critical":
+				var r float64
+				if r, err = strconv.ParseFloat(value, 64); err != nil || r <= 0 || r > 100 {
+					err = fmt.Errorf("Unable to parse '%s' '%s' as percent between 0 and 100", opt, value)
+					return
+				}
+
+				if opt == "util_warning" {
+					Net.Util.Warning = r
+				} else {
+					Net.Util.Critical = r
+				}
+
+			case "t1_ratio", "t2_ratio":
+				var r float64
+				if r, err = strconv.ParseFloat(value, 64); err != nil || r <= 0 || r >= 1 {
+					err = fmt.Errorf("Unable to parse '%s' '%s' as ratio between 0 and 1", opt, value)
+					return
+				}
+
+				if opt == "t1_ratio" {
+					Net.Lease.T1 = r
+				} else {
+					Net.Lease.T2 = r
+				}
+
+			default:
+				if Net.DHCPOptions, err = OptionAdd(Net.DHCPOptions, opt, value); err != nil {
+					err = fmt.Errorf("Subnet %s: %s", NetStr, err)
+					return
+				}
 			}
 		}
 
+		if err = Segment.Lease.Merge(Net.Lease).Validate(); err != nil {
+			err = fmt.Errorf("Subnet %s: %s", NetStr, err)
+			return
+		}
+
+		if err = Segment.Util.Merge(Net.Util).Validate(); err != nil {
+			err = fmt.Errorf("Subnet %s: %s", NetStr, err)
+			return
+		}
+
+		if Net.DHCPOptions, err = OptionsClasslessRoutes(Net.DHCPOptions, Net.Router); err != nil {
+			err = fmt.Errorf("Subnet %s: %s", NetStr, err)
+			return
+		}
+
+		if err = LoadRanges(db, SubnetID, Net); err != nil {
+			err = fmt.Errorf("Subnet %s: %s", NetStr, err)
+			return
+		}
+		Net.PoolInit()
+
+		if err = LoadReservations(db, Segment.Id, SubnetID, Net); err != nil {
+			err = fmt.Errorf("Subnet %s: %s", NetStr, err)
+			return
+		}
+
 		var b bytes.Buffer
 		w := tabwriter.NewWriter(&b, 0, 0, 3, ' ', 0)
 		fmt.Fprintf(w, "Subnet %s loaded:\n", NetStr)
 		fmt.Fprintf(w, " Mask:\t%s\n", Mask)
-		fmt.Fprintf(w, " Range:\t%s - %s\n", aux.IPIntToStr(Net.RangeStart), aux.IPIntToStr(Net.RangeEnd))
+		fmt.Fprintf(w, " Ranges:\t%s (%d hosts)\n", IPRangesString(Net.Ranges), Net.Capacity())
+		fmt.Fprintf(w, " Exclusions:\t%s\n", IPRangesString(Net.Exclusions))
 		fmt.Fprintf(w, " Router:\t%s\n", aux.IPIntToStr(Net.Router))
 		fmt.Fprintf(w, " DNS:\t%s\n", strings.Join(Net.DNSStr, ", "))
 		fmt.Fprintf(w, " Lease TTL:\t%s\n", Net.LeaseTTL)
+		fmt.Fprintf(w, " Lease Policy:\t%s\n", Segment.Lease.Merge(Net.Lease))
+		fmt.Fprintf(w, " Utilization Alerts:\t%s\n", Segment.Util.Merge(Net.Util))
+		fmt.Fprintf(w, " Options:\t%s\n", OptionsString(Net.DHCPOptions))
+		fmt.Fprintf(w, " Reservations:\t%d\n", len(Net.Reservations))
 		w.Flush()
 
 		for _, v := range strings.Split(b.String(), "\n") {
@@ -235,6 +305,198 @@ func LoadSubnetsFromSegment(SegmentId int) (Subnets map[uint32]*Subnet, Masks []
 	return
 }
 
+// Loads additional pool ranges and exclusions of a subnet
+func LoadRanges(db *sqlx.DB, SubnetID int, Net *Subnet) (err error) {
+	var rows *sql.Rows
+	if rows, err = db.Query(
+		"SELECT `range_start`, `range_end`, `exclude` FROM `dhcp_ranges` WHERE `subnet_id` = ?",
+		SubnetID); err != nil {
+		return fmt.Errorf("Ranges query error: %s", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			RangeStart, RangeEnd string
+			Exclude              bool
+		)
+
+		if err = rows.Scan(&RangeStart, &RangeEnd, &Exclude); err != nil {
+			return fmt.Errorf("Ranges rows.Scan() error: %s", err)
+		}
+
+		r := IPRange{
+			Start: aux.IPStrToInt(RangeStart),
+			End:   aux.IPStrToInt(RangeEnd),
+		}
+
+		if r.Start == 0 || r.End < r.Start || r.Start&Net.Mask != Net.Net || r.End&Net.Mask != Net.Net {
+			return fmt.Errorf("Range '%s - %s' is wrong or does not belong to subnet", RangeStart, RangeEnd)
+		}
+
+		if Exclude {
+			Net.Exclusions = append(Net.Exclusions, r)
+		} else {
+			Net.Ranges = append(Net.Ranges, r)
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("Ranges rows.Next() error: %s", err)
+	}
+
+	return
+}
+
+// Loads static MAC -> IP reservations of a subnet and their per-host options
+func LoadReservations(db *sqlx.DB, SegmentId, SubnetID int, Net *Subnet) (err error) {
+	var rows1 *sql.Rows
+	if rows1, err = db.Query(
+		"SELECT `reservation_id`, `mac`, `ip` FROM `dhcp_reservations` WHERE `segment_id` = ? AND `subnet_id` = ? AND `enabled` = 1",
+		SegmentId, SubnetID); err != nil {
+		return fmt.Errorf("Reservations query error: %s", err)
+	}
+	defer rows1.Close()
+
+	for rows1.Next() {
+		var (
+			ReservationID int
+			MACStr, IPStr string
+			MAC           net.HardwareAddr
+		)
+
+		if err = rows1.Scan(&ReservationID, &MACStr, &IPStr); err != nil {
+			return fmt.Errorf("Reservations rows.Scan() error: %s", err)
+		}
+
+		if MAC, err = net.ParseMAC(MACStr); err != nil || len(MAC) != 6 {
+			return fmt.Errorf("Reservation %d: unable to parse MAC '%s'", ReservationID, MACStr)
+		}
+
+		R := &Reservation{
+			MAC: aux.MACByteToInt(MAC),
+			IP:  aux.IPStrToInt(IPStr),
+		}
+
+		if R.IP == 0 || R.IP&Net.Mask != Net.Net {
+			return fmt.Errorf("Reservation %d: IP '%s' does not belong to subnet", ReservationID, IPStr)
+		}
+
+		if _, ok := Net.Reservations[R.MAC]; ok {
+			return fmt.Errorf("Reservation %d: MAC '%s' is already reserved", ReservationID, MACStr)
+		}
+
+		if _, ok := Net.ReservationsIP[R.IP]; ok {
+			return fmt.Errorf("Reservation %d: IP '%s' is already reserved", ReservationID, IPStr)
+		}
+
+		// Reservation's default route goes via its own router if it's defined
+		Router := Net.Router
+		if err = LoadReservationOptions(db, ReservationID, R, &Router); err != nil {
+			return
+		}
+
+		if R.DHCPOptions, err = OptionsReservationRoutes(R.DHCPOptions, Net.DHCPOptions, Router, Net.Router); err != nil {
+			return fmt.Errorf("Reservation %d: %s", ReservationID, err)
+		}
+
+		Net.Reservations[R.MAC] = R
+		Net.ReservationsIP[R.IP] = R
+
+		// Keep reserved address out of random & range allocation
+		Net.AddrUse(R.IP)
+
+		log.Debugf("Subnet %s: reserved %s for %s", Net.NetStr, IPStr, MACStr)
+	}
+
+	if err = rows1.Err(); err != nil {
+		return fmt.Errorf("Reservations rows.Next() error: %s", err)
+	}
+
+	return
+}
+
+// Loads subnet's and common options, common ones are skipped if the subnet defines the same option
+func LoadSubnetOptions(db *sqlx.DB, SubnetID int) (Options []OptionRow, err error) {
+	var rows *sql.Rows
+	if rows, err = db.Query(
+		"SELECT `opt`, `value`, `subnet` FROM "+
+			"(SELECT `opt`, `value`, `ord`, 1 AS `subnet` FROM `dhcp_opts_subnet` WHERE `subnet_id` = ? "+
+			"UNION ALL "+
+			"SELECT `opt`, `value`, `ord`, 0 AS `subnet` FROM `dhcp_opts_common`) "+
+			"AS `t1` "+
+			"ORDER BY `t1`.`opt` ASC, `t1`.`ord` ASC", SubnetID); err != nil {
+		return nil, fmt.Errorf("Subnet options query error: %s", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r OptionRow
+		if err = rows.Scan(&r.Name, &r.Value, &r.Subnet); err != nil {
+			return nil, fmt.Errorf("Subnet options rows.Scan() error: %s", err)
+		}
+
+		Options = append(Options, r)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("Subnet options rows.Next() error: %s", err)
+	}
+
+	return OptionRowsMerge(Options), nil
+}
+
+// Loads reservation's options, Router is updated if reservation overrides it
+func LoadReservationOptions(db *sqlx.DB, ReservationID int, R *Reservation, Router *uint32) (err error) {
+	var rows *sql.Rows
+	if rows, err = db.Query(
+		"SELECT `opt`, `value` FROM `dhcp_opts_reservation` WHERE `reservation_id` = ? ORDER BY `opt` ASC, `ord` ASC",
+		ReservationID); err != nil {
+		return fmt.Errorf("Reservation options query error: %s", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var opt, value string
+		if err = rows.Scan(&opt, &value); err != nil {
+			return fmt.Errorf("Reservation options rows.Scan() error: %s", err)
+		}
+
+		switch OptionName(opt) {
+		case "router":
+			if *Router = aux.IPStrToInt(value); *Router > 0 {
+				R.DHCPOptions = append(R.DHCPOptions, dhcp.Option{
+					Code:  dhcp.OptionRouter,
+					Value: aux.IPIntToNet(*Router).To4(),
+				})
+			}
+
+		case "dns":
+			if DNS := aux.IPStrToInt(value); DNS <= 0 {
+				return fmt.Errorf("Reservation %d: unable to parse DNS '%s' as IP address", ReservationID, value)
+			} else {
+				R.DNS = append(R.DNS, aux.IPIntToNet(DNS))
+			}
+
+		case "lease_ttl":
+			if R.LeaseTTL, err = time.ParseDuration(value); err != nil {
+				return fmt.Errorf("Reservation %d: unable to parse 'lease_ttl' '%s' as duration", ReservationID, value)
+			}
+
+		default:
+			if R.DHCPOptions, err = OptionAdd(R.DHCPOptions, opt, value); err != nil {
+				return fmt.Errorf("Reservation %d: %s", ReservationID, err)
+			}
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("Reservation options rows.Next() error: %s", err)
+	}
+
+	return
+}
+
 func GenerateAutoSubnet(NetAddr uint32, Segment *Segment) (Net *Subnet) {
 	// Construct subnet model
 	Net = &Subnet{
@@ -248,12 +510,18 @@ func GenerateAutoSubnet(NetAddr uint32, Segment *Segment) (Net *Subnet) {
 
 		Mask:     Segment.AutoModeMask,
 		LeaseTTL: Segment.AutoModeLeaseTTL,
-
-		RangeStart: NetAddr + Segment.AutoModeRangeStart,
-		RangeEnd:   NetAddr + Segment.AutoModeRangeEnd,
 	}
 	Net.StatsInit()
 
+	for _, r := range Segment.AutoModeRanges {
+		Net.Ranges = append(Net.Ranges, r.Offset(NetAddr))
+	}
+
+	for _, r := range Segment.AutoModeExclusions {
+		Net.Exclusions = append(Net.Exclusions, r.Offset(NetAddr))
+	}
+	Net.PoolInit()
+
 	Net.DHCPOptions = append(Net.DHCPOptions,
 		dhcp.Option{
 			Code:  dhcp.OptionRouter,
@@ -268,6 +536,21 @@ func GenerateAutoSubnet(NetAddr uint32, Segment *Segment) (Net *Subnet) {
 		},
 	)
 
+	// Routes' gateways are relative to the network like the router is
+	if len(Segment.AutoModeRoutes) > 0 {
+		var Routes []byte
+		for _, r := range Segment.AutoModeRoutes {
+			r.Router += NetAddr
+			Routes = append(Routes, r.Encode()...)
+		}
+
+		// Length is checked when config is loaded
+		Net.DHCPOptions, _ = OptionsClasslessRoutes(append(Net.DHCPOptions, dhcp.Option{
+			Code:  dhcp.OptionClasslessRouteFormat,
+			Value: Routes,
+		}), NetAddr+Segment.AutoModeRouter)
+	}
+
 	return
 }
 
@@ -281,8 +564,9 @@ func CacheReload() (err error, Duration time.Duration) {
 	defer CacheReloading.UnSet()
 
 	TimeStart := time.Now()
-	log.Warnf("Starting to reload cache from Aerospike...")
+	log.Warnf("Starting to reload cache from '%s' backend...", o.DHCPBackend)
 
+	// Requests, workers and dumps are paused, ConfigReload can't swap segments meanwhile
 	CacheReloadingMtx.Lock()
 	defer CacheReloadingMtx.Unlock()
 
@@ -290,14 +574,7 @@ func CacheReload() (err error, Duration time.Duration) {
 		Seg.DeleteDynamicSubnets()
 	}
 
-	if err = SubnetsDownloadFromAerospike(); err != nil {
-		err = fmt.Errorf("Unable to download subnets from Aerospike: %s", err)
-		log.Warnf("%s", err)
-		return
-	}
-
-	if err = LeasesDownloadFromAerospike(); err != nil {
-		err = fmt.Errorf("Unable to download leases from Aerospike: %s", err)
+	if err = DHCPBackend.Load(); err != nil {
 		log.Warnf("%s", err)
 		return
 	}
@@ -313,32 +590,43 @@ func main() {
 		wg  sync.WaitGroup
 	)
 
+	if flag.Parse(); CheckConfig {
+		os.Exit(ConfigCheck())
+	}
+
 	log.Warnf("Starting %s", AppInfo)
 
 	if o, err = ConfigLoad(); err != nil {
 		log.Fatalf("Unable to load config file: %s", err)
 	}
 
-	if err = LoadSegments(); err != nil {
+	if err = LoadSegments(o.Segments); err != nil {
 		log.Fatalf("Segments loading error: %s", err)
 	}
 
-	// Initialize Aerospike
-	as = mtspike.Handle{
-		Hosts:     o.ASHosts,
-		Namespace: o.ASNamespace,
+	if o.DHCPBackend == BACKEND_HASH {
+		// Initialize Aerospike
+		as = mtspike.Handle{
+			Hosts:     o.ASHosts,
+			Namespace: o.ASNamespace,
+		}
+
+		// Connect to Aerospike
+		if err = as.Connect(); err != nil {
+			log.Fatalf("Unable to connect to Aerospike: %s", err)
+		}
+		log.Warnf("Aerospike connected")
 	}
 
-	// Connect to Aerospike
-	if err = as.Connect(); err != nil {
-		log.Fatalf("Unable to connect to Aerospike: %s", err)
+	if DHCPBackend, err = ConstructBackend(o.DHCPBackend); err != nil {
+		log.Fatalf("Unable to construct '%s' backend: %s", o.DHCPBackend, err)
 	}
-	log.Warnf("Aerospike connected")
 
 	sigchannel := make(chan os.Signal, 1)
 	signal.Notify(sigchannel, syscall.SIGHUP)
 	signal.Notify(sigchannel, syscall.SIGTERM)
 	signal.Notify(sigchannel, syscall.SIGUSR1)
+	signal.Notify(sigchannel, syscall.SIGUSR2)
 	signal.Notify(sigchannel, os.Interrupt)
 
 	go func() {
@@ -348,6 +636,9 @@ func main() {
 				go CacheReload()
 			case syscall.SIGUSR1:
 				log.Warnf("Got SIGUSR1, dumping statistics")
+			case syscall.SIGUSR2:
+				log.Warnf("Got SIGUSR2, reloading configuration")
+				go ConfigReload()
 			case os.Interrupt, syscall.SIGTERM:
 				log.Warnf("Got SIGTERM, shutting down")
 				HandleShutdown()
@@ -361,22 +652,33 @@ func main() {
 		}
 	}
 
-	if len(o.DHCPListen) == 0 {
-		log.Fatal("No DHCP listening address defined")
+	if len(o.DHCPListen) == 0 && len(o.DHCPListenInterfaces) == 0 {
+		log.Fatal("No DHCP listening address or interface defined")
+	}
+
+	if err = AlertsInit(); err != nil {
+		log.Fatalf("Unable to initialize alerts: %s", err)
+	}
+
+	if err = LeaseEventsInit(); err != nil {
+		log.Fatalf("Unable to initialize lease events: %s", err)
+	}
+
+	if err = DHCPBackend.Load(); err != nil {
+		log.Fatalf("Unable to load subnets & leases: %s", err)
 	}
 
-	if err = SubnetsDownloadFromAerospike(); err != nil {
-		log.Fatalf("Unable to load subnets from Aerospike: %s", err)
+	if err = DHCPBackend.Init(); err != nil {
+		log.Fatalf("Unable to initialize backend: %s", err)
 	}
 
-	if err = LeasesDownloadFromAerospike(); err != nil {
-		log.Fatalf("Unable to load leases from Aerospike: %s", err)
+	if err = MetricsInit(); err != nil {
+		log.Fatalf("Unable to initialize metrics: %s", err)
 	}
 
-	DHCPBackend = ConstructBackend()
-	DHCPBackend.Init()
+	DHCPWorkersStart()
+	go RateLimitWorker(o.DHCPCleanupInterval)
 
-	MetricsInit()
 	for _, v := range o.DHCPListen {
 		wg.Add(1)
 
@@ -386,6 +688,15 @@ func main() {
 		}(v)
 	}
 
+	for _, v := range o.DHCPListenInterfaces {
+		wg.Add(1)
+
+		go func(iface string) {
+			defer wg.Done()
+			DHCPServeInterface(iface)
+		}(v)
+	}
+
 	go MiscMemoryMonitor()
 	wg.Wait()
 }
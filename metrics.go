@@ -6,15 +6,18 @@ import (
 	"mt-aux/metrics"
 	"strconv"
 	"time"
+
+	log "github.com/Sirupsen/logrus"
 )
 
 var (
-	InfluxDB *metrics.InfluxDB
+	InfluxDB     *metrics.InfluxDB
+	MetricsSinks []MetricsSink
 )
 
 // Send periodic stats metric
 func MetricsSendCleanup(Segment *Segment, Subnet *Subnet, Duration time.Duration, ExpiredByMAC, ExpiredByIP int) (err error) {
-	if !o.MetricsEnabled {
+	if len(MetricsSinks) == 0 {
 		return
 	}
 
@@ -31,7 +34,7 @@ func MetricsSendCleanup(Segment *Segment, Subnet *Subnet, Duration time.Duration
 		"ExpiredByIP":  ExpiredByIP,
 	}
 
-	InfluxDB.SendMetric(&metrics.InfluxDBMetric{
+	MetricsSend(&metrics.InfluxDBMetric{
 		Measurement: o.MetricsMeasurementCleanup,
 		Timestamp:   time.Now(),
 
@@ -44,7 +47,7 @@ func MetricsSendCleanup(Segment *Segment, Subnet *Subnet, Duration time.Duration
 
 // Send periodic stats metric
 func MetricsSendStats(Segment *Segment, Subnet *Subnet, Duration time.Duration) (err error) {
-	if !o.MetricsEnabled {
+	if len(MetricsSinks) == 0 {
 		return
 	}
 
@@ -62,7 +65,7 @@ func MetricsSendStats(Segment *Segment, Subnet *Subnet, Duration time.Duration)
 		"LeasesExpired": Subnet.LeasesExpired(),
 	}
 
-	InfluxDB.SendMetric(&metrics.InfluxDBMetric{
+	MetricsSend(&metrics.InfluxDBMetric{
 		Measurement: o.MetricsMeasurementStats,
 		Timestamp:   time.Now(),
 
@@ -75,7 +78,7 @@ func MetricsSendStats(Segment *Segment, Subnet *Subnet, Duration time.Duration)
 
 // Send periodic stats segments metric
 func MetricsSendStatsSegment(Segment *Segment, Duration time.Duration) (err error) {
-	if !o.MetricsEnabled {
+	if len(MetricsSinks) == 0 {
 		return
 	}
 
@@ -92,7 +95,7 @@ func MetricsSendStatsSegment(Segment *Segment, Duration time.Duration) (err erro
 		"LeasesExpired": Segment.LeasesExpired,
 	}
 
-	InfluxDB.SendMetric(&metrics.InfluxDBMetric{
+	MetricsSend(&metrics.InfluxDBMetric{
 		Measurement: o.MetricsMeasurementStatsSegment,
 		Timestamp:   time.Now(),
 
@@ -103,9 +106,41 @@ func MetricsSendStatsSegment(Segment *Segment, Duration time.Duration) (err erro
 	return
 }
 
+// Send metric about subnet's utilization level change
+func MetricsSendAlert(a *UtilAlert) (err error) {
+	if len(MetricsSinks) == 0 {
+		return
+	}
+
+	Tags := map[string]string{
+		"ServerID":    o.ServerID,
+		"SegmentName": a.Segment,
+		"Subnet":      a.Subnet,
+		"Level":       a.Level.String(),
+		"PrevLevel":   a.PrevLevel.String(),
+	}
+
+	Fields := map[string]interface{}{
+		"Level":        int(a.Level),
+		"Utilization":  a.Utilization,
+		"LeasesActive": a.LeasesActive,
+		"LeasesTotal":  a.Capacity,
+	}
+
+	MetricsSend(&metrics.InfluxDBMetric{
+		Measurement: o.MetricsMeasurementAlerts,
+		Timestamp:   a.Time,
+
+		Tags:   Tags,
+		Fields: Fields,
+	})
+
+	return
+}
+
 // Send metric about a single DHCP request
 func MetricsSendDHCPRequest(Ctx *ReqCtx) (err error) {
-	if !o.MetricsEnabled {
+	if len(MetricsSinks) == 0 {
 		return
 	}
 
@@ -125,6 +160,10 @@ func MetricsSendDHCPRequest(Ctx *ReqCtx) (err error) {
 		Tags["Subnet"] = Ctx.SubnetCopy.NetStr
 	}
 
+	if Ctx.Class != nil {
+		Tags["Class"] = Ctx.Class.Name
+	}
+
 	if Ctx.DropReason != "" {
 		Tags["DropReason"] = Ctx.DropReason
 	}
@@ -148,6 +187,8 @@ func MetricsSendDHCPRequest(Ctx *ReqCtx) (err error) {
 		Tags["RelayIPSource"] = "Option82"
 	case STATS_RELAYIP_UNICAST:
 		Tags["RelayIPSource"] = "Unicast"
+	case STATS_RELAYIP_INTERFACE:
+		Tags["RelayIPSource"] = "Interface"
 	}
 
 	Fields := map[string]interface{}{
@@ -179,7 +220,7 @@ func MetricsSendDHCPRequest(Ctx *ReqCtx) (err error) {
 		}
 	}
 
-	InfluxDB.SendMetric(&metrics.InfluxDBMetric{
+	MetricsSend(&metrics.InfluxDBMetric{
 		Measurement: o.MetricsMeasurementRequests,
 		Timestamp:   time.Now(),
 
@@ -190,15 +231,42 @@ func MetricsSendDHCPRequest(Ctx *ReqCtx) (err error) {
 	return
 }
 
+// Fans metric out to all the configured sinks
+func MetricsSend(m *metrics.InfluxDBMetric) {
+	for _, s := range MetricsSinks {
+		s.Send(m)
+	}
+}
+
 func MetricsInit() (err error) {
-	InfluxDB = &metrics.InfluxDB{
-		InfluxDBHosts: o.MetricsHosts,
-		RoundRobin:    true,
+	MetricsSinks, err = MetricsSinksStart(o)
+	return
+}
+
+// Legacy InfluxDB client is switched by metrics.enable, configured sinks are always started
+func MetricsSinksStart(Cfg *Opts) (Sinks []MetricsSink, err error) {
+	if Cfg.MetricsEnabled && len(Cfg.MetricsHosts) > 0 {
+		InfluxDB = &metrics.InfluxDB{
+			InfluxDBHosts: Cfg.MetricsHosts,
+			RoundRobin:    true,
+		}
+
+		if err = InfluxDB.Init(); err != nil {
+			err = fmt.Errorf("Unable to initialize InfluxDB: %s", err)
+			return
+		}
+
+		Sinks = append(Sinks, &MetricsSinkInfluxDB{DB: InfluxDB})
 	}
 
-	if err = InfluxDB.Init(); err != nil {
-		err = fmt.Errorf("Unable to initialize InfluxDB: %s", err)
-		return
+	for _, c := range Cfg.MetricsSinks {
+		var Sink MetricsSink
+		if Sink, err = NewMetricsSink(c); err != nil {
+			return
+		}
+
+		Sinks = append(Sinks, Sink)
+		log.Infof("Metrics sink '%s': %s", c.Name, c)
 	}
 
 	return
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mt-aux/metrics"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	SINK_INFLUXDB_UDP  = "influxdb_udp"
+	SINK_INFLUXDB_HTTP = "influxdb_http"
+	SINK_STATSD        = "statsd"
+	SINK_FILE          = "file"
+)
+
+// Destination of metrics, Send should never block request processing
+type MetricsSink interface {
+	Send(*metrics.InfluxDBMetric)
+}
+
+// Settings of [metrics.sinks.NAME]
+type MetricsSinkConfig struct {
+	Name string
+	Type string
+
+	Address       string // influxdb_udp, statsd
+	URL           string // influxdb_http
+	Path          string // file
+	Prefix        string // statsd
+	Tags          bool   // statsd: DogStatsD tags
+	MaxPacketSize int
+
+	QueueSize     int
+	BatchSize     int
+	FlushInterval time.Duration
+}
+
+func MetricsSinkConfigLoad(Name string, v *viper.Viper) (c MetricsSinkConfig, err error) {
+	v.SetDefault("max_packet_size", 1400)
+	v.SetDefault("queue_size", 10000)
+	v.SetDefault("batch_size", 500)
+	v.SetDefault("flush_interval", time.Second)
+
+	c = MetricsSinkConfig{
+		Name:          Name,
+		Type:          v.GetString("type"),
+		Address:       v.GetString("address"),
+		URL:           v.GetString("url"),
+		Path:          v.GetString("path"),
+		Prefix:        v.GetString("prefix"),
+		Tags:          v.GetBool("tags"),
+		MaxPacketSize: v.GetInt("max_packet_size"),
+		QueueSize:     v.GetInt("queue_size"),
+		BatchSize:     v.GetInt("batch_size"),
+		FlushInterval: v.GetDuration("flush_interval"),
+	}
+
+	switch c.Type {
+	case SINK_INFLUXDB_UDP, SINK_STATSD:
+		if c.Address == "" {
+			err = fmt.Errorf("Sink '%s': address should be defined", Name)
+		}
+
+	case SINK_INFLUXDB_HTTP:
+		if c.URL == "" {
+			err = fmt.Errorf("Sink '%s': url should be defined", Name)
+		}
+
+	case SINK_FILE:
+		if c.Path == "" {
+			err = fmt.Errorf("Sink '%s': path should be defined", Name)
+		}
+
+	default:
+		err = fmt.Errorf("Sink '%s': type can be one of '%s', '%s', '%s', '%s'", Name, SINK_INFLUXDB_UDP, SINK_INFLUXDB_HTTP, SINK_STATSD, SINK_FILE)
+	}
+
+	if err == nil && (c.QueueSize <= 0 || c.BatchSize <= 0 || c.FlushInterval <= 0 || c.MaxPacketSize <= 0) {
+		err = fmt.Errorf("Sink '%s': queue_size, batch_size, flush_interval and max_packet_size should be > 0", Name)
+	}
+
+	return
+}
+
+func (c MetricsSinkConfig) String() string {
+	switch c.Type {
+	case SINK_INFLUXDB_HTTP:
+		return fmt.Sprintf("%s (%s)", c.Type, c.URL)
+	case SINK_FILE:
+		return fmt.Sprintf("%s (%s)", c.Type, c.Path)
+	}
+
+	return fmt.Sprintf("%s (%s)", c.Type, c.Address)
+}
+
+func NewMetricsSink(c MetricsSinkConfig) (s MetricsSink, err error) {
+	q := &MetricsQueue{
+		Name:  c.Name,
+		Queue: make(chan *metrics.InfluxDBMetric, c.QueueSize),
+	}
+
+	switch c.Type {
+	case SINK_INFLUXDB_UDP:
+		var Conn net.Conn
+		if Conn, err = net.Dial("udp", c.Address); err != nil {
+			return nil, fmt.Errorf("Sink '%s': %s", c.Name, err)
+		}
+
+		q.Flush = func(Batch []*metrics.InfluxDBMetric) error {
+			return MetricsWritePackets(Conn, c.MaxPacketSize, Batch, InfluxDBLine)
+		}
+
+	case SINK_INFLUXDB_HTTP:
+		Client := &http.Client{Timeout: 5 * time.Second}
+
+		q.Flush = func(Batch []*metrics.InfluxDBMetric) (err error) {
+			var b bytes.Buffer
+			for _, m := range Batch {
+				b.WriteString(InfluxDBLine(m))
+			}
+
+			var r *http.Response
+			if r, err = Client.Post(c.URL, "text/plain", &b); err != nil {
+				return
+			}
+			r.Body.Close()
+
+			if r.StatusCode/100 != 2 {
+				err = fmt.Errorf("HTTP status %s", r.Status)
+			}
+
+			return
+		}
+
+	case SINK_STATSD:
+		var Conn net.Conn
+		if Conn, err = net.Dial("udp", c.Address); err != nil {
+			return nil, fmt.Errorf("Sink '%s': %s", c.Name, err)
+		}
+
+		q.Flush = func(Batch []*metrics.InfluxDBMetric) error {
+			return MetricsWritePackets(Conn, c.MaxPacketSize, Batch, func(m *metrics.InfluxDBMetric) string {
+				return StatsDLines(m, c.Prefix, c.Tags)
+			})
+		}
+
+	case SINK_FILE:
+		var f *os.File
+		if f, err = os.OpenFile(c.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+			return nil, fmt.Errorf("Sink '%s': %s", c.Name, err)
+		}
+
+		q.Flush = func(Batch []*metrics.InfluxDBMetric) (err error) {
+			var b bytes.Buffer
+			for _, m := range Batch {
+				b.Write(JSONLine(m))
+			}
+
+			_, err = f.Write(b.Bytes())
+			return
+		}
+
+	default:
+		return nil, fmt.Errorf("Sink '%s': unknown type '%s'", c.Name, c.Type)
+	}
+
+	go q.Worker(c.BatchSize, c.FlushInterval)
+	return q, nil
+}
+
+// Legacy InfluxDB client configured by metrics.hosts
+type MetricsSinkInfluxDB struct {
+	DB *metrics.InfluxDB
+}
+
+func (s *MetricsSinkInfluxDB) Send(m *metrics.InfluxDBMetric) {
+	s.DB.SendMetric(m)
+}
+
+// Buffers metrics and flushes them in batches from its own goroutine,
+// metrics are dropped if the destination can't keep up
+type MetricsQueue struct {
+	Name    string
+	Queue   chan *metrics.InfluxDBMetric
+	Flush   func([]*metrics.InfluxDBMetric) error
+	Dropped uint64
+}
+
+func (q *MetricsQueue) Send(m *metrics.InfluxDBMetric) {
+	select {
+	case q.Queue <- m:
+	default:
+		atomic.AddUint64(&q.Dropped, 1)
+	}
+}
+
+func (q *MetricsQueue) Worker(BatchSize int, Interval time.Duration) {
+	var (
+		Batch   []*metrics.InfluxDBMetric
+		Dropped uint64
+		Ticker  = time.NewTicker(Interval)
+	)
+
+	for {
+		select {
+		case m := <-q.Queue:
+			if Batch = append(Batch, m); len(Batch) < BatchSize {
+				continue
+			}
+
+		case <-Ticker.C:
+			if d := atomic.LoadUint64(&q.Dropped); d != Dropped {
+				log.Warnf("Metrics sink '%s': %d metrics dropped due to full queue", q.Name, d-Dropped)
+				Dropped = d
+			}
+
+			if len(Batch) == 0 {
+				continue
+			}
+		}
+
+		if err := q.Flush(Batch); err != nil {
+			log.Warnf("Metrics sink '%s': unable to send %d metrics: %s", q.Name, len(Batch), err)
+		}
+
+		Batch = Batch[:0]
+	}
+}
+
+// Packs lines into datagrams no longer than MaxSize, longer lines are sent alone
+func MetricsWritePackets(Conn net.Conn, MaxSize int, Batch []*metrics.InfluxDBMetric, Encode func(*metrics.InfluxDBMetric) string) (err error) {
+	var b bytes.Buffer
+
+	for _, m := range Batch {
+		for _, Line := range strings.SplitAfter(Encode(m), "\n") {
+			if Line == "" {
+				continue
+			}
+
+			if b.Len() > 0 && b.Len()+len(Line) > MaxSize {
+				if _, err = Conn.Write(b.Bytes()); err != nil {
+					return
+				}
+				b.Reset()
+			}
+
+			b.WriteString(Line)
+		}
+	}
+
+	if b.Len() > 0 {
+		_, err = Conn.Write(b.Bytes())
+	}
+
+	return
+}
+
+var (
+	influxDBEscaperMeasurement = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxDBEscaperTag         = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+	influxDBEscaperString      = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	statsDEscaper              = strings.NewReplacer(",", "_", "|", "_", "\n", "_")
+)
+
+func sortedKeys(m map[string]string) (Keys []string) {
+	for k := range m {
+		Keys = append(Keys, k)
+	}
+	sort.Strings(Keys)
+	return
+}
+
+// Encodes metric in InfluxDB line protocol with nanosecond timestamp
+func InfluxDBLine(m *metrics.InfluxDBMetric) string {
+	var b bytes.Buffer
+
+	b.WriteString(influxDBEscaperMeasurement.Replace(m.Measurement))
+
+	for _, k := range sortedKeys(m.Tags) {
+		if m.Tags[k] == "" {
+			continue
+		}
+
+		b.WriteString("," + influxDBEscaperTag.Replace(k) + "=" + influxDBEscaperTag.Replace(m.Tags[k]))
+	}
+
+	var Fields []string
+	for k, v := range m.Fields {
+		f := influxDBEscaperTag.Replace(k) + "="
+
+		switch t := v.(type) {
+		case int:
+			f += strconv.Itoa(t) + "i"
+		case int64:
+			f += strconv.FormatInt(t, 10) + "i"
+		case uint64:
+			f += strconv.FormatUint(t, 10) + "i"
+		case float64:
+			f += strconv.FormatFloat(t, 'g', -1, 64)
+		case bool:
+			f += strconv.FormatBool(t)
+		default:
+			f += `"` + influxDBEscaperString.Replace(fmt.Sprint(t)) + `"`
+		}
+
+		Fields = append(Fields, f)
+	}
+	sort.Strings(Fields)
+
+	b.WriteString(" " + strings.Join(Fields, ",") + " " + strconv.FormatInt(m.Timestamp.UnixNano(), 10) + "\n")
+	return b.String()
+}
+
+// Encodes numeric fields as StatsD gauges, durations (microseconds) as timers in milliseconds.
+// Non-numeric fields like MAC are skipped, tags are appended in DogStatsD format if enabled
+func StatsDLines(m *metrics.InfluxDBMetric, Prefix string, Tags bool) string {
+	var (
+		b      bytes.Buffer
+		Suffix string
+	)
+
+	if Tags {
+		var t []string
+		for _, k := range sortedKeys(m.Tags) {
+			if m.Tags[k] != "" {
+				t = append(t, k+":"+statsDEscaper.Replace(m.Tags[k]))
+			}
+		}
+
+		// Empty tags section is rejected by DogStatsD
+		if len(t) > 0 {
+			Suffix = "|#" + strings.Join(t, ",")
+		}
+	}
+
+	for k, v := range m.Fields {
+		var Value float64
+
+		switch t := v.(type) {
+		case int:
+			Value = float64(t)
+		case int64:
+			Value = float64(t)
+		case uint64:
+			Value = float64(t)
+		case float64:
+			Value = t
+		default:
+			continue
+		}
+
+		Type := "g"
+		if strings.HasSuffix(k, "Duration") {
+			Type, Value = "ms", Value/1000
+		}
+
+		fmt.Fprintf(&b, "%s%s.%s:%s|%s%s\n", Prefix, m.Measurement, k, strconv.FormatFloat(Value, 'f', -1, 64), Type, Suffix)
+	}
+
+	return b.String()
+}
+
+func JSONLine(m *metrics.InfluxDBMetric) []byte {
+	js, _ := json.Marshal(struct {
+		Measurement string                 `json:"measurement"`
+		Timestamp   time.Time              `json:"timestamp"`
+		Tags        map[string]string      `json:"tags"`
+		Fields      map[string]interface{} `json:"fields"`
+	}{m.Measurement, m.Timestamp, m.Tags, m.Fields})
+
+	return append(js, '\n')
+}
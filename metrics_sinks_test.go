@@ -0,0 +1,198 @@
+package main
+
+import (
+	"io/ioutil"
+	"mt-aux/metrics"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+var TestMetricTime = time.Unix(1600000000, 123)
+
+func NewTestMetric() *metrics.InfluxDBMetric {
+	return &metrics.InfluxDBMetric{
+		Measurement: "dhcp requests",
+		Timestamp:   TestMetricTime,
+		Tags: map[string]string{
+			"segment": "seg,1 a=b",
+			"subnet":  "10.0.0.0/24",
+			"empty":   "",
+		},
+		Fields: map[string]interface{}{
+			"Count":           uint64(3),
+			"RequestDuration": int64(1500),
+			"Ratio":           0.5,
+			"Ok":              true,
+			"MAC":             `00:11:"22"\`,
+		},
+	}
+}
+
+// Lines of StatsD output in stable order
+func SortedLines(s string) []string {
+	Lines := strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+	sort.Strings(Lines)
+	return Lines
+}
+
+func TestInfluxDBLine(t *testing.T) {
+	Expected := `dhcp\ requests,segment=seg\,1\ a\=b,subnet=10.0.0.0/24 ` +
+		`Count=3i,MAC="00:11:\"22\"\\",Ok=true,Ratio=0.5,RequestDuration=1500i 1600000000000000123` + "\n"
+
+	if Line := InfluxDBLine(NewTestMetric()); Line != Expected {
+		t.Fatalf("Line:\n%s\nexpected:\n%s", Line, Expected)
+	}
+}
+
+func TestStatsDLines(t *testing.T) {
+	m := NewTestMetric()
+	m.Measurement = "dhcp"
+
+	Lines := SortedLines(StatsDLines(m, "mt.", true))
+	Expected := []string{
+		"mt.dhcp.Count:3|g|#segment:seg_1 a=b,subnet:10.0.0.0/24",
+		"mt.dhcp.Ratio:0.5|g|#segment:seg_1 a=b,subnet:10.0.0.0/24",
+		"mt.dhcp.RequestDuration:1.5|ms|#segment:seg_1 a=b,subnet:10.0.0.0/24",
+	}
+
+	if strings.Join(Lines, "\n") != strings.Join(Expected, "\n") {
+		t.Fatalf("Lines:\n%s\nexpected:\n%s", strings.Join(Lines, "\n"), strings.Join(Expected, "\n"))
+	}
+
+	// No tags section if there are no tag values
+	m.Tags = map[string]string{"segment": ""}
+	for _, Line := range SortedLines(StatsDLines(m, "", true)) {
+		if strings.Contains(Line, "|#") {
+			t.Fatalf("Empty tags section in '%s'", Line)
+		}
+	}
+
+	if Lines := SortedLines(StatsDLines(NewTestMetric(), "", false)); strings.Contains(Lines[0], "#") {
+		t.Fatalf("Tags are added while disabled: '%s'", Lines[0])
+	}
+}
+
+// Records written datagrams
+type TestPacketConn struct {
+	net.Conn
+	Packets []string
+}
+
+func (c *TestPacketConn) Write(b []byte) (int, error) {
+	c.Packets = append(c.Packets, string(b))
+	return len(b), nil
+}
+
+func TestMetricsWritePackets(t *testing.T) {
+	Line := func(m *metrics.InfluxDBMetric) string {
+		return strings.Repeat(m.Measurement, 10) + "\n"
+	}
+
+	// 11 byte lines, 3 fit into 40 byte packet, 50 byte line goes alone
+	var Batch []*metrics.InfluxDBMetric
+	for _, Name := range []string{"a", "b", "c", "d", "e", "fffff", "g"} {
+		Batch = append(Batch, &metrics.InfluxDBMetric{Measurement: Name})
+	}
+
+	c := &TestPacketConn{}
+	if err := MetricsWritePackets(c, 40, Batch, Line); err != nil {
+		t.Fatal(err)
+	}
+
+	Sizes := []int{}
+	for _, p := range c.Packets {
+		if !strings.HasSuffix(p, "\n") {
+			t.Fatalf("Packet ends in the middle of line: %q", p)
+		}
+		Sizes = append(Sizes, len(p))
+	}
+
+	if len(Sizes) != 4 || Sizes[0] != 33 || Sizes[1] != 22 || Sizes[2] != 51 || Sizes[3] != 11 {
+		t.Fatalf("Packet sizes %v, expected [33 22 51 11]", Sizes)
+	}
+}
+
+func TestMetricsSinkInfluxDBUDP(t *testing.T) {
+	Conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Conn.Close()
+
+	s, err := NewMetricsSink(MetricsSinkConfig{
+		Name: "udp", Type: SINK_INFLUXDB_UDP, Address: Conn.LocalAddr().String(),
+		MaxPacketSize: 1400, QueueSize: 10, BatchSize: 2, FlushInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Full batch is flushed without waiting for the interval
+	s.Send(NewTestMetric())
+	s.Send(NewTestMetric())
+
+	Conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	Buffer := make([]byte, 2000)
+	n, _, err := Conn.ReadFromUDP(Buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if Expected := strings.Repeat(InfluxDBLine(NewTestMetric()), 2); string(Buffer[:n]) != Expected {
+		t.Fatalf("Packet:\n%s\nexpected:\n%s", Buffer[:n], Expected)
+	}
+}
+
+func TestMetricsSinkInfluxDBHTTP(t *testing.T) {
+	Bodies := make(chan string, 1)
+	Server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Body, _ := ioutil.ReadAll(r.Body)
+		Bodies <- string(Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer Server.Close()
+
+	s, err := NewMetricsSink(MetricsSinkConfig{
+		Name: "http", Type: SINK_INFLUXDB_HTTP, URL: Server.URL + "/write?db=dhcp",
+		MaxPacketSize: 1400, QueueSize: 10, BatchSize: 100, FlushInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Partial batch is flushed by the interval
+	s.Send(NewTestMetric())
+
+	select {
+	case Body := <-Bodies:
+		if Body != InfluxDBLine(NewTestMetric()) {
+			t.Fatalf("Body:\n%s\nexpected:\n%s", Body, InfluxDBLine(NewTestMetric()))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Nothing was posted")
+	}
+}
+
+// Sinks don't depend on the legacy InfluxDB switch
+func TestMetricsSinksStart(t *testing.T) {
+	Sinks, err := MetricsSinksStart(&Opts{
+		MetricsEnabled: false,
+		MetricsHosts:   []string{"127.0.0.1:1"},
+		MetricsSinks: []MetricsSinkConfig{{
+			Name: "statsd", Type: SINK_STATSD, Address: "127.0.0.1:1",
+			MaxPacketSize: 1400, QueueSize: 10, BatchSize: 1, FlushInterval: time.Hour,
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(Sinks) != 1 {
+		t.Fatalf("%d sinks started, expected only the configured one", len(Sinks))
+	}
+}
@@ -0,0 +1,566 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	dhcp "mt-aux/dhcp"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	OPT_TYPE_IP = iota
+	OPT_TYPE_IPS
+	OPT_TYPE_UINT8
+	OPT_TYPE_UINT16
+	OPT_TYPE_UINT32
+	OPT_TYPE_INT32
+	OPT_TYPE_STRING
+	OPT_TYPE_BOOL
+	OPT_TYPE_HEX
+	OPT_TYPE_ROUTES
+	OPT_TYPE_DOMAINS
+	OPT_TYPE_CLASSLESS_ROUTES
+)
+
+// Microsoft's pre-RFC 3442 code for classless static routes, same encoding as 121
+const OptionMSClasslessRouteFormat dhcp.OptionCode = 249
+
+// Describes how option's value from MySQL is encoded
+type OptionDef struct {
+	Code dhcp.OptionCode
+	Name string
+	Type int
+}
+
+// List options can be given in several rows (ordered by 'ord') and are merged into one
+func (d *OptionDef) List() bool {
+	switch d.Type {
+	case OPT_TYPE_IPS, OPT_TYPE_ROUTES, OPT_TYPE_DOMAINS, OPT_TYPE_HEX, OPT_TYPE_CLASSLESS_ROUTES:
+		return true
+	}
+
+	return false
+}
+
+var (
+	OptionDefs = []*OptionDef{
+		{2, "time_offset", OPT_TYPE_INT32},
+		{3, "router", OPT_TYPE_IPS},
+		{4, "time_servers", OPT_TYPE_IPS},
+		{6, "dns", OPT_TYPE_IPS},
+		{7, "log_servers", OPT_TYPE_IPS},
+		{12, "hostname", OPT_TYPE_STRING},
+		{15, "domain_name", OPT_TYPE_STRING},
+		{19, "ip_forwarding", OPT_TYPE_BOOL},
+		{23, "default_ip_ttl", OPT_TYPE_UINT8},
+		{26, "mtu", OPT_TYPE_UINT16},
+		{28, "broadcast_address", OPT_TYPE_IP},
+		{33, "static_routes", OPT_TYPE_ROUTES},
+		{35, "arp_cache_timeout", OPT_TYPE_UINT32},
+		{37, "tcp_default_ttl", OPT_TYPE_UINT8},
+		{42, "ntp_servers", OPT_TYPE_IPS},
+		{43, "vendor_specific", OPT_TYPE_HEX},
+		{44, "netbios_name_servers", OPT_TYPE_IPS},
+		{46, "netbios_node_type", OPT_TYPE_UINT8},
+		{47, "netbios_scope", OPT_TYPE_STRING},
+		{66, "tftp_server_name", OPT_TYPE_STRING},
+		{67, "bootfile_name", OPT_TYPE_STRING},
+		{69, "smtp_servers", OPT_TYPE_IPS},
+		{72, "www_servers", OPT_TYPE_IPS},
+		{100, "posix_timezone", OPT_TYPE_STRING},
+		{101, "tz_database", OPT_TYPE_STRING},
+		{114, "captive_portal", OPT_TYPE_STRING},
+		{119, "domain_search", OPT_TYPE_DOMAINS},
+		{121, "classless_routes", OPT_TYPE_CLASSLESS_ROUTES},
+		{138, "capwap_ac", OPT_TYPE_IPS},
+		{150, "tftp_servers", OPT_TYPE_IPS},
+		{249, "ms_classless_routes", OPT_TYPE_CLASSLESS_ROUTES},
+		{252, "wpad", OPT_TYPE_STRING},
+	}
+
+	OptionDefsByName = map[string]*OptionDef{}
+	OptionDefsByCode = map[dhcp.OptionCode]*OptionDef{}
+
+	// Options that are generated by the server itself and can't be configured
+	OptionsForbidden = map[dhcp.OptionCode]bool{
+		dhcp.OptionSubnetMask:             true,
+		dhcp.OptionRequestedIPAddress:     true,
+		dhcp.OptionIPAddressLeaseTime:     true,
+		dhcp.OptionOverload:               true,
+		dhcp.OptionDHCPMessageType:        true,
+		dhcp.OptionServerIdentifier:       true,
+		dhcp.OptionParameterRequestList:   true,
+		dhcp.OptionMaximumDHCPMessageSize: true,
+		dhcp.OptionRenewalTimeValue:       true,
+		dhcp.OptionRebindingTimeValue:     true,
+		dhcp.OptionClientIdentifier:       true,
+		dhcp.OptionRelayAgentInformation:  true,
+	}
+)
+
+func init() {
+	for _, d := range OptionDefs {
+		OptionDefsByName[d.Name] = d
+		OptionDefsByCode[d.Code] = d
+	}
+}
+
+// Finds option by name or numeric code, unknown numeric codes are treated as hex
+func OptionLookup(Name string) (d *OptionDef, err error) {
+	var (
+		Code uint64
+		ok   bool
+	)
+
+	if d, ok = OptionDefsByName[Name]; !ok {
+		if Code, err = strconv.ParseUint(Name, 10, 8); err != nil {
+			return nil, fmt.Errorf("Unknown option '%s'", Name)
+		}
+
+		if d, ok = OptionDefsByCode[dhcp.OptionCode(Code)]; !ok {
+			d = &OptionDef{
+				Code: dhcp.OptionCode(Code),
+				Name: Name,
+				Type: OPT_TYPE_HEX,
+			}
+		}
+	}
+
+	if d.Code == dhcp.Pad || d.Code == dhcp.End || OptionsForbidden[d.Code] {
+		return nil, fmt.Errorf("Option '%s' can't be configured", Name)
+	}
+
+	return
+}
+
+// Returns registry name for numeric codes of known options, so they're handled the same way
+func OptionName(Name string) string {
+	if Code, err := strconv.ParseUint(Name, 10, 8); err == nil {
+		if d, ok := OptionDefsByCode[dhcp.OptionCode(Code)]; ok {
+			return d.Name
+		}
+	}
+
+	return Name
+}
+
+// Option row from MySQL, Subnet is set for subnet-specific rows
+type OptionRow struct {
+	Name   string
+	Value  string
+	Subnet bool
+}
+
+// Drops common rows of options which the subnet defines, no matter if by name or by code
+func OptionRowsMerge(Rows []OptionRow) (Merged []OptionRow) {
+	Defined := map[string]bool{}
+	for _, r := range Rows {
+		if r.Subnet {
+			Defined[OptionName(r.Name)] = true
+		}
+	}
+
+	for _, r := range Rows {
+		if r.Subnet || !Defined[OptionName(r.Name)] {
+			Merged = append(Merged, r)
+		}
+	}
+
+	return
+}
+
+// Encodes textual value according to option's type
+func OptionEncode(d *OptionDef, Value string) (b []byte, err error) {
+	Value = strings.TrimSpace(Value)
+
+	switch d.Type {
+	case OPT_TYPE_IP:
+		if b = net.ParseIP(Value).To4(); b == nil {
+			err = fmt.Errorf("Unable to parse '%s' as IP address", Value)
+		}
+
+	case OPT_TYPE_IPS:
+		for _, v := range OptionSplitList(Value) {
+			ip := net.ParseIP(v).To4()
+			if ip == nil {
+				return nil, fmt.Errorf("Unable to parse '%s' as IP address", v)
+			}
+
+			b = append(b, ip...)
+		}
+
+	case OPT_TYPE_UINT8, OPT_TYPE_UINT16, OPT_TYPE_UINT32:
+		Size := map[int]int{OPT_TYPE_UINT8: 1, OPT_TYPE_UINT16: 2, OPT_TYPE_UINT32: 4}[d.Type]
+
+		var v uint64
+		if v, err = strconv.ParseUint(Value, 10, Size*8); err != nil {
+			return nil, fmt.Errorf("Unable to parse '%s' as %d-bit unsigned integer", Value, Size*8)
+		}
+
+		b = make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(v))
+		b = b[4-Size:]
+
+	case OPT_TYPE_INT32:
+		var v int64
+		if v, err = strconv.ParseInt(Value, 10, 32); err != nil {
+			return nil, fmt.Errorf("Unable to parse '%s' as 32-bit integer", Value)
+		}
+
+		b = make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(int32(v)))
+
+	case OPT_TYPE_STRING:
+		if Value == "" {
+			err = fmt.Errorf("Empty string")
+		}
+
+		b = []byte(Value)
+
+	case OPT_TYPE_BOOL:
+		var v bool
+		if v, err = strconv.ParseBool(Value); err != nil {
+			return nil, fmt.Errorf("Unable to parse '%s' as boolean", Value)
+		}
+
+		if b = []byte{0}; v {
+			b[0] = 1
+		}
+
+	case OPT_TYPE_HEX:
+		if b, err = hex.DecodeString(strings.NewReplacer(":", "", " ", "", "0x", "").Replace(Value)); err != nil {
+			return nil, fmt.Errorf("Unable to parse '%s' as hex string", Value)
+		}
+
+	case OPT_TYPE_ROUTES:
+		// Classful routes (option 33): 'destination router' pairs
+		for _, v := range OptionSplitList(Value) {
+			t := strings.Fields(v)
+			if len(t) != 2 {
+				return nil, fmt.Errorf("Route '%s' should be 'destination router'", v)
+			}
+
+			Dst, Router := net.ParseIP(t[0]).To4(), net.ParseIP(t[1]).To4()
+			if Dst == nil || Router == nil {
+				return nil, fmt.Errorf("Unable to parse route '%s'", v)
+			}
+
+			b = append(b, Dst...)
+			b = append(b, Router...)
+		}
+
+	case OPT_TYPE_CLASSLESS_ROUTES:
+		// 'destination/bits router' pairs
+		for _, v := range OptionSplitList(Value) {
+			var r ClasslessRoute
+			if r, err = ParseClasslessRoute(v); err != nil {
+				return nil, err
+			}
+
+			b = append(b, r.Encode()...)
+		}
+
+	case OPT_TYPE_DOMAINS:
+		// RFC 1035 encoding without compression (RFC 3397)
+		for _, v := range OptionSplitList(Value) {
+			for _, Label := range strings.Split(strings.TrimSuffix(v, "."), ".") {
+				if len(Label) == 0 || len(Label) > 63 {
+					return nil, fmt.Errorf("Wrong domain name '%s'", v)
+				}
+
+				b = append(b, byte(len(Label)))
+				b = append(b, Label...)
+			}
+
+			b = append(b, 0)
+		}
+	}
+
+	if err != nil {
+		return
+	}
+
+	if len(b) == 0 {
+		return nil, fmt.Errorf("Empty value")
+	}
+
+	return
+}
+
+// Parses option from MySQL row and adds it to the list, merging values of list options
+func OptionAdd(Options []dhcp.Option, Name, Value string) ([]dhcp.Option, error) {
+	d, err := OptionLookup(Name)
+	if err != nil {
+		return Options, err
+	}
+
+	b, err := OptionEncode(d, Value)
+	if err != nil {
+		return Options, fmt.Errorf("Option '%s': %s", Name, err)
+	}
+
+	for i := range Options {
+		if Options[i].Code != d.Code {
+			continue
+		}
+
+		if !d.List() {
+			return Options, fmt.Errorf("Option '%s' is defined more than once", Name)
+		}
+
+		b = append(append([]byte{}, Options[i].Value...), b...)
+		if len(b) > 255 {
+			return Options, fmt.Errorf("Option '%s' is longer than 255 bytes", Name)
+		}
+
+		Options[i].Value = b
+		return Options, nil
+	}
+
+	if len(b) > 255 {
+		return Options, fmt.Errorf("Option '%s' is longer than 255 bytes", Name)
+	}
+
+	return append(Options, dhcp.Option{
+		Code:  d.Code,
+		Value: b,
+	}), nil
+}
+
+// Classless static route (RFC 3442)
+type ClasslessRoute struct {
+	Dst    uint32
+	Bits   int
+	Router uint32
+}
+
+func ParseClasslessRoute(Value string) (r ClasslessRoute, err error) {
+	var Dst *net.IPNet
+
+	t := strings.Fields(Value)
+	if len(t) != 2 {
+		return r, fmt.Errorf("Route '%s' should be 'destination/bits router'", Value)
+	}
+
+	if _, Dst, err = net.ParseCIDR(t[0]); err != nil || Dst.IP.To4() == nil {
+		return r, fmt.Errorf("Unable to parse route destination '%s'", t[0])
+	}
+
+	Router := net.ParseIP(t[1]).To4()
+	if Router == nil {
+		return r, fmt.Errorf("Unable to parse route gateway '%s'", t[1])
+	}
+
+	r.Dst = binary.BigEndian.Uint32(Dst.IP.To4())
+	r.Bits, _ = Dst.Mask.Size()
+	r.Router = binary.BigEndian.Uint32(Router)
+	return
+}
+
+// Destination is encoded with only significant octets: width, ceil(width/8) octets, router
+func (r ClasslessRoute) Encode() (b []byte) {
+	Dst := make([]byte, 4)
+	binary.BigEndian.PutUint32(Dst, r.Dst)
+
+	b = append(b, byte(r.Bits))
+	b = append(b, Dst[:(r.Bits+7)/8]...)
+	b = append(b, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(b[len(b)-4:], r.Router)
+	return
+}
+
+func ClasslessRoutesEncode(Routes []ClasslessRoute) (b []byte) {
+	for _, r := range Routes {
+		b = append(b, r.Encode()...)
+	}
+
+	return
+}
+
+func ClasslessRoutesHaveDefault(b []byte) bool {
+	for len(b) > 0 {
+		if b[0] == 0 {
+			return true
+		}
+
+		if n := 1 + (int(b[0])+7)/8 + 4; len(b) >= n {
+			b = b[n:]
+		} else {
+			break
+		}
+	}
+
+	return false
+}
+
+// Returns encoded routes without default ones
+func ClasslessRoutesWithoutDefault(b []byte) (Routes []byte) {
+	for len(b) > 0 {
+		n := 1 + (int(b[0])+7)/8 + 4
+		if len(b) < n {
+			break
+		}
+
+		if b[0] != 0 {
+			Routes = append(Routes, b[:n]...)
+		}
+		b = b[n:]
+	}
+
+	return
+}
+
+// Clients that support option 121 ignore Router option (RFC 3442), so the default route
+// via Router is added to it if missing. Routes are mirrored to option 249 for older Windows clients
+func OptionsClasslessRoutes(Options []dhcp.Option, Router uint32) ([]dhcp.Option, error) {
+	Idx, Mirrored := -1, false
+
+	for i, Opt := range Options {
+		switch Opt.Code {
+		case dhcp.OptionClasslessRouteFormat:
+			Idx = i
+		case OptionMSClasslessRouteFormat:
+			Mirrored = true
+		}
+	}
+
+	if Idx < 0 {
+		return Options, nil
+	}
+
+	if Router > 0 && !ClasslessRoutesHaveDefault(Options[Idx].Value) {
+		Options[Idx].Value = append(append([]byte{}, Options[Idx].Value...), ClasslessRoute{Router: Router}.Encode()...)
+
+		if len(Options[Idx].Value) > 255 {
+			return Options, fmt.Errorf("Option 'classless_routes' with default route is longer than 255 bytes")
+		}
+	}
+
+	if !Mirrored {
+		Options = append(Options, dhcp.Option{
+			Code:  OptionMSClasslessRouteFormat,
+			Value: Options[Idx].Value,
+		})
+	}
+
+	return Options, nil
+}
+
+// Reservation which overrides the router inherits subnet's classless routes unless it has its own,
+// default route of them goes via reservation's router
+func OptionsReservationRoutes(Options, SubnetOptions []dhcp.Option, Router, SubnetRouter uint32) ([]dhcp.Option, error) {
+	if Router > 0 && Router != SubnetRouter && OptionFind(Options, dhcp.OptionClasslessRouteFormat) == nil {
+		if Routes := OptionFind(SubnetOptions, dhcp.OptionClasslessRouteFormat); Routes != nil {
+			Options = append(Options, dhcp.Option{
+				Code:  dhcp.OptionClasslessRouteFormat,
+				Value: ClasslessRoutesWithoutDefault(Routes.Value),
+			})
+		}
+	}
+
+	return OptionsClasslessRoutes(Options, Router)
+}
+
+// Returns option with the given code or nil if there's none
+func OptionFind(Options []dhcp.Option, Code dhcp.OptionCode) *dhcp.Option {
+	for i := range Options {
+		if Options[i].Code == Code {
+			return &Options[i]
+		}
+	}
+
+	return nil
+}
+
+// Merges option lists, options of earlier lists override ones with the same code in later lists
+func OptionsOverride(Lists ...[]dhcp.Option) (Options []dhcp.Option) {
+	Overridden := map[dhcp.OptionCode]bool{}
+
+	for _, List := range Lists {
+		for _, Opt := range List {
+			if !Overridden[Opt.Code] {
+				Options = append(Options, Opt)
+			}
+		}
+
+		for _, Opt := range List {
+			Overridden[Opt.Code] = true
+		}
+	}
+
+	return
+}
+
+func OptionSplitList(Value string) (t []string) {
+	for _, v := range strings.Split(Value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			t = append(t, v)
+		}
+	}
+
+	return
+}
+
+// Human-readable list of options for config dumps
+func OptionsString(Options []dhcp.Option) string {
+	var t []string
+
+	for _, Opt := range Options {
+		Name := strconv.Itoa(int(Opt.Code))
+		if d, ok := OptionDefsByCode[Opt.Code]; ok {
+			Name = d.Name
+		}
+
+		t = append(t, fmt.Sprintf("%s=%s", Name, OptionValueString(Opt)))
+	}
+
+	sort.Strings(t)
+	return strings.Join(t, ", ")
+}
+
+func OptionValueString(Opt dhcp.Option) string {
+	d, ok := OptionDefsByCode[Opt.Code]
+	if !ok {
+		return hex.EncodeToString(Opt.Value)
+	}
+
+	switch d.Type {
+	case OPT_TYPE_IP, OPT_TYPE_IPS:
+		var t []string
+		for i := 0; i+4 <= len(Opt.Value); i += 4 {
+			t = append(t, net.IP(Opt.Value[i:i+4]).String())
+		}
+
+		return strings.Join(t, ",")
+
+	case OPT_TYPE_UINT8, OPT_TYPE_UINT16, OPT_TYPE_UINT32, OPT_TYPE_BOOL:
+		var v uint64
+		for _, b := range Opt.Value {
+			v = v<<8 | uint64(b)
+		}
+
+		return strconv.FormatUint(v, 10)
+
+	case OPT_TYPE_STRING:
+		return strconv.Quote(string(Opt.Value))
+
+	case OPT_TYPE_CLASSLESS_ROUTES:
+		var t []string
+		for b := Opt.Value; len(b) > 0 && len(b) >= 1+(int(b[0])+7)/8+4; {
+			n := (int(b[0]) + 7) / 8
+			Dst := make(net.IP, 4)
+			copy(Dst, b[1:1+n])
+
+			t = append(t, fmt.Sprintf("%s/%d %s", Dst, b[0], net.IP(b[1+n:5+n])))
+			b = b[5+n:]
+		}
+
+		return strings.Join(t, ";")
+	}
+
+	return hex.EncodeToString(Opt.Value)
+}
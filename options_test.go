@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	aux "mt-aux"
+	"mt-aux/dhcp"
+	"strings"
+	"testing"
+)
+
+func TestOptionLookup(t *testing.T) {
+	for _, tt := range []struct {
+		Name  string
+		Code  int
+		Error bool
+	}{
+		{"dns", 6, false},
+		{"6", 6, false},
+		{"200", 200, false},
+		{"1", 0, true},
+		{"subnet_mask", 0, true},
+		{"53", 0, true},
+		{"82", 0, true},
+		{"0", 0, true},
+		{"255", 0, true},
+		{"256", 0, true},
+		{"unknown", 0, true},
+	} {
+		d, err := OptionLookup(tt.Name)
+		if (err != nil) != tt.Error {
+			t.Errorf("%s: error %v, expected error %t", tt.Name, err, tt.Error)
+			continue
+		}
+
+		if !tt.Error && int(d.Code) != tt.Code {
+			t.Errorf("%s: code %d, expected %d", tt.Name, d.Code, tt.Code)
+		}
+	}
+
+	// Every registry option can be configured
+	for _, d := range OptionDefs {
+		if _, err := OptionLookup(d.Name); err != nil {
+			t.Errorf("Registry option '%s' (%d): %s", d.Name, d.Code, err)
+		}
+	}
+}
+
+func TestOptionRowsMerge(t *testing.T) {
+	Rows := []OptionRow{
+		{"15", "common.example", false},
+		{"42", "10.0.0.1", false},
+		{"42", "10.0.0.2", false},
+		{"6", "10.0.0.53", false},
+		{"dns", "10.1.0.53", true},
+		{"dns", "10.1.0.54", true},
+		{"domain_name", "subnet.example", true},
+		{"lease_ttl", "1h", false},
+		{"ntp_servers", "10.1.0.123", false},
+		{"router", "10.1.0.1", true},
+	}
+
+	Expected := []OptionRow{
+		{"42", "10.0.0.1", false},
+		{"42", "10.0.0.2", false},
+		{"dns", "10.1.0.53", true},
+		{"dns", "10.1.0.54", true},
+		{"domain_name", "subnet.example", true},
+		{"lease_ttl", "1h", false},
+		{"ntp_servers", "10.1.0.123", false},
+		{"router", "10.1.0.1", true},
+	}
+
+	if m := OptionRowsMerge(Rows); fmt.Sprint(m) != fmt.Sprint(Expected) {
+		t.Fatalf("Merged:\n%v\nexpected:\n%v", m, Expected)
+	}
+}
+
+func TestOptionsReservationRoutes(t *testing.T) {
+	var (
+		SubnetRouter = aux.IPStrToInt("10.0.0.1")
+		Router       = aux.IPStrToInt("10.0.0.2")
+		Route        = ClasslessRoute{Dst: aux.IPStrToInt("192.168.0.0"), Bits: 16, Router: aux.IPStrToInt("10.0.0.3")}
+		Own          = ClasslessRoute{Dst: aux.IPStrToInt("172.16.0.0"), Bits: 12, Router: aux.IPStrToInt("10.0.0.4")}
+	)
+
+	SubnetOptions, _ := OptionsClasslessRoutes([]dhcp.Option{
+		{Code: dhcp.OptionRouter, Value: aux.IPIntToNet(SubnetRouter).To4()},
+		{Code: dhcp.OptionClasslessRouteFormat, Value: Route.Encode()},
+	}, SubnetRouter)
+
+	for _, tt := range []struct {
+		Name    string
+		Options []dhcp.Option
+		Router  uint32
+		Routes  []ClasslessRoute
+	}{
+		{"same_router", nil, SubnetRouter, nil},
+		{"own_router", nil, Router, []ClasslessRoute{Route, {Router: Router}}},
+		{"own_routes", []dhcp.Option{{Code: dhcp.OptionClasslessRouteFormat, Value: Own.Encode()}}, Router, []ClasslessRoute{Own, {Router: Router}}},
+	} {
+		t.Run(tt.Name, func(t *testing.T) {
+			Options, err := OptionsReservationRoutes(tt.Options, SubnetOptions, tt.Router, SubnetRouter)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			Routes := OptionFind(Options, dhcp.OptionClasslessRouteFormat)
+			if tt.Routes == nil {
+				if Routes != nil {
+					t.Fatalf("Reservation has its own routes %x", Routes.Value)
+				}
+				return
+			}
+
+			if Routes == nil || !bytes.Equal(Routes.Value, ClasslessRoutesEncode(tt.Routes)) {
+				t.Fatalf("Routes %v, expected %x", Routes, ClasslessRoutesEncode(tt.Routes))
+			}
+
+			if MS := OptionFind(Options, OptionMSClasslessRouteFormat); MS == nil || !bytes.Equal(MS.Value, Routes.Value) {
+				t.Fatalf("Routes aren't mirrored to option 249")
+			}
+		})
+	}
+}
+
+func TestClasslessRoutesWithoutDefault(t *testing.T) {
+	Route := ClasslessRoute{Dst: aux.IPStrToInt("10.1.0.0"), Bits: 24, Router: 1}
+	b := ClasslessRoutesEncode([]ClasslessRoute{{Router: 2}, Route, {Router: 3}})
+
+	if r := ClasslessRoutesWithoutDefault(b); !bytes.Equal(r, Route.Encode()) {
+		t.Fatalf("Routes %x, expected %x", r, Route.Encode())
+	}
+
+	// Truncated route is dropped
+	if r := ClasslessRoutesWithoutDefault(append(Route.Encode(), 24, 10)); !bytes.Equal(r, Route.Encode()) {
+		t.Fatalf("Routes %x, expected %x", r, Route.Encode())
+	}
+}
+
+func TestParseClasslessRouteErrors(t *testing.T) {
+	for _, v := range []string{"10.0.0.0/8", "10.0.0.0/33 10.0.0.1", "10.0.0.0/8 gw", "::/0 10.0.0.1"} {
+		if _, err := ParseClasslessRoute(v); err == nil {
+			t.Errorf("'%s' parsed without error", v)
+		}
+	}
+
+	// Option errors name the option, the caller adds subnet or reservation
+	if _, err := OptionAdd(nil, "classless_routes", "10.0.0.0/8 gw"); err == nil || !strings.Contains(err.Error(), "'classless_routes'") {
+		t.Errorf("Error without option name: %v", err)
+	}
+}
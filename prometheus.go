@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+const PROMETHEUS_PREFIX = "mtdhcpd_"
+
+var prometheusEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Gauges with segment & subnet labels
+var prometheusGauges = []struct {
+	Name string
+	Help string
+}{
+	{"segment_subnets", "Number of subnets in segment"},
+	{"segment_capacity", "Number of addresses in segment's pools"},
+	{"segment_leases_active", "Active leases in segment"},
+	{"segment_leases_expired", "Expired leases kept for reuse in segment"},
+	{"subnet_capacity", "Number of addresses in subnet's pool"},
+	{"subnet_leases_active", "Active leases in subnet"},
+	{"subnet_leases_expired", "Expired leases kept for reuse in subnet"},
+	{"subnet_util_level", "Utilization alert level of subnet: 0 - ok, 1 - warning, 2 - critical"},
+	{"subnet_no_free_timestamp_seconds", "Last time subnet had no free addresses"},
+}
+
+// Formats label pairs ("name", "value", ...) for Prometheus text format
+func PrometheusLabels(Pairs ...string) string {
+	var t []string
+	for i := 0; i+1 < len(Pairs); i += 2 {
+		t = append(t, Pairs[i]+`="`+prometheusEscaper.Replace(Pairs[i+1])+`"`)
+	}
+
+	return strings.Join(t, ",")
+}
+
+func PrometheusHeader(w io.Writer, Name, Type, Help string) {
+	fmt.Fprintf(w, "# HELP %s%s %s\n# TYPE %s%s %s\n", PROMETHEUS_PREFIX, Name, Help, PROMETHEUS_PREFIX, Name, Type)
+}
+
+func PrometheusValue(w io.Writer, Name, Labels string, Value interface{}) {
+	if Labels != "" {
+		Labels = "{" + Labels + "}"
+	}
+
+	fmt.Fprintf(w, "%s%s%s %v\n", PROMETHEUS_PREFIX, Name, Labels, Value)
+}
+
+// Writes stats counters keyed by their descriptions, sorted to keep output stable
+func PrometheusStats(w io.Writer, Name string, Stats map[string]uint64, Labels ...string) {
+	var Keys []string
+	for k := range Stats {
+		Keys = append(Keys, k)
+	}
+	sort.Strings(Keys)
+
+	for _, k := range Keys {
+		PrometheusValue(w, Name, PrometheusLabels(append(Labels, "stat", k)...), Stats[k])
+	}
+}
+
+// Chooses subnets which get their own series. Static subnets go first, then dynamic ones ordered
+// by segment id & network, so subnets created by automode in one segment don't replace others' series
+func PrometheusSubnetsSelect(Segments []*Segment, Limit int) (Selected map[*Subnet]bool) {
+	type SegNet struct {
+		Seg *Segment
+		Net *Subnet
+	}
+
+	var All []SegNet
+	for _, Seg := range Segments {
+		Seg.RLock()
+		for _, Net := range Seg.Subnets {
+			All = append(All, SegNet{Seg, Net})
+		}
+		Seg.RUnlock()
+	}
+
+	sort.Slice(All, func(i, j int) bool {
+		a, b := All[i], All[j]
+		if a.Net.Dynamic != b.Net.Dynamic {
+			return !a.Net.Dynamic
+		}
+
+		if a.Seg.Id != b.Seg.Id {
+			return a.Seg.Id < b.Seg.Id
+		}
+
+		return a.Net.Net < b.Net.Net
+	})
+
+	Selected = map[*Subnet]bool{}
+	for i := 0; i < len(All) && i < Limit; i++ {
+		Selected[All[i].Net] = true
+	}
+
+	return
+}
+
+// Renders all the counters & gauges. Number of subnets with their own series is limited
+// by metrics.prometheus_subnet_limit as automode can create thousands of them
+func PrometheusDump() string {
+	var (
+		b       bytes.Buffer
+		Omitted int
+	)
+
+	TimeStart := time.Now()
+
+	PrometheusHeader(&b, "stats_total", "counter", "Global request processing counters")
+	PrometheusStats(&b, "stats_total", Stats.DumpMap())
+
+	PrometheusHeader(&b, "request_duration_seconds", "histogram", "Request processing time")
+	HistogramRequests.WritePrometheus(&b, PROMETHEUS_PREFIX+"request_duration_seconds", "")
+
+	PrometheusHeader(&b, "request_type_duration_seconds", "histogram", "Request processing time by request type")
+	for _, t := range HistogramRequestTypes {
+		HistogramsRequestType[t].WritePrometheus(&b, PROMETHEUS_PREFIX+"request_type_duration_seconds", PrometheusLabels("type", t.String()))
+	}
+
+	PrometheusHeader(&b, "response_duration_seconds", "histogram", "Request processing time by reply type")
+	for _, t := range HistogramResponses {
+		HistogramsResponse[t].WritePrometheus(&b, PROMETHEUS_PREFIX+"response_duration_seconds", PrometheusLabels("response", t.String()))
+	}
+
+	PrometheusHeader(&b, "transaction_duration_seconds", "histogram", "Time between DISCOVER and REQUEST acknowledged")
+	HistogramTransactions.WritePrometheus(&b, PROMETHEUS_PREFIX+"transaction_duration_seconds", "")
+
+	PrometheusHeader(&b, "cleanup_duration_seconds", "histogram", "Expired leases cleanup time per subnet")
+	HistogramCleanup.WritePrometheus(&b, PROMETHEUS_PREFIX+"cleanup_duration_seconds", "")
+
+	var Segments, Subnets, Latency bytes.Buffer
+	Gauges := map[string]*bytes.Buffer{}
+	for _, v := range prometheusGauges {
+		Gauges[v.Name] = &bytes.Buffer{}
+	}
+
+	CacheReloadingMtx.RLock()
+	Selected := PrometheusSubnetsSelect(o.SegmentsOrdered, o.MetricsPrometheusSubnetLimit)
+
+	for _, Seg := range o.SegmentsOrdered {
+		var (
+			Capacity, Active, Expired int
+			Nets                      []*Subnet
+		)
+
+		Seg.RLock()
+		for _, Net := range Seg.Subnets {
+			Nets = append(Nets, Net)
+		}
+		Seg.RUnlock()
+
+		sort.Slice(Nets, func(i, j int) bool {
+			if Nets[i].Dynamic != Nets[j].Dynamic {
+				return !Nets[i].Dynamic
+			}
+
+			return Nets[i].Net < Nets[j].Net
+		})
+
+		for _, Net := range Nets {
+			Capacity += Net.Capacity()
+			Active += Net.LeasesActive()
+			Expired += Net.LeasesExpired()
+
+			if !Selected[Net] {
+				Omitted++
+				continue
+			}
+
+			l := PrometheusLabels("segment", Seg.Name, "subnet", Net.NetStr)
+			PrometheusStats(&Subnets, "subnet_stats_total", Net.Stats.DumpMap(), "segment", Seg.Name, "subnet", Net.NetStr)
+			PrometheusValue(Gauges["subnet_capacity"], "subnet_capacity", l, Net.Capacity())
+			PrometheusValue(Gauges["subnet_leases_active"], "subnet_leases_active", l, Net.LeasesActive())
+			PrometheusValue(Gauges["subnet_leases_expired"], "subnet_leases_expired", l, Net.LeasesExpired())
+			PrometheusValue(Gauges["subnet_util_level"], "subnet_util_level", l, int(Net.Alert()))
+
+			if t := Net.NoFreeGet(); !t.IsZero() {
+				PrometheusValue(Gauges["subnet_no_free_timestamp_seconds"], "subnet_no_free_timestamp_seconds", l, t.Unix())
+			}
+		}
+
+		l := PrometheusLabels("segment", Seg.Name)
+		Seg.Latency.WritePrometheus(&Latency, PROMETHEUS_PREFIX+"segment_request_duration_seconds", l)
+		PrometheusStats(&Segments, "segment_stats_total", Seg.Stats.DumpMap(), "segment", Seg.Name)
+		PrometheusValue(Gauges["segment_subnets"], "segment_subnets", l, len(Nets))
+		PrometheusValue(Gauges["segment_capacity"], "segment_capacity", l, Capacity)
+		PrometheusValue(Gauges["segment_leases_active"], "segment_leases_active", l, Active)
+		PrometheusValue(Gauges["segment_leases_expired"], "segment_leases_expired", l, Expired)
+	}
+	CacheReloadingMtx.RUnlock()
+
+	PrometheusHeader(&b, "segment_stats_total", "counter", "Request processing counters per segment")
+	b.Write(Segments.Bytes())
+
+	PrometheusHeader(&b, "subnet_stats_total", "counter", "Request processing counters per subnet")
+	b.Write(Subnets.Bytes())
+
+	PrometheusHeader(&b, "segment_request_duration_seconds", "histogram", "Request processing time per segment")
+	b.Write(Latency.Bytes())
+
+	for _, v := range prometheusGauges {
+		PrometheusHeader(&b, v.Name, "gauge", v.Help)
+		b.Write(Gauges[v.Name].Bytes())
+	}
+
+	PrometheusHeader(&b, "subnets_omitted", "gauge", "Subnets without own series due to metrics.prometheus_subnet_limit")
+	PrometheusValue(&b, "subnets_omitted", "", Omitted)
+
+	PrometheusHeader(&b, "queue_length", "gauge", "Requests waiting for a worker")
+	PrometheusValue(&b, "queue_length", "", len(DHCPQueue))
+
+	PrometheusHeader(&b, "queue_capacity", "gauge", "Request queue size")
+	PrometheusValue(&b, "queue_capacity", "", cap(DHCPQueue))
+
+	PrometheusHeader(&b, "memory_bytes", "gauge", "Memory obtained from OS")
+	PrometheusValue(&b, "memory_bytes", "", MemoryUsage)
+
+	PrometheusHeader(&b, "goroutines", "gauge", "Number of goroutines")
+	PrometheusValue(&b, "goroutines", "", runtime.NumGoroutine())
+
+	PrometheusHeader(&b, "uptime_seconds", "gauge", "Process uptime")
+	PrometheusValue(&b, "uptime_seconds", "", int(time.Since(ProcessStartTime).Seconds()))
+
+	PrometheusHeader(&b, "scrape_duration_seconds", "gauge", "Time spent generating these metrics")
+	PrometheusValue(&b, "scrape_duration_seconds", "", time.Since(TimeStart).Seconds())
+
+	return b.String()
+}
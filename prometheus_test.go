@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	aux "mt-aux"
+	"strings"
+	"testing"
+)
+
+// Segment with static subnets and dynamic ones created by automode
+func NewTestPrometheusSegment(Id, Priority int, Name string, Static, Dynamic int) *Segment {
+	Seg := &Segment{Id: Id, Name: Name, Priority: Priority, Subnets: map[uint32]*Subnet{}}
+	Seg.StatsInit()
+
+	for i := 0; i < Static+Dynamic; i++ {
+		NetAddr := fmt.Sprintf("10.%d.%d.0", Id, i)
+		Net := &Subnet{
+			Net:         aux.IPStrToInt(NetAddr),
+			NetStr:      NetAddr + "/24",
+			Mask:        aux.IPStrToInt("255.255.255.0"),
+			RangeStart:  aux.IPStrToInt(NetAddr) + 10,
+			RangeEnd:    aux.IPStrToInt(NetAddr) + 250,
+			Dynamic:     i >= Static,
+			LeasesByIP:  map[uint32]*Lease{},
+			LeasesByMAC: map[uint64]*Lease{},
+		}
+		Net.StatsInit()
+		Net.PoolInit()
+
+		Seg.Subnets[Net.Net] = Net
+	}
+
+	o.Segments[Seg.Id] = Seg
+	return Seg
+}
+
+func TestPrometheusSubnetsSelect(t *testing.T) {
+	InitTestOpts()
+
+	// Dynamic subnets of the first evaluated segment don't push out static ones of the other
+	Auto := NewTestPrometheusSegment(1, 10, "auto", 1, 5)
+	Static := NewTestPrometheusSegment(2, 0, "static", 2, 0)
+	o.SegmentsOrdered = SegmentsOrder(o.Segments)
+
+	Selected := PrometheusSubnetsSelect(o.SegmentsOrdered, 4)
+	if len(Selected) != 4 {
+		t.Fatalf("%d subnets selected, expected 4", len(Selected))
+	}
+
+	for _, Net := range append(PrometheusTestSubnets(Static), PrometheusTestSubnets(Auto)...) {
+		if !Net.Dynamic && !Selected[Net] {
+			t.Fatalf("Static subnet %s wasn't selected", Net.NetStr)
+		}
+	}
+
+	// The same dynamic subnet stays selected as more of them are created
+	First := Auto.Subnets[aux.IPStrToInt("10.1.1.0")]
+
+	NewNet := &Subnet{Net: aux.IPStrToInt("10.1.200.0"), NetStr: "10.1.200.0/24", Dynamic: true}
+	Auto.Subnets[NewNet.Net] = NewNet
+
+	if Selected = PrometheusSubnetsSelect(o.SegmentsOrdered, 4); !Selected[First] || Selected[NewNet] {
+		t.Fatalf("Selection changed after new dynamic subnet was created")
+	}
+}
+
+func PrometheusTestSubnets(Seg *Segment) (Nets []*Subnet) {
+	for _, Net := range Seg.Subnets {
+		Nets = append(Nets, Net)
+	}
+
+	return
+}
+
+func TestPrometheusDump(t *testing.T) {
+	InitTestOpts()
+	o.MetricsPrometheusSubnetLimit = 2
+	defer func() { o.MetricsPrometheusSubnetLimit = 0 }()
+
+	NewTestPrometheusSegment(1, 0, `a"b\c`+"\nd", 1, 2)
+	NewTestPrometheusSegment(2, 0, "plain", 1, 0)
+	o.SegmentsOrdered = SegmentsOrder(o.Segments)
+
+	Dump := PrometheusDump()
+
+	var (
+		Help  = map[string]int{}
+		Type  = map[string]string{}
+		Lines = strings.Split(strings.TrimSuffix(Dump, "\n"), "\n")
+	)
+
+	for _, Line := range Lines {
+		f := strings.Fields(Line)
+
+		switch {
+		case strings.HasPrefix(Line, "# HELP "):
+			Help[f[2]]++
+
+		case strings.HasPrefix(Line, "# TYPE "):
+			if _, ok := Type[f[2]]; ok {
+				t.Errorf("Second TYPE of %s", f[2])
+			}
+			Type[f[2]] = f[3]
+
+		default:
+			Name := Line[:strings.IndexAny(Line, "{ ")]
+			if Type[Name] == "" {
+				for _, Suffix := range []string{"_bucket", "_sum", "_count"} {
+					if Base := strings.TrimSuffix(Name, Suffix); Base != Name && Type[Base] == "histogram" {
+						Name = Base
+					}
+				}
+			}
+
+			if Type[Name] == "" {
+				t.Errorf("Sample of %s before its TYPE", Name)
+			}
+		}
+	}
+
+	for Name, n := range Help {
+		if n != 1 {
+			t.Errorf("%d HELP lines of %s", n, Name)
+		}
+	}
+
+	if len(Help) != len(Type) {
+		t.Errorf("%d HELP and %d TYPE lines", len(Help), len(Type))
+	}
+
+	// Quotes, backslashes and newlines are escaped, so every sample stays on one line
+	if !strings.Contains(Dump, `mtdhcpd_segment_subnets{segment="a\"b\\c\nd"} 3`) {
+		t.Errorf("Segment label isn't escaped:\n%s", Dump)
+	}
+
+	// Static subnets of both segments are selected, dynamic ones are omitted
+	for _, Expected := range []string{
+		`mtdhcpd_subnet_capacity{segment="a\"b\\c\nd",subnet="10.1.0.0/24"} 241`,
+		`mtdhcpd_subnet_capacity{segment="plain",subnet="10.2.0.0/24"} 241`,
+		"mtdhcpd_subnets_omitted 2",
+	} {
+		if !strings.Contains(Dump, Expected+"\n") {
+			t.Errorf("No '%s' in dump", Expected)
+		}
+	}
+}
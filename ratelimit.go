@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	aux "mt-aux"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	RATELIMIT_SHARDS = 64
+
+	// Buckets which dropped requests are kept at least that long to be reported as throttled
+	RATELIMIT_REPORT_PERIOD = time.Hour
+)
+
+// Token bucket parameters: Rate requests per second on average with bursts up to Burst.
+// Zero rate disables limiting
+type RateLimit struct {
+	Rate  float64
+	Burst float64
+}
+
+func (l RateLimit) Enabled() bool {
+	return l.Rate > 0
+}
+
+func (l RateLimit) String() string {
+	if !l.Enabled() {
+		return "disabled"
+	}
+
+	return fmt.Sprintf("%g/sec (burst %g)", l.Rate, l.Burst)
+}
+
+type RateLimits struct {
+	MAC     RateLimit
+	RelayIP RateLimit
+}
+
+// Reads rate_limit section, missing values are taken from Defaults
+func RateLimitsLoad(v *viper.Viper, Defaults RateLimits) (l RateLimits, err error) {
+	l = Defaults
+	if v == nil {
+		return
+	}
+
+	if v.IsSet("mac_rate") {
+		l.MAC.Rate = v.GetFloat64("mac_rate")
+	}
+
+	if v.IsSet("mac_burst") {
+		l.MAC.Burst = v.GetFloat64("mac_burst")
+	}
+
+	if v.IsSet("relay_rate") {
+		l.RelayIP.Rate = v.GetFloat64("relay_rate")
+	}
+
+	if v.IsSet("relay_burst") {
+		l.RelayIP.Burst = v.GetFloat64("relay_burst")
+	}
+
+	for _, r := range []RateLimit{l.MAC, l.RelayIP} {
+		if r.Rate < 0 {
+			return l, fmt.Errorf("rate_limit: rate should be >= 0")
+		}
+
+		if r.Enabled() && r.Burst < 1 {
+			return l, fmt.Errorf("rate_limit: burst should be >= 1")
+		}
+	}
+
+	return
+}
+
+type RateBucket struct {
+	Limit   RateLimit
+	Tokens  float64
+	Updated time.Time
+
+	Dropped  uint64
+	LastDrop time.Time
+}
+
+type RateLimiterShard struct {
+	Buckets map[uint64]*RateBucket
+	sync.Mutex
+}
+
+// Set of token buckets keyed by MAC or Relay IP
+type RateLimiter struct {
+	Shards [RATELIMIT_SHARDS]*RateLimiterShard
+}
+
+var (
+	RateLimiterMAC     = NewRateLimiter()
+	RateLimiterRelayIP = NewRateLimiter()
+)
+
+func NewRateLimiter() (r *RateLimiter) {
+	r = &RateLimiter{}
+
+	for i := range r.Shards {
+		r.Shards[i] = &RateLimiterShard{
+			Buckets: map[uint64]*RateBucket{},
+		}
+	}
+
+	return
+}
+
+// Takes a token from Key's bucket, returns false if there's none left
+func (r *RateLimiter) Allow(Key uint64, Limit RateLimit, Now time.Time) bool {
+	if !Limit.Enabled() {
+		return true
+	}
+
+	s := r.Shards[Key%RATELIMIT_SHARDS]
+	s.Lock()
+	defer s.Unlock()
+
+	b, ok := s.Buckets[Key]
+	if !ok {
+		b = &RateBucket{
+			Tokens:  Limit.Burst,
+			Updated: Now,
+		}
+
+		s.Buckets[Key] = b
+	}
+
+	// Limits could be changed since the bucket was created
+	b.Limit = Limit
+	if b.Tokens += Now.Sub(b.Updated).Seconds() * Limit.Rate; b.Tokens > Limit.Burst {
+		b.Tokens = Limit.Burst
+	}
+	b.Updated = Now
+
+	if b.Tokens < 1 {
+		b.Dropped++
+		b.LastDrop = Now
+		return false
+	}
+
+	b.Tokens--
+	return true
+}
+
+// Gives back the token taken by Allow, when the request is dropped by another limit
+func (r *RateLimiter) Refund(Key uint64, Limit RateLimit) {
+	if !Limit.Enabled() {
+		return
+	}
+
+	s := r.Shards[Key%RATELIMIT_SHARDS]
+	s.Lock()
+	defer s.Unlock()
+
+	if b, ok := s.Buckets[Key]; ok && b.Tokens+1 <= Limit.Burst {
+		b.Tokens++
+	}
+}
+
+// Removes buckets which are refilled completely, they are the same as absent ones
+// unless they have dropped requests recently
+func (r *RateLimiter) Cleanup(Now time.Time) (Count int) {
+	for _, s := range r.Shards {
+		s.Lock()
+		for k, b := range s.Buckets {
+			if b.Dropped > 0 && Now.Sub(b.LastDrop) < RATELIMIT_REPORT_PERIOD {
+				continue
+			}
+
+			if b.Tokens+Now.Sub(b.Updated).Seconds()*b.Limit.Rate >= b.Limit.Burst {
+				delete(s.Buckets, k)
+				Count++
+			}
+		}
+		s.Unlock()
+	}
+
+	return
+}
+
+type RateThrottled struct {
+	Key      uint64
+	Dropped  uint64
+	LastDrop time.Time
+}
+
+// Returns keys which had requests dropped during the last Period
+func (r *RateLimiter) Throttled(Now time.Time, Period time.Duration) (t []RateThrottled) {
+	for _, s := range r.Shards {
+		s.Lock()
+		for k, b := range s.Buckets {
+			if b.Dropped > 0 && Now.Sub(b.LastDrop) < Period {
+				t = append(t, RateThrottled{
+					Key:      k,
+					Dropped:  b.Dropped,
+					LastDrop: b.LastDrop,
+				})
+			}
+		}
+		s.Unlock()
+	}
+
+	sort.Slice(t, func(i, j int) bool {
+		return t[i].Dropped > t[j].Dropped
+	})
+
+	return
+}
+
+// Checks request against MAC & Relay IP limits of its segment
+func (c *ReqCtx) RateLimitAllow() bool {
+	Now := time.Now()
+
+	if !RateLimiterMAC.Allow(c.MAC, c.Segment.RateLimit.MAC, Now) {
+		c.LogDebugf("MAC rate limit exceeded")
+		return false
+	}
+
+	if !RateLimiterRelayIP.Allow(uint64(c.RelayIP), c.Segment.RateLimit.RelayIP, Now) {
+		// Dropped request doesn't count against client's own limit
+		RateLimiterMAC.Refund(c.MAC, c.Segment.RateLimit.MAC)
+		c.LogDebugf("Relay IP rate limit exceeded")
+		return false
+	}
+
+	return true
+}
+
+func RateLimitWorker(Interval time.Duration) {
+	for {
+		time.Sleep(Interval)
+
+		TimeStart := time.Now()
+		MACs := RateLimiterMAC.Cleanup(TimeStart)
+		Relays := RateLimiterRelayIP.Cleanup(TimeStart)
+
+		if o.LogTickers {
+			log.Warnf("Ticker: RateLimitWorker(): done in %s: %d MAC & %d Relay IP buckets removed", time.Since(TimeStart), MACs, Relays)
+		}
+	}
+}
+
+func RateLimitDumpThrottled(Period time.Duration) string {
+	var b bytes.Buffer
+	w := tabwriter.NewWriter(&b, 0, 0, 3, ' ', 0)
+	Now := time.Now()
+
+	fmt.Fprintf(w, "MACs throttled during the last %s:\n", Period)
+	for _, t := range RateLimiterMAC.Throttled(Now, Period) {
+		fmt.Fprintf(w, " %s\t%d dropped\t(last %s ago)\n", aux.MACIntToStr(t.Key), t.Dropped, Now.Sub(t.LastDrop))
+	}
+
+	fmt.Fprintf(w, "\nRelay IPs throttled during the last %s:\n", Period)
+	for _, t := range RateLimiterRelayIP.Throttled(Now, Period) {
+		fmt.Fprintf(w, " %s\t%d dropped\t(last %s ago)\n", aux.IPIntToStr(uint32(t.Key)), t.Dropped, Now.Sub(t.LastDrop))
+	}
+
+	w.Flush()
+	return b.String()
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"mt-aux/dhcp"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	r := NewRateLimiter()
+	l := RateLimit{Rate: 2, Burst: 3}
+	Now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if !r.Allow(1, l, Now) {
+			t.Fatalf("Request %d within burst was dropped", i)
+		}
+	}
+
+	if r.Allow(1, l, Now) {
+		t.Fatalf("Request over burst was allowed")
+	}
+
+	// Other keys have their own buckets
+	if !r.Allow(2, l, Now) {
+		t.Fatalf("Request of another key was dropped")
+	}
+
+	// 2/sec refills one token in 500ms
+	if !r.Allow(1, l, Now.Add(500*time.Millisecond)) || r.Allow(1, l, Now.Add(500*time.Millisecond)) {
+		t.Fatalf("Bucket wasn't refilled by one token")
+	}
+
+	if !r.Allow(1, RateLimit{}, Now) {
+		t.Fatalf("Disabled limit dropped request")
+	}
+}
+
+func TestRateLimiterCleanup(t *testing.T) {
+	r := NewRateLimiter()
+	l := RateLimit{Rate: 1, Burst: 1}
+	Now := time.Now()
+
+	r.Allow(1, l, Now)
+	r.Allow(2, l, Now)
+	r.Allow(2, l, Now) // Dropped
+
+	// Both buckets are refilled by now
+	if n := r.Cleanup(Now.Add(10 * time.Second)); n != 1 {
+		t.Fatalf("Cleanup removed %d buckets, expected 1", n)
+	}
+
+	if Th := r.Throttled(Now.Add(10*time.Second), time.Minute); len(Th) != 1 || Th[0].Key != 2 || Th[0].Dropped != 1 {
+		t.Fatalf("Throttled bucket wasn't kept: %+v", Th)
+	}
+
+	if n := r.Cleanup(Now.Add(RATELIMIT_REPORT_PERIOD)); n != 1 {
+		t.Fatalf("Throttled bucket wasn't removed after the report period")
+	}
+}
+
+func TestRateLimitAllowRelayDropKeepsMACToken(t *testing.T) {
+	InitTestOpts()
+	RateLimiterMAC, RateLimiterRelayIP = NewRateLimiter(), NewRateLimiter()
+	Seg, Net := NewTestSegment("10.1.0.0", "10.1.0.10", "10.1.0.20")
+	Seg.RateLimit = RateLimits{
+		MAC:     RateLimit{Rate: 0.001, Burst: 1},
+		RelayIP: RateLimit{Rate: 0.001, Burst: 1},
+	}
+
+	c := NewTestCtx(Seg, Net, 0x0a0b0c0d0e01, dhcp.Discover)
+	c.SetRelayIP(0x0a010001)
+
+	// Relay's only token is taken by another client
+	if !RateLimiterRelayIP.Allow(uint64(c.RelayIP), Seg.RateLimit.RelayIP, time.Now()) {
+		t.Fatalf("First relay request was dropped")
+	}
+
+	if c.RateLimitAllow() {
+		t.Fatalf("Request over relay limit was allowed")
+	}
+
+	if !RateLimiterMAC.Allow(c.MAC, Seg.RateLimit.MAC, time.Now()) {
+		t.Fatalf("MAC token was used by request dropped by relay limit")
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Changes applied by configuration reload
+type ConfigDiff struct {
+	SegmentsAdded   []string
+	SegmentsRemoved []string
+	SegmentsChanged []string
+
+	SubnetsAdded     []string
+	SubnetsRemoved   []string
+	SubnetsChanged   []string
+	SubnetsUnchanged int
+
+	LeasesMigrated int
+	LeasesDropped  int
+
+	// Settings which were changed in config file, but are applied only on restart
+	RestartRequired []string
+
+	Duration time.Duration
+}
+
+func (d *ConfigDiff) String() string {
+	var b bytes.Buffer
+	w := tabwriter.NewWriter(&b, 0, 0, 3, ' ', 0)
+
+	fmt.Fprintf(w, "Configuration reloaded in %s:\n", d.Duration)
+	fmt.Fprintf(w, " Segments added:\t%s\n", strings.Join(d.SegmentsAdded, ", "))
+	fmt.Fprintf(w, " Segments removed:\t%s\n", strings.Join(d.SegmentsRemoved, ", "))
+	fmt.Fprintf(w, " Segments changed:\t%s\n", strings.Join(d.SegmentsChanged, ", "))
+	fmt.Fprintf(w, " Subnets added:\t%s\n", strings.Join(d.SubnetsAdded, ", "))
+	fmt.Fprintf(w, " Subnets removed:\t%s\n", strings.Join(d.SubnetsRemoved, ", "))
+	fmt.Fprintf(w, " Subnets changed:\t%s\n", strings.Join(d.SubnetsChanged, ", "))
+	fmt.Fprintf(w, " Subnets unchanged:\t%d\n", d.SubnetsUnchanged)
+	fmt.Fprintf(w, " Leases migrated:\t%d\n", d.LeasesMigrated)
+	fmt.Fprintf(w, " Leases dropped:\t%d\n", d.LeasesDropped)
+	fmt.Fprintf(w, " Restart required for:\t%s\n", strings.Join(d.RestartRequired, ", "))
+	w.Flush()
+
+	return b.String()
+}
+
+// Re-reads config file and subnets from MySQL and applies them without dropping leases:
+// unchanged subnets are kept as is, leases of changed ones are moved into the new subnets
+func ConfigReload() (Diff *ConfigDiff, err error) {
+	var n *Opts
+
+	if CacheReloading.SetToIf(false, true) {
+		err = fmt.Errorf("Cache reload already in progress")
+		log.Errorf("%s", err)
+		return
+	}
+
+	defer CacheReloading.UnSet()
+
+	TimeStart := time.Now()
+	log.Warnf("Starting to reload configuration...")
+
+	// Everything is loaded before taking the lock, requests are served meanwhile
+	if n, err = ConfigLoad(); err != nil {
+		err = fmt.Errorf("Unable to load config file: %s", err)
+		log.Errorf("%s", err)
+		return
+	}
+
+	if err = LoadSegments(n.Segments); err != nil {
+		err = fmt.Errorf("Segments loading error: %s", err)
+		log.Errorf("%s", err)
+		return
+	}
+
+	Diff = &ConfigDiff{}
+
+	CacheReloadingMtx.Lock()
+	defer CacheReloadingMtx.Unlock()
+
+	for _, Seg := range n.SegmentsOrdered {
+		if Old, ok := o.Segments[Seg.Id]; ok {
+			SegmentReload(Old, Seg, Diff)
+		} else {
+			Diff.SegmentsAdded = append(Diff.SegmentsAdded, Seg.Name)
+		}
+	}
+
+	for Id, Seg := range o.Segments {
+		if _, ok := n.Segments[Id]; ok {
+			continue
+		}
+
+		Diff.SegmentsRemoved = append(Diff.SegmentsRemoved, Seg.Name)
+		for _, Subnet := range Seg.Subnets {
+			Diff.LeasesDropped += len(Subnet.LeasesByIP)
+		}
+	}
+
+	for _, v := range []struct {
+		Name     string
+		Old, New interface{}
+	}{
+		{"server_id", o.ServerID, n.ServerID},
+		{"mysql.dsn", o.MySQLDSN, n.MySQLDSN},
+		{"http.listen", o.HTTPListen, n.HTTPListen},
+		{"log.syslog", o.Syslog, n.Syslog},
+		{"metrics.enable", o.MetricsEnabled, n.MetricsEnabled},
+		{"metrics.hosts", o.MetricsHosts, n.MetricsHosts},
+		{"metrics.sinks", o.MetricsSinks, n.MetricsSinks},
+		{"alerts.webhook", []interface{}{o.AlertsWebhook, o.AlertsWebhookTimeout, o.AlertsWebhookRetries},
+			[]interface{}{n.AlertsWebhook, n.AlertsWebhookTimeout, n.AlertsWebhookRetries}},
+		{"events", []interface{}{o.EventsEnabled, o.EventsQueueSize, o.EventsFile, o.EventsWebhook, o.EventsWebhookTimeout, o.EventsWebhookRetries},
+			[]interface{}{n.EventsEnabled, n.EventsQueueSize, n.EventsFile, n.EventsWebhook, n.EventsWebhookTimeout, n.EventsWebhookRetries}},
+		{"dhcp.backend", o.DHCPBackend, n.DHCPBackend},
+		{"dhcp.disk_path", o.DHCPDiskPath, n.DHCPDiskPath},
+		{"dhcp.listen", o.DHCPListen, n.DHCPListen},
+		{"dhcp.listen_interfaces", o.DHCPListenInterfaces, n.DHCPListenInterfaces},
+		{"dhcp.buffer_size", o.DHCPBufferSize, n.DHCPBufferSize},
+		{"dhcp.workers", o.DHCPWorkers, n.DHCPWorkers},
+		{"dhcp.queue_size", o.DHCPQueueSize, n.DHCPQueueSize},
+		{"dhcp.sockets_per_listen", o.DHCPSocketsPerListen, n.DHCPSocketsPerListen},
+		{"dhcp.batch_size", o.DHCPBatchSize, n.DHCPBatchSize},
+		{"dhcp.cleanup_interval", o.DHCPCleanupInterval, n.DHCPCleanupInterval},
+		{"dhcp.stats_interval", o.DHCPStatsInterval, n.DHCPStatsInterval},
+		{"aerospike", []interface{}{o.ASHosts, o.ASNamespace, o.ASSetLeases, o.ASSetSubnets, o.ASScanTimeout},
+			[]interface{}{n.ASHosts, n.ASNamespace, n.ASSetLeases, n.ASSetSubnets, n.ASScanTimeout}},
+	} {
+		if !reflect.DeepEqual(v.Old, v.New) {
+			Diff.RestartRequired = append(Diff.RestartRequired, v.Name)
+		}
+	}
+
+	// Requests are not served while the lock is held, so the options can be swapped in place
+	o.Segments, o.SegmentsOrdered = n.Segments, n.SegmentsOrdered
+	o.Classes = n.Classes
+	o.DHCPReplyToSource = n.DHCPReplyToSource
+	o.DHCPGraceTTL = n.DHCPGraceTTL
+	o.DHCPRandomTries = n.DHCPRandomTries
+	o.DHCPCleanupAge = n.DHCPCleanupAge
+	o.DHCPRateLimit = n.DHCPRateLimit
+	o.DHCPSegmentMatch = n.DHCPSegmentMatch
+	o.MetricsMeasurementRequests = n.MetricsMeasurementRequests
+	o.MetricsMeasurementStats = n.MetricsMeasurementStats
+	o.MetricsMeasurementStatsSegment = n.MetricsMeasurementStatsSegment
+	o.MetricsMeasurementCleanup = n.MetricsMeasurementCleanup
+	o.MetricsMeasurementAlerts = n.MetricsMeasurementAlerts
+	o.AlertsUtil = n.AlertsUtil
+	o.AlertsExhaustedPeriod = n.AlertsExhaustedPeriod
+	o.MetricsPrometheusSubnetLimit = n.MetricsPrometheusSubnetLimit
+	o.LogLevel, o.LogrusLevel = n.LogLevel, n.LogrusLevel
+
+	Diff.Duration = time.Since(TimeStart)
+
+	for _, v := range strings.Split(Diff.String(), "\n") {
+		log.Warnf(v)
+	}
+
+	return
+}
+
+// Moves subnets & leases of the running segment into the newly loaded one
+func SegmentReload(Old, New *Segment, Diff *ConfigDiff) {
+	New.Stats, New.Latency = Old.Stats, Old.Latency
+
+	if !SegmentConfigEqual(Old, New) {
+		Diff.SegmentsChanged = append(Diff.SegmentsChanged, New.Name)
+	}
+
+	for NetAddr, Subnet := range New.Subnets {
+		OldSubnet, ok := Old.Subnets[NetAddr]
+
+		switch {
+		case !ok:
+			Diff.SubnetsAdded = append(Diff.SubnetsAdded, New.Name+": "+Subnet.NetStr)
+
+		case SubnetConfigEqual(OldSubnet, Subnet):
+			New.Subnets[NetAddr] = OldSubnet
+			Diff.SubnetsUnchanged++
+
+		default:
+			Migrated, Dropped := SubnetMigrateLeases(OldSubnet, Subnet)
+			Diff.LeasesMigrated += Migrated
+			Diff.LeasesDropped += Dropped
+			Diff.SubnetsChanged = append(Diff.SubnetsChanged, New.Name+": "+Subnet.NetStr)
+		}
+	}
+
+	for NetAddr, Subnet := range Old.Subnets {
+		if _, ok := New.Subnets[NetAddr]; ok {
+			continue
+		}
+
+		// Automode subnets are regenerated only if their settings were changed, and dropped if the mask was changed
+		if Subnet.Dynamic && New.AutoMode && Old.AutoModeMask == New.AutoModeMask {
+			if SegmentAutoModeEqual(Old, New) {
+				New.Subnets[NetAddr] = Subnet
+				Diff.SubnetsUnchanged++
+				continue
+			}
+
+			New.Subnets[NetAddr] = GenerateAutoSubnet(NetAddr, New)
+			Migrated, Dropped := SubnetMigrateLeases(Subnet, New.Subnets[NetAddr])
+			Diff.LeasesMigrated += Migrated
+			Diff.LeasesDropped += Dropped
+			Diff.SubnetsChanged = append(Diff.SubnetsChanged, New.Name+": "+Subnet.NetStr)
+			continue
+		}
+
+		Diff.LeasesDropped += len(Subnet.LeasesByIP)
+		Diff.SubnetsRemoved = append(Diff.SubnetsRemoved, Old.Name+": "+Subnet.NetStr)
+	}
+}
+
+// Moves leases into the new subnet, leases outside of its pool or conflicting with its reservations are dropped
+func SubnetMigrateLeases(Old, New *Subnet) (Migrated, Dropped int) {
+	New.Stats = Old.Stats
+	New.AlertLevel, New.NoFreeLast = Old.AlertLevel, Old.NoFreeLast
+
+	for IP, Lease := range Old.LeasesByIP {
+		if R, ok := New.ReservationsIP[IP]; (ok && R.MAC != Lease.MAC) || (!ok && !New.AddrAllowed(IP)) {
+			Dropped++
+			continue
+		}
+
+		New.LeasesByIP[IP] = Lease
+		if l, ok := Old.LeasesByMAC[Lease.MAC]; ok && l == Lease {
+			New.LeasesByMAC[Lease.MAC] = Lease
+		}
+
+		// Expired ones are already back in the pool
+		if !Lease.Expired() {
+			New.AddrUse(IP)
+		}
+
+		Migrated++
+	}
+
+	return
+}
+
+func SubnetConfigEqual(a, b *Subnet) bool {
+	return a.Dynamic == b.Dynamic &&
+		a.Mask == b.Mask &&
+		a.Router == b.Router &&
+		a.LeaseTTL == b.LeaseTTL &&
+		a.Lease == b.Lease &&
+		a.Util == b.Util &&
+		reflect.DeepEqual(a.Ranges, b.Ranges) &&
+		reflect.DeepEqual(a.Exclusions, b.Exclusions) &&
+		reflect.DeepEqual(a.DNS, b.DNS) &&
+		reflect.DeepEqual(a.DHCPOptions, b.DHCPOptions) &&
+		reflect.DeepEqual(a.Reservations, b.Reservations)
+}
+
+func SegmentConfigEqual(a, b *Segment) bool {
+	return a.Name == b.Name &&
+		a.Priority == b.Priority &&
+		a.DetectRule == b.DetectRule &&
+		a.DNSRandom == b.DNSRandom &&
+		a.Option82Echo == b.Option82Echo &&
+		a.RateLimit == b.RateLimit &&
+		a.Lease == b.Lease &&
+		a.Util == b.Util &&
+		SegmentAutoModeEqual(a, b)
+}
+
+func SegmentAutoModeEqual(a, b *Segment) bool {
+	return a.AutoMode == b.AutoMode &&
+		a.AutoModeMask == b.AutoModeMask &&
+		a.AutoModeRouter == b.AutoModeRouter &&
+		a.AutoModeLeaseTTL == b.AutoModeLeaseTTL &&
+		reflect.DeepEqual(a.AutoModeRanges, b.AutoModeRanges) &&
+		reflect.DeepEqual(a.AutoModeExclusions, b.AutoModeExclusions) &&
+		reflect.DeepEqual(a.AutoModeRoutes, b.AutoModeRoutes) &&
+		reflect.DeepEqual(a.AutoModeDNS, b.AutoModeDNS)
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Knetic/govaluate"
+)
+
+// How request matching several segments is handled
+const (
+	SEGMENT_MATCH_FIRST  = "first"  // Segment with the highest priority wins
+	SEGMENT_MATCH_UNIQUE = "unique" // Request is dropped
+)
+
+// Upper bound of sample inputs generated from one detect rule
+const SEGMENT_OVERLAP_SAMPLES = 256
+
+func (s *Segment) Evaluate(p map[string]interface{}) (bool, error) {
+	t, err := s.DetectExpression.Evaluate(p)
+	if err != nil {
+		return false, fmt.Errorf("Unable to evaluate expression: %s", err)
+	}
+
+	b, ok := t.(bool)
+	if !ok {
+		return false, errors.New("Expression result is not boolean")
+	}
+
+	return b, nil
+}
+
+// Orders segments by descending priority, then by id
+func SegmentsOrder(Segments map[int]*Segment) (Ordered []*Segment) {
+	for _, Seg := range Segments {
+		Ordered = append(Ordered, Seg)
+	}
+
+	sort.Slice(Ordered, func(i, j int) bool {
+		if Ordered[i].Priority != Ordered[j].Priority {
+			return Ordered[i].Priority > Ordered[j].Priority
+		}
+
+		return Ordered[i].Id < Ordered[j].Id
+	})
+
+	return
+}
+
+// Evaluates every rule against sample inputs built from literals of the other rules.
+// It can't prove that rules don't overlap, but found overlaps are real
+func SegmentsCheckOverlap(Ordered []*Segment, Match string) (Overlaps []string) {
+	Reported := map[[2]int]bool{}
+
+	for _, Seg := range Ordered {
+		for _, Sample := range SegmentSamples(Seg) {
+			var p map[string]interface{}
+
+			if ok, err := Seg.Match(Sample, &p); err != nil || !ok {
+				continue
+			}
+
+			for _, Other := range Ordered {
+				if Other == Seg || Reported[[2]int{Seg.Id, Other.Id}] {
+					continue
+				}
+
+				if ok, err := Other.Match(Sample, &p); err != nil || !ok {
+					continue
+				}
+
+				Reported[[2]int{Seg.Id, Other.Id}] = true
+				Reported[[2]int{Other.Id, Seg.Id}] = true
+
+				Result := "such requests are dropped"
+				if Match == SEGMENT_MATCH_FIRST {
+					for _, v := range Ordered {
+						if v == Seg || v == Other {
+							Result = fmt.Sprintf("'%s' is chosen", v.Name)
+							break
+						}
+					}
+				}
+
+				Overlaps = append(Overlaps, fmt.Sprintf("Segments '%s' and '%s' both match request with %s, %s",
+					Seg.Name, Other.Name, SegmentSampleString(Sample), Result))
+			}
+		}
+	}
+
+	return
+}
+
+// Builds request contexts from literals of the segment's rule: every numeric literal
+// is tried as RelayIP, RemoteIP & MAC combined with every string literal as all string attributes
+func SegmentSamples(Seg *Segment) (Samples []*ReqCtx) {
+	Numbers, Strings := []uint64{0}, []string{""}
+
+	for _, t := range Seg.DetectExpression.Tokens() {
+		switch t.Kind {
+		case govaluate.NUMERIC:
+			if v, ok := t.Value.(float64); ok && v >= 0 {
+				Numbers = append(Numbers, uint64(v))
+			}
+
+		case govaluate.STRING:
+			if v, ok := t.Value.(string); ok {
+				Strings = append(Strings, v)
+			}
+		}
+	}
+
+	for _, n := range Numbers {
+		for _, s := range Strings {
+			if len(Samples) == SEGMENT_OVERLAP_SAMPLES {
+				return
+			}
+
+			Samples = append(Samples, &ReqCtx{
+				RelayIP:      uint32(n),
+				RemoteIP:     uint32(n),
+				MAC:          n,
+				MACOUI:       s,
+				VendorClass:  s,
+				UserClass:    s,
+				Hostname:     s,
+				ClientID:     s,
+				CircuitID:    s,
+				RemoteID:     s,
+				SubscriberID: s,
+			})
+		}
+	}
+
+	return
+}
+
+func SegmentSampleString(c *ReqCtx) string {
+	var t []string
+
+	if c.MAC > 0 {
+		t = append(t, fmt.Sprintf("RelayIP/RemoteIP/MAC = %d", c.MAC))
+	}
+
+	if c.VendorClass != "" {
+		t = append(t, fmt.Sprintf("string attributes = '%s'", c.VendorClass))
+	}
+
+	if len(t) == 0 {
+		return "empty attributes"
+	}
+
+	return strings.Join(t, ", ")
+}
+
+// Natively compiled detect rule, used instead of govaluate expression when possible
+type SegmentMatcher func(c *ReqCtx) bool
+
+// Matches request against the segment, expression parameters are built into p only if needed
+func (s *Segment) Match(c *ReqCtx, p *map[string]interface{}) (bool, error) {
+	if s.Matcher != nil {
+		return s.Matcher(c), nil
+	}
+
+	if *p == nil {
+		*p = c.ExpressionParameters()
+	}
+
+	return s.Evaluate(*p)
+}
+
+// Numeric request attributes supported by compiled rules
+var segmentRuleVars = map[string]func(c *ReqCtx) uint64{
+	"RelayIP":  func(c *ReqCtx) uint64 { return uint64(c.RelayIP) },
+	"RemoteIP": func(c *ReqCtx) uint64 { return uint64(c.RemoteIP) },
+	"MAC":      func(c *ReqCtx) uint64 { return c.MAC },
+}
+
+// Compiles rules consisting of comparisons of RelayIP, RemoteIP & MAC with numbers,
+// InNetwork(), InRange(), '!', '&&', '||' and parentheses. Anything else is an error
+// and such rules are left to govaluate
+func SegmentRuleCompile(Rule string) (m SegmentMatcher, err error) {
+	p := &segmentRuleParser{}
+
+	if p.Tokens, err = segmentRuleTokenize(Rule); err != nil {
+		return
+	}
+
+	if m, err = p.Or(); err != nil {
+		return nil, err
+	}
+
+	if p.Pos != len(p.Tokens) {
+		return nil, fmt.Errorf("Unexpected '%s'", p.Tokens[p.Pos])
+	}
+
+	return
+}
+
+// Two-character operators
+func segmentRuleOperator(s string) bool {
+	switch s {
+	case "&&", "||", "==", "!=", ">=", "<=":
+		return true
+	}
+
+	return false
+}
+
+func segmentRuleTokenize(Rule string) (Tokens []string, err error) {
+	for i := 0; i < len(Rule); {
+		c := Rule[i]
+
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+
+		case c == '[':
+			j := strings.IndexByte(Rule[i:], ']')
+			if j < 0 {
+				return nil, errors.New("Unterminated '['")
+			}
+
+			Tokens = append(Tokens, Rule[i+1:i+j])
+			i += j + 1
+
+		case i+1 < len(Rule) && segmentRuleOperator(Rule[i:i+2]):
+			Tokens = append(Tokens, Rule[i:i+2])
+			i += 2
+
+		case strings.IndexByte("()!,<>", c) >= 0:
+			Tokens = append(Tokens, Rule[i:i+1])
+			i++
+
+		case c == '_' || c == '.' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			j := i
+			for ; j < len(Rule); j++ {
+				c = Rule[j]
+				if !(c == '_' || c == '.' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+					break
+				}
+			}
+
+			Tokens = append(Tokens, Rule[i:j])
+			i = j
+
+		default:
+			return nil, fmt.Errorf("Unsupported character '%c'", c)
+		}
+	}
+
+	return
+}
+
+type segmentRuleParser struct {
+	Tokens []string
+	Pos    int
+}
+
+func (p *segmentRuleParser) Peek() string {
+	if p.Pos < len(p.Tokens) {
+		return p.Tokens[p.Pos]
+	}
+
+	return ""
+}
+
+func (p *segmentRuleParser) Next() string {
+	t := p.Peek()
+	p.Pos++
+	return t
+}
+
+func (p *segmentRuleParser) Expect(t string) error {
+	if n := p.Next(); n != t {
+		return fmt.Errorf("Expected '%s', got '%s'", t, n)
+	}
+
+	return nil
+}
+
+func (p *segmentRuleParser) Or() (m SegmentMatcher, err error) {
+	if m, err = p.And(); err != nil {
+		return
+	}
+
+	for p.Peek() == "||" {
+		p.Next()
+
+		var r SegmentMatcher
+		if r, err = p.And(); err != nil {
+			return
+		}
+
+		l := m
+		m = func(c *ReqCtx) bool { return l(c) || r(c) }
+	}
+
+	return
+}
+
+func (p *segmentRuleParser) And() (m SegmentMatcher, err error) {
+	if m, err = p.Unary(); err != nil {
+		return
+	}
+
+	for p.Peek() == "&&" {
+		p.Next()
+
+		var r SegmentMatcher
+		if r, err = p.Unary(); err != nil {
+			return
+		}
+
+		l := m
+		m = func(c *ReqCtx) bool { return l(c) && r(c) }
+	}
+
+	return
+}
+
+func (p *segmentRuleParser) Unary() (m SegmentMatcher, err error) {
+	switch t := p.Peek(); t {
+	case "!":
+		p.Next()
+		if m, err = p.Unary(); err != nil {
+			return
+		}
+
+		n := m
+		return func(c *ReqCtx) bool { return !n(c) }, nil
+
+	case "(":
+		p.Next()
+		if m, err = p.Or(); err != nil {
+			return
+		}
+
+		return m, p.Expect(")")
+
+	case "InNetwork", "InRange":
+		return p.Function()
+	}
+
+	return p.Comparison()
+}
+
+func (p *segmentRuleParser) Variable() (func(c *ReqCtx) uint64, error) {
+	t := p.Next()
+	if v, ok := segmentRuleVars[t]; ok {
+		return v, nil
+	}
+
+	return nil, fmt.Errorf("Unsupported variable '%s'", t)
+}
+
+func (p *segmentRuleParser) Number() (uint64, error) {
+	t := p.Next()
+	n, err := strconv.ParseUint(t, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Unsupported number '%s'", t)
+	}
+
+	return n, nil
+}
+
+// Function(Variable, Number, Number)
+func (p *segmentRuleParser) Function() (m SegmentMatcher, err error) {
+	var (
+		Name string
+		v    func(c *ReqCtx) uint64
+		a, b uint64
+	)
+
+	Name = p.Next()
+	if err = p.Expect("("); err != nil {
+		return
+	}
+
+	if v, err = p.Variable(); err != nil {
+		return
+	}
+
+	if err = p.Expect(","); err != nil {
+		return
+	}
+
+	if a, err = p.Number(); err != nil {
+		return
+	}
+
+	if err = p.Expect(","); err != nil {
+		return
+	}
+
+	if b, err = p.Number(); err != nil {
+		return
+	}
+
+	if err = p.Expect(")"); err != nil {
+		return
+	}
+
+	if Name == "InNetwork" {
+		return func(c *ReqCtx) bool { return v(c)&b == a }, nil
+	}
+
+	return func(c *ReqCtx) bool { x := v(c); return x >= a && x <= b }, nil
+}
+
+// Variable op Number
+func (p *segmentRuleParser) Comparison() (m SegmentMatcher, err error) {
+	var (
+		v  func(c *ReqCtx) uint64
+		n  uint64
+		Op string
+	)
+
+	if v, err = p.Variable(); err != nil {
+		return
+	}
+
+	Op = p.Next()
+
+	if n, err = p.Number(); err != nil {
+		return
+	}
+
+	switch Op {
+	case "==":
+		m = func(c *ReqCtx) bool { return v(c) == n }
+	case "!=":
+		m = func(c *ReqCtx) bool { return v(c) != n }
+	case ">":
+		m = func(c *ReqCtx) bool { return v(c) > n }
+	case ">=":
+		m = func(c *ReqCtx) bool { return v(c) >= n }
+	case "<":
+		m = func(c *ReqCtx) bool { return v(c) < n }
+	case "<=":
+		m = func(c *ReqCtx) bool { return v(c) <= n }
+	default:
+		err = fmt.Errorf("Unsupported operator '%s'", Op)
+	}
+
+	return
+}
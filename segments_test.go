@@ -0,0 +1,112 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Knetic/govaluate"
+)
+
+func TestSegmentRuleTokenize(t *testing.T) {
+	for _, tt := range []struct {
+		Rule   string
+		Tokens string
+		Error  bool
+	}{
+		{"RelayIP==1", "RelayIP == 1", false},
+		{"!(MAC != 1) || RelayIP>=2&&RelayIP<=3", "! ( MAC != 1 ) || RelayIP >= 2 && RelayIP <= 3", false},
+		{"InNetwork([RelayIP], 167772160, 4294967040)", "InNetwork ( RelayIP , 167772160 , 4294967040 )", false},
+		{"RelayIP>1", "RelayIP > 1", false},
+
+		// Halves of operators aren't operators themselves
+		{"RelayIP & 1", "", true},
+		{"RelayIP | 1", "", true},
+		{"RelayIP = 1", "", true},
+		{"RelayIP =1", "", true},
+		{"RelayIP == 'a'", "", true},
+		{"[RelayIP", "", true},
+	} {
+		Tokens, err := segmentRuleTokenize(tt.Rule)
+		if (err != nil) != tt.Error {
+			t.Errorf("%s: error %v, expected error %t", tt.Rule, err, tt.Error)
+			continue
+		}
+
+		if s := strings.Join(Tokens, " "); !tt.Error && s != tt.Tokens {
+			t.Errorf("%s: tokens %s, expected %s", tt.Rule, s, tt.Tokens)
+		}
+	}
+}
+
+var TestSegmentRules = []string{
+	"RelayIP == 167772161",
+	"InNetwork(RelayIP, 167772160, 4294967040) && MAC != 1",
+	"InRange(RelayIP, 167772160, 167772415) || !(RemoteIP < 100 || RemoteIP >= 200)",
+}
+
+// Compiled rules give the same results as govaluate
+func TestSegmentRuleCompile(t *testing.T) {
+	for _, Rule := range TestSegmentRules {
+		m, err := SegmentRuleCompile(Rule)
+		if err != nil {
+			t.Fatalf("%s: %s", Rule, err)
+		}
+
+		Seg := &Segment{}
+		if Seg.DetectExpression, err = govaluate.NewEvaluableExpressionWithFunctions(Rule, goValuateFunctions); err != nil {
+			t.Fatalf("%s: %s", Rule, err)
+		}
+
+		for _, c := range []*ReqCtx{
+			{RelayIP: 167772161, MAC: 1},
+			{RelayIP: 167772161, MAC: 2},
+			{RelayIP: 167772416, RemoteIP: 150},
+			{RelayIP: 1, RemoteIP: 99},
+		} {
+			Expected, err := Seg.Evaluate(c.ExpressionParameters())
+			if err != nil {
+				t.Fatalf("%s: %s", Rule, err)
+			}
+
+			if m(c) != Expected {
+				t.Errorf("%s: compiled rule returns %t for %+v", Rule, !Expected, c)
+			}
+		}
+	}
+
+	for _, Rule := range []string{"Hostname == 'a'", "RelayIP = 1", "RelayIP == 1 &&", "(RelayIP == 1"} {
+		if _, err := SegmentRuleCompile(Rule); err == nil {
+			t.Errorf("%s: compiled without error", Rule)
+		}
+	}
+}
+
+func BenchmarkSegmentRule(b *testing.B) {
+	c := &ReqCtx{RelayIP: 167772161, RemoteIP: 150, MAC: 2}
+
+	for _, Rule := range TestSegmentRules {
+		Seg := &Segment{}
+		Seg.DetectExpression, _ = govaluate.NewEvaluableExpressionWithFunctions(Rule, goValuateFunctions)
+		Compiled, _ := SegmentRuleCompile(Rule)
+
+		b.Run("compiled/"+Rule, func(b *testing.B) {
+			var p map[string]interface{}
+			Seg.Matcher = Compiled
+
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				Seg.Match(c, &p)
+			}
+		})
+
+		b.Run("govaluate/"+Rule, func(b *testing.B) {
+			Seg.Matcher = nil
+
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var p map[string]interface{}
+				Seg.Match(c, &p)
+			}
+		})
+	}
+}
@@ -13,11 +13,13 @@ import (
 
 type StatsSegmentsStruct struct {
 	GenerationTime string                         `json:"generation_time"`
+	Latency        *StatsLatencyStruct            `json:"latency"`
 	Segments       map[string]*StatsSegmentStruct `json:"segments"`
 }
 
 type StatsSegmentStruct struct {
-	Name string `json:"name"`
+	Name    string           `json:"name"`
+	Latency HistogramSummary `json:"latency"`
 
 	Capacity      int `json:"capacity"`
 	LeasesActive  int `json:"leases_active"`
@@ -54,8 +56,10 @@ const (
 	STATS_RELAYIP_OPTION82
 	STATS_RELAYIP_GIADDR
 	STATS_RELAYIP_UNICAST
+	STATS_RELAYIP_INTERFACE
 
 	STATS_LEASE_EXISTING
+	STATS_LEASE_RESERVED
 	STATS_LEASE_RANDOM
 	STATS_LEASE_RANGE
 	STATS_LEASE_NO_FREE
@@ -63,10 +67,13 @@ const (
 	STATS_ERRORS_RELAYIP_NOT_FOUND
 	STATS_ERRORS_MALFORMED_PACKET
 	STATS_ERRORS_UNKNOWN_SEGMENT
+	STATS_ERRORS_AMBIGUOUS_SEGMENT
 	STATS_ERRORS_UNKNOWN_SUBNET
 	STATS_ERRORS_INCORRECT_SERVER
 	STATS_ERRORS_NO_REQUESTED_IP
 	STATS_ERRORS_CONCURRENT
+	STATS_ERRORS_OVERLOAD
+	STATS_ERRORS_RATE_LIMITED
 	STATS_ERRORS_OTHER
 
 	STATS_PACKETS_IN
@@ -90,9 +97,18 @@ var (
 		STATS_ERRORS_UNKNOWN_SEGMENT: &metrics.Item{
 			Description: "Errors [Unknown Segment]",
 		},
+		STATS_ERRORS_AMBIGUOUS_SEGMENT: &metrics.Item{
+			Description: "Errors [Ambiguous Segment]",
+		},
 		STATS_ERRORS_UNKNOWN_SUBNET: &metrics.Item{
 			Description: "Errors [Unknown Subnet]",
 		},
+		STATS_ERRORS_OVERLOAD: &metrics.Item{
+			Description: "Errors [Overload]",
+		},
+		STATS_ERRORS_RATE_LIMITED: &metrics.Item{
+			Description: "Errors [Rate Limited]",
+		},
 		STATS_ERRORS_OTHER: &metrics.Item{
 			Description: "Errors [Other]",
 		},
@@ -155,10 +171,16 @@ var (
 		STATS_RELAYIP_UNICAST: &metrics.Item{
 			Description: "Relay IP Source [Unicast]",
 		},
+		STATS_RELAYIP_INTERFACE: &metrics.Item{
+			Description: "Relay IP Source [Interface]",
+		},
 
 		STATS_LEASE_EXISTING: &metrics.Item{
 			Description: "Lease [Existing]",
 		},
+		STATS_LEASE_RESERVED: &metrics.Item{
+			Description: "Lease [Reserved]",
+		},
 		STATS_LEASE_RANDOM: &metrics.Item{
 			Description: "Lease [Random]",
 		},
@@ -178,6 +200,9 @@ var (
 		STATS_ERRORS_NO_REQUESTED_IP: &metrics.Item{
 			Description: "Errors [No RequestedIP]",
 		},
+		STATS_ERRORS_RATE_LIMITED: &metrics.Item{
+			Description: "Errors [Rate Limited]",
+		},
 		STATS_ERRORS_OTHER: &metrics.Item{
 			Description: "Errors [Other]",
 		},
@@ -214,10 +239,25 @@ func StatsDumpGlobal() (s string) {
 		s += fmt.Sprintf(" %s\n", r)
 	}
 
+	l := HistogramsLatency()
+	s += "Latency:\n"
+	s += fmt.Sprintf(" Total: %s\n", l.Total)
+	for _, t := range HistogramRequestTypes {
+		s += fmt.Sprintf(" Request [%s]: %s\n", t, l.Requests[t.String()])
+	}
+	for _, t := range HistogramResponses {
+		s += fmt.Sprintf(" Reply [%s]: %s\n", t, l.Responses[t.String()])
+	}
+	s += fmt.Sprintf(" Transaction [Discover -> ACK]: %s\n", l.Transactions)
+
 	return
 }
 
 func StatsDumpSegments() (s string) {
+	// Segments are swapped by ConfigReload
+	CacheReloadingMtx.RLock()
+	defer CacheReloadingMtx.RUnlock()
+
 	var (
 		Segments                  []int
 		Capacity, Active, Expired int
@@ -248,6 +288,7 @@ func StatsDumpSegments() (s string) {
 
 		Seg.RUnlock()
 
+		s += fmt.Sprintf(" Latency: %s\n", Seg.Latency.Summary())
 		for _, r := range strings.Split(Seg.Stats.Dump(), "\n") {
 			s += fmt.Sprintf(" %s\n", r)
 		}
@@ -257,6 +298,9 @@ func StatsDumpSegments() (s string) {
 }
 
 func StatsDumpSubnets() (s string) {
+	CacheReloadingMtx.RLock()
+	defer CacheReloadingMtx.RUnlock()
+
 	var Segments []int
 	for S := range o.Segments {
 		Segments = append(Segments, S)
@@ -295,8 +339,12 @@ func StatsDumpSubnets() (s string) {
 }
 
 func StatsDumpStruct() (Stats *StatsSegmentsStruct) {
+	CacheReloadingMtx.RLock()
+	defer CacheReloadingMtx.RUnlock()
+
 	TimeStart := time.Now()
 	Stats = &StatsSegmentsStruct{
+		Latency:  HistogramsLatency(),
 		Segments: map[string]*StatsSegmentStruct{},
 	}
 
@@ -311,6 +359,7 @@ func StatsDumpStruct() (Stats *StatsSegmentsStruct) {
 
 		StatsSeg := &StatsSegmentStruct{
 			Name:    Seg.Name,
+			Latency: Seg.Latency.Summary(),
 			Subnets: map[string]*StatsSubnetStruct{},
 			Stats:   Seg.Stats.DumpMap(),
 		}
@@ -350,6 +399,9 @@ func StatsDumpStruct() (Stats *StatsSegmentsStruct) {
 }
 
 func StatsDumpLeases() (s string) {
+	CacheReloadingMtx.RLock()
+	defer CacheReloadingMtx.RUnlock()
+
 	var b bytes.Buffer
 	w := tabwriter.NewWriter(&b, 0, 0, 3, ' ', 0)
 
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/binary"
 	aux "mt-aux"
 	"mt-aux/dhcp"
 	"mt-aux/maps"
@@ -10,6 +11,8 @@ import (
 	log "github.com/Sirupsen/logrus"
 )
 
+// Request context. Packet, RequestOptions, Option82Raw & Option82 point into the pooled request buffer,
+// they're cleared by GenerateReply and must not be kept anywhere which outlives the request
 type ReqCtx struct {
 	MAC    uint64
 	MACStr string
@@ -35,9 +38,11 @@ type ReqCtx struct {
 	NotFoundReason string
 	LeaseSource    string
 
-	Segment *Segment
-	Subnet  *Subnet
-	Lease   *Lease
+	Segment     *Segment
+	Subnet      *Subnet
+	Lease       *Lease
+	Reservation *Reservation
+	Class       *ClientClass
 
 	SegmentCopy *Segment
 	SubnetCopy  *Subnet
@@ -45,6 +50,18 @@ type ReqCtx struct {
 
 	ReplyOptions   []dhcp.Option
 	RequestOptions dhcp.Options
+	Option82Raw    []byte
+	Option82       map[uint8][]byte
+
+	// Attributes for class expressions
+	MACOUI       string
+	VendorClass  string
+	UserClass    string
+	Hostname     string
+	ClientID     string
+	CircuitID    string
+	RemoteID     string
+	SubscriberID string
 
 	Packet       *dhcp.Packet
 	ReqLockShard *maps.ConcurrentMapUint64Shard
@@ -104,6 +121,10 @@ func (c *ReqCtx) FillLogFields() {
 		c.LogF["subnet"] = c.Subnet.NetStr
 	}
 
+	if c.Class != nil {
+		c.LogF["class"] = c.Class.Name
+	}
+
 	if c.RequestDuration > 0 {
 		c.LogF["duration"] = c.RequestDuration.String()
 	}
@@ -174,36 +195,38 @@ func (c *ReqCtx) SetRemoteIP(IP net.IP) {
 	c.RemoteIPStr = IP.String()
 }
 
-func (c *ReqCtx) SegmentEvaluate() {
-	var (
-		ok, b bool
-		err   error
-		t     interface{}
-	)
+// Evaluates segments in order of priority, the first matching one is chosen.
+// With 'unique' segment_match all of them are evaluated, returns number of matches
+func (c *ReqCtx) SegmentEvaluate() (Matched int) {
+	// Built on demand, most of the rules are compiled
+	var p map[string]interface{}
 
-	p := map[string]interface{}{
-		"RemoteIP": c.RemoteIP,
-		"RelayIP":  c.RelayIP,
-	}
+	for _, v := range o.SegmentsOrdered {
+		ok, err := v.Match(c, &p)
+		if err != nil {
+			c.LogErrorf("Segment '%s': %s", v.Name, err)
+			continue
+		}
 
-	for _, v := range o.Segments {
-		if t, err = v.DetectExpression.Evaluate(p); err != nil {
-			c.LogErrorf("Unable to evaluate expression: %s", err)
+		if !ok {
 			continue
 		}
 
-		if b, ok = t.(bool); !ok {
-			c.LogErrorf("Expression result is not boolean")
+		if Matched++; Matched > 1 {
+			c.LogWarnf("Segment '%s' also matches", v.Name)
 			continue
 		}
 
-		if b {
-			c.Segment = v
-			c.SegmentCopy = &Segment{}
-			*c.SegmentCopy = *c.Segment
+		c.Segment = v
+		c.SegmentCopy = &Segment{}
+		*c.SegmentCopy = *c.Segment
+
+		if o.DHCPSegmentMatch == SEGMENT_MATCH_FIRST {
 			break
 		}
 	}
+
+	return
 }
 
 func (c *ReqCtx) ObtainRequestedIP() bool {
@@ -268,14 +291,13 @@ func (c *ReqCtx) ObtainSubnet() {
 	c.Segment.Subnets[c.Subnet.Net] = c.Subnet
 	c.Segment.Unlock()
 
-	if err := SubnetUploadToAerospike(c.Subnet, c.Segment); err != nil {
-		c.LogErrorf("Unable to upload subnet to Aerospike: %s", err)
+	if err := DHCPBackend.SubnetStore(c.Segment, c.Subnet); err != nil {
+		c.LogErrorf("Unable to store subnet: %s", err)
 	}
 
-	c.LogDebugf("Auto-Subnet %s generated (Range: %s - %s, Router: %s, Lease TTL: %s)",
+	c.LogDebugf("Auto-Subnet %s generated (Ranges: %s, Router: %s, Lease TTL: %s)",
 		c.Subnet.NetStr,
-		aux.IPIntToStr(c.Subnet.RangeStart),
-		aux.IPIntToStr(c.Subnet.RangeEnd),
+		IPRangesString(c.Subnet.Ranges),
 		aux.IPIntToStr(c.Subnet.Net+c.Segment.AutoModeRouter),
 		c.Subnet.LeaseTTL,
 	)
@@ -283,13 +305,92 @@ func (c *ReqCtx) ObtainSubnet() {
 out:
 	c.SubnetCopy = &Subnet{}
 	*c.SubnetCopy = *c.Subnet
+
+	// Reservations are immutable, no need to lock
+	c.Reservation = c.Subnet.Reservations[c.MAC]
+}
+
+func (c *ReqCtx) LeasePolicy() LeasePolicy {
+	return c.Segment.Lease.Merge(c.Subnet.Lease)
+}
+
+// Lease time for ACK: reservation's lease TTL overrides class's one which overrides subnet's one,
+// client's requested lease time is honored within policy bounds
+func (c *ReqCtx) LeaseTTL() (TTL time.Duration) {
+	switch {
+	case c.Reservation != nil && c.Reservation.LeaseTTL > 0:
+		TTL = c.Reservation.LeaseTTL
+	case c.Class != nil && c.Class.LeaseTTL > 0:
+		TTL = c.Class.LeaseTTL
+	default:
+		TTL = c.Subnet.LeaseTTL
+	}
+
+	p := c.LeasePolicy()
+	if p.Max <= 0 {
+		return
+	}
+
+	if v := c.RequestOptions[dhcp.OptionIPAddressLeaseTime]; len(v) == 4 {
+		TTL = time.Duration(binary.BigEndian.Uint32(v)) * time.Second
+
+		if TTL < p.Min {
+			TTL = p.Min
+		} else if TTL > p.Max {
+			TTL = p.Max
+		}
+	}
+
+	return
+}
+
+// Lease time for OFFER
+func (c *ReqCtx) OfferTTL() time.Duration {
+	if p := c.LeasePolicy(); p.OfferTTL > 0 {
+		return p.OfferTTL
+	}
+
+	return c.LeaseTTL()
+}
+
+// How long offered address is held for the client until it's bound by REQUEST,
+// offer_ttl if it's set, otherwise dhcp.grace_ttl as clients may never come back
+func (c *ReqCtx) OfferHoldTTL() time.Duration {
+	if p := c.LeasePolicy(); p.OfferTTL > 0 {
+		return p.OfferTTL
+	}
+
+	return o.DHCPGraceTTL
+}
+
+// Options to send in reply, reservation's options override class's ones
+// which override subnet's ones with the same code
+func (c *ReqCtx) DHCPOptions() (Options []dhcp.Option) {
+	var Lists [][]dhcp.Option
+
+	if c.Reservation != nil {
+		Lists = append(Lists, c.Reservation.DHCPOptions)
+	}
+
+	if c.Class != nil {
+		Lists = append(Lists, c.Class.Options)
+	}
+
+	Lists = append(Lists, c.Subnet.DHCPOptions)
+	return append(append(Options, c.ReplyOptions...), OptionsOverride(Lists...)...)
 }
 
 // Add DNS servers
 func (c *ReqCtx) AddDNS() {
 	var DNS []net.IP
 
-	if c.Subnet.Dynamic {
+	if c.Reservation != nil && len(c.Reservation.DNS) > 0 {
+		DNS = make([]net.IP, len(c.Reservation.DNS))
+		copy(DNS, c.Reservation.DNS)
+	} else if c.Class != nil && len(c.Class.DNS) > 0 {
+		DNS = make([]net.IP, len(c.Class.DNS))
+		copy(DNS, c.Class.DNS)
+	} else if c.Subnet.Dynamic {
 		DNS = make([]net.IP, len(c.Segment.AutoModeDNS))
 		copy(DNS, c.Segment.AutoModeDNS)
 	} else {
@@ -311,6 +412,18 @@ func (c *ReqCtx) AddDNS() {
 	}
 }
 
+// Relay Agent Information should be echoed back unchanged as the last option (RFC 3046)
+func (c *ReqCtx) RelayAgentOptions() []dhcp.Option {
+	if c.Option82Raw == nil || c.Segment == nil || !c.Segment.Option82Echo {
+		return nil
+	}
+
+	return []dhcp.Option{{
+		Code:  dhcp.OptionRelayAgentInformation,
+		Value: c.Option82Raw,
+	}}
+}
+
 func (c *ReqCtx) WorkStart() (ok bool) {
 	c.ReqLockShard = RequestLock.GetShard(c.MAC)
 
@@ -333,33 +446,65 @@ func (c *ReqCtx) WorkFinish() {
 	c.ReqLockShard.Unlock()
 }
 
+// Builds reply honoring client's Parameter Request List and Maximum Message Size
+func (c *ReqCtx) BuildReply(Response dhcp.MessageType, LeaseTTL time.Duration, Options []dhcp.Option) (Reply dhcp.Packet) {
+	var (
+		YIAddr  net.IP
+		Dropped []dhcp.OptionCode
+	)
+
+	Mandatory := []dhcp.Option{{
+		Code:  dhcp.OptionDHCPMessageType,
+		Value: []byte{byte(Response)},
+	}, {
+		Code:  dhcp.OptionServerIdentifier,
+		Value: aux.IPIntToNet(c.LocalIP).To4(),
+	}}
+
+	// NAK carries no address & lease information
+	if Response != dhcp.NAK {
+		YIAddr = aux.IPIntToNet(c.IP).To4()
+	}
+
+	// INFORM client has configured its address itself, ACK to it must not carry lease time (RFC 2131 4.3.5)
+	if Response != dhcp.NAK && c.DHCPRequest != dhcp.Inform {
+		p := c.LeasePolicy()
+		Mandatory = append(Mandatory, dhcp.Option{
+			Code:  dhcp.OptionIPAddressLeaseTime,
+			Value: dhcp.OptionsLeaseTime(LeaseTTL),
+		}, dhcp.Option{
+			Code:  dhcp.OptionRenewalTimeValue,
+			Value: dhcp.OptionsLeaseTime(time.Duration(float64(LeaseTTL) * p.T1)),
+		}, dhcp.Option{
+			Code:  dhcp.OptionRebindingTimeValue,
+			Value: dhcp.OptionsLeaseTime(time.Duration(float64(LeaseTTL) * p.T2)),
+		})
+	}
+
+	if Reply, Dropped = BuildReply(*c.Packet, c.RequestOptions, Mandatory, Options, c.RelayAgentOptions(), YIAddr); len(Dropped) > 0 {
+		c.LogWarnf("Options %v do not fit into reply, dropped", Dropped)
+	}
+
+	return
+}
+
 func (c *ReqCtx) GenerateReply(Response dhcp.MessageType) (Reply dhcp.Packet) {
 	c.RequestDuration = time.Since(c.RequestStart)
 	c.DHCPResponse = Response
+	c.HistogramsObserve()
 
 	switch c.DHCPResponse {
 	case dhcp.Offer:
 		c.StatsInc(STATS_REPLIES_OFFER)
-
-		Reply = dhcp.ReplyPacket(
-			*c.Packet, dhcp.Offer, aux.IPIntToNet(c.LocalIP).To4(), aux.IPIntToNet(c.IP).To4(),
-			c.Subnet.LeaseTTL, append(c.ReplyOptions, c.Subnet.DHCPOptions...),
-		)
+		Reply = c.BuildReply(dhcp.Offer, c.OfferTTL(), c.DHCPOptions())
 
 	case dhcp.ACK:
 		c.StatsInc(STATS_REPLIES_ACK)
-
-		Reply = dhcp.ReplyPacket(
-			*c.Packet, dhcp.ACK, aux.IPIntToNet(c.LocalIP).To4(), aux.IPIntToNet(c.IP).To4(),
-			c.Subnet.LeaseTTL, append(c.ReplyOptions, c.Subnet.DHCPOptions...),
-		)
+		Reply = c.BuildReply(dhcp.ACK, c.LeaseTTL(), c.DHCPOptions())
 
 	case dhcp.NAK:
 		c.StatsInc(STATS_REPLIES_NAK)
-
-		Reply = dhcp.ReplyPacket(
-			*c.Packet, dhcp.NAK, aux.IPIntToNet(c.LocalIP).To4(), nil, 0, nil,
-		)
+		Reply = c.BuildReply(dhcp.NAK, 0, nil)
 
 	case dhcp.Drop:
 		c.StatsInc(STATS_REPLIES_DROP)
@@ -378,6 +523,9 @@ func (c *ReqCtx) GenerateReply(Response dhcp.MessageType) (Reply dhcp.Packet) {
 
 	c.WorkFinish()
 
+	// Request buffer is reused by the next packet once the reply is sent
+	c.Packet, c.RequestOptions, c.Option82Raw, c.Option82 = nil, nil, nil, nil
+
 	go MetricsSendDHCPRequest(c)
 	c.LogInfof("")
 	return Reply
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"mt-aux/dhcp"
+	"net"
+	"testing"
+	"time"
+)
+
+// Option 82 with Circuit-ID & Link-Selection pointing to the test subnet
+var TestOption82 = []byte{
+	1, 4, 'e', 't', 'h', '0',
+	dhcp.Option82LinkSelection, 4, 10, 0, 0, 1,
+}
+
+func TestRelayAgentInformationEcho(t *testing.T) {
+	Tests := []struct {
+		Name     string
+		Option82 []byte
+		Echo     bool
+		Expected []byte
+	}{
+		{"no_option82", nil, true, nil},
+		{"option82_echo", TestOption82, true, TestOption82},
+		{"option82_no_echo", TestOption82, false, nil},
+	}
+
+	for _, tt := range Tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			s := NewTestServer(t)
+			s.Segment.Option82Echo = tt.Echo
+
+			var Options []dhcp.Option
+			if tt.Option82 != nil {
+				Options = append(Options, dhcp.Option{Code: dhcp.OptionRelayAgentInformation, Value: tt.Option82})
+			}
+
+			p := RelayedRequest(dhcp.Discover, 0x020000000001, Options...)
+			Reply, _ := DHCPHandleRequest(p, dhcp.Discover, p.ParseOptions(), s.Listener, net.ParseIP(TEST_RELAY_IP))
+			if Reply == nil {
+				t.Fatalf("No reply to DISCOVER")
+			}
+
+			// Request buffer is reused by the next packet
+			for i := range p {
+				p[i] = 0xff
+			}
+
+			Opts, Order := DecodeReply(t, Reply)
+			Value, ok := Opts[dhcp.OptionRelayAgentInformation]
+
+			if tt.Expected == nil {
+				if ok {
+					t.Fatalf("Relay Agent Information is in reply: %x", Value)
+				}
+				return
+			}
+
+			if !bytes.Equal(Value, tt.Expected) {
+				t.Fatalf("Relay Agent Information %x, expected unchanged %x", Value, tt.Expected)
+			}
+
+			// RFC 3046 2.1: the option must be the last one in the reply
+			if Order[len(Order)-1] != dhcp.OptionRelayAgentInformation {
+				t.Fatalf("Relay Agent Information is not the last option: %v", Order)
+			}
+		})
+	}
+}
+
+func TestRelayAgentInformationLinkSelection(t *testing.T) {
+	s := NewTestServer(t)
+
+	// Malformed Link-Selection drops the request
+	p := RelayedRequest(dhcp.Discover, 0x020000000001, dhcp.Option{
+		Code:  dhcp.OptionRelayAgentInformation,
+		Value: []byte{dhcp.Option82LinkSelection, 2, 10, 0},
+	})
+
+	if Reply, _ := DHCPHandleRequest(p, dhcp.Discover, p.ParseOptions(), s.Listener, net.ParseIP(TEST_RELAY_IP)); Reply != nil {
+		t.Fatalf("Request with malformed Link-Selection was answered")
+	}
+
+	// Link-Selection takes precedence over giaddr
+	p = RelayedRequest(dhcp.Discover, 0x020000000001, dhcp.Option{Code: dhcp.OptionRelayAgentInformation, Value: TestOption82})
+	p.SetGIAddr(net.IPv4(192, 168, 0, 1).To4())
+
+	Reply, _ := DHCPHandleRequest(p, dhcp.Discover, p.ParseOptions(), s.Listener, net.ParseIP(TEST_RELAY_IP))
+	if Reply == nil {
+		t.Fatalf("No reply to DISCOVER with Link-Selection")
+	}
+
+	if IP := Reply.YIAddr(); IP.Mask(net.CIDRMask(24, 32)).String() != "10.0.0.0" {
+		t.Fatalf("Offered address %s is not from Link-Selection subnet", IP)
+	}
+}
+
+// Client's lease time is clamped to the policy bounds, T1/T2 follow it, INFORM gets none of them
+func TestReplyLeaseTime(t *testing.T) {
+	for _, tt := range []struct {
+		Name      string
+		Request   dhcp.MessageType
+		Requested time.Duration
+		Expected  time.Duration
+	}{
+		{"subnet_ttl", dhcp.Request, 0, TEST_LEASE_TTL},
+		{"requested", dhcp.Request, 2 * time.Hour, 2 * time.Hour},
+		{"below_min", dhcp.Request, time.Minute, 5 * time.Minute},
+		{"above_max", dhcp.Request, 48 * time.Hour, 24 * time.Hour},
+		{"inform", dhcp.Inform, 2 * time.Hour, 0},
+	} {
+		t.Run(tt.Name, func(t *testing.T) {
+			s := NewTestServer(t)
+			s.Segment.Lease = LeasePolicy{Min: 5 * time.Minute, Max: 24 * time.Hour, T1: 0.5, T2: 0.875}
+
+			var Options []dhcp.Option
+			if tt.Requested > 0 {
+				Options = append(Options, dhcp.Option{Code: dhcp.OptionIPAddressLeaseTime, Value: dhcp.OptionsLeaseTime(tt.Requested)})
+			}
+
+			p := RelayedRequest(tt.Request, 0x020000000001, Options...)
+			c := NewTestCtx(s.Segment, s.Subnet, 0x020000000001, tt.Request)
+			c.Packet, c.RequestOptions = &p, p.ParseOptions()
+			if tt.Request != dhcp.Inform {
+				c.SetRequestedIP(s.Subnet.RangeStart)
+			}
+
+			Opts, _ := DecodeReply(t, c.GenerateReply(dhcp.ACK))
+
+			for _, Option := range []struct {
+				Code  dhcp.OptionCode
+				Ratio float64
+			}{
+				{dhcp.OptionIPAddressLeaseTime, 1},
+				{dhcp.OptionRenewalTimeValue, 0.5},
+				{dhcp.OptionRebindingTimeValue, 0.875},
+			} {
+				Value, ok := Opts[Option.Code]
+				if tt.Expected == 0 {
+					if ok {
+						t.Fatalf("Option %d is in reply", Option.Code)
+					}
+					continue
+				}
+
+				Expected := uint32(tt.Expected.Seconds() * Option.Ratio)
+				if len(Value) != 4 || binary.BigEndian.Uint32(Value) != Expected {
+					t.Fatalf("Option %d is %x, expected %d", Option.Code, Value, Expected)
+				}
+			}
+		})
+	}
+}
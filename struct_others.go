@@ -1,10 +1,13 @@
 package main
 
 import (
+	"fmt"
 	"math"
+	aux "mt-aux"
 	"mt-aux/dhcp"
 	"mt-aux/metrics"
 	"net"
+	"strings"
 	"sync"
 	"time"
 
@@ -17,6 +20,7 @@ type Lease struct {
 	Expires      time.Time
 	Discover     bool
 	DiscoverTime time.Time
+	Bound        bool // ACKed to the client, its expiration is reported as lease event
 }
 
 func (l *Lease) Expired() bool {
@@ -36,16 +40,152 @@ func (l *Lease) TxDuration() time.Duration {
 	return time.Since(l.DiscoverTime)
 }
 
+type IPRange struct {
+	Start uint32
+	End   uint32
+}
+
+func (r IPRange) Contains(ip uint32) bool {
+	return ip >= r.Start && ip <= r.End
+}
+
+func (r IPRange) Size() int {
+	return int(r.End) - int(r.Start) + 1
+}
+
+func (r IPRange) Offset(Base uint32) IPRange {
+	return IPRange{Start: Base + r.Start, End: Base + r.End}
+}
+
+func (r IPRange) String() string {
+	if r.Start == r.End {
+		return aux.IPIntToStr(r.Start)
+	}
+
+	return aux.IPIntToStr(r.Start) + " - " + aux.IPIntToStr(r.End)
+}
+
+// Parses either 'a.b.c.d-e.f.g.h' or a single address
+func ParseIPRange(s string) (r IPRange, err error) {
+	t := strings.SplitN(s, "-", 2)
+
+	if r.Start = aux.IPStrToInt(strings.TrimSpace(t[0])); len(t) == 1 {
+		r.End = r.Start
+	} else {
+		r.End = aux.IPStrToInt(strings.TrimSpace(t[1]))
+	}
+
+	if r.End < r.Start {
+		err = fmt.Errorf("Wrong IP range '%s'", s)
+	}
+
+	return
+}
+
+func IPRangesContain(Ranges []IPRange, ip uint32) bool {
+	for _, r := range Ranges {
+		if r.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func IPRangesString(Ranges []IPRange) string {
+	var t []string
+	for _, r := range Ranges {
+		t = append(t, r.String())
+	}
+
+	return strings.Join(t, ", ")
+}
+
+// Lease time negotiation, zero fields of subnet's policy are inherited from segment's one
+type LeasePolicy struct {
+	Min      time.Duration // Bounds for lease time requested by client (option 51),
+	Max      time.Duration // requests are ignored if Max is not set
+	OfferTTL time.Duration // Lease time advertised in OFFER, same as in ACK if not set
+
+	T1 float64 // Renewal (option 58) and rebinding (option 59) times as fractions of lease time
+	T2 float64
+}
+
+func (p LeasePolicy) Merge(Override LeasePolicy) LeasePolicy {
+	if Override.Min > 0 {
+		p.Min = Override.Min
+	}
+
+	if Override.Max > 0 {
+		p.Max = Override.Max
+	}
+
+	if Override.OfferTTL > 0 {
+		p.OfferTTL = Override.OfferTTL
+	}
+
+	if Override.T1 > 0 {
+		p.T1 = Override.T1
+	}
+
+	if Override.T2 > 0 {
+		p.T2 = Override.T2
+	}
+
+	return p
+}
+
+func (p LeasePolicy) Validate() error {
+	if p.Max > 0 && p.Min > p.Max {
+		return fmt.Errorf("lease_ttl_min (%s) is greater than lease_ttl_max (%s)", p.Min, p.Max)
+	}
+
+	if p.T1 <= 0 || p.T2 >= 1 || p.T1 >= p.T2 {
+		return fmt.Errorf("t1_ratio (%g) and t2_ratio (%g) should satisfy 0 < t1 < t2 < 1", p.T1, p.T2)
+	}
+
+	return nil
+}
+
+func (p LeasePolicy) String() string {
+	s := fmt.Sprintf("T1 %g, T2 %g", p.T1, p.T2)
+
+	if p.Max > 0 {
+		s += fmt.Sprintf(", client requests within %s - %s", p.Min, p.Max)
+	}
+
+	if p.OfferTTL > 0 {
+		s += fmt.Sprintf(", offer %s", p.OfferTTL)
+	}
+
+	return s
+}
+
+// Static MAC -> IP binding with optional per-host options
+type Reservation struct {
+	MAC uint64
+	IP  uint32
+
+	LeaseTTL    time.Duration
+	DNS         []net.IP
+	DHCPOptions []dhcp.Option
+}
+
 type Subnet struct {
 	Dynamic bool
 
 	Net        uint32
 	NetStr     string
 	Mask       uint32
-	RangeStart uint32
+	RangeStart uint32 // Bounds of all pool ranges
 	RangeEnd   uint32
 	Router     uint32
 	LeaseTTL   time.Duration
+	Lease      LeasePolicy
+
+	Ranges        []IPRange
+	Exclusions    []IPRange
+	CapacityCount int
 
 	DNS    []net.IP
 	DNSStr []string
@@ -55,15 +195,90 @@ type Subnet struct {
 	LeasesByIP  map[uint32]*Lease
 	LeasesByMAC map[uint64]*Lease
 
+	// Loaded once with the subnet and never modified afterwards
+	Reservations   map[uint64]*Reservation
+	ReservationsIP map[uint32]*Reservation
+
+	// Addresses in range occupied by non-expired leases, reserved, excluded or outside of pool ranges
+	Used *IPBitmap
+
 	LeasesActiveCount  int
 	LeasesExpiredCount int
 
+	// Earliest expiration among leases holding their addresses, zero if unknown.
+	// Expired leases aren't searched for before that
+	ExpiresNext time.Time
+
+	Util       UtilThresholds
+	AlertLevel UtilLevel
+	NoFreeLast int64 // Unix nanoseconds, accessed atomically
+
 	Stats *metrics.Stats
 	sync.RWMutex
 }
 
 func (s *Subnet) Capacity() int {
-	return int(s.RangeEnd) - int(s.RangeStart) + 1
+	return s.CapacityCount
+}
+
+// Builds the pool bitmap from ranges and exclusions, addresses in between the ranges
+// and excluded ones are marked as permanently occupied
+func (s *Subnet) PoolInit() {
+	if len(s.Ranges) == 0 {
+		s.Ranges = []IPRange{{Start: s.RangeStart, End: s.RangeEnd}}
+	}
+
+	s.RangeStart, s.RangeEnd = s.Ranges[0].Start, s.Ranges[0].End
+	for _, r := range s.Ranges {
+		if r.Start < s.RangeStart {
+			s.RangeStart = r.Start
+		}
+
+		if r.End > s.RangeEnd {
+			s.RangeEnd = r.End
+		}
+	}
+
+	s.Used = NewIPBitmap(s.RangeStart, s.RangeEnd)
+	for ip := uint64(s.RangeStart); ip <= uint64(s.RangeEnd); ip++ {
+		if !s.AddrAllowed(uint32(ip)) {
+			s.Used.Set(uint32(ip))
+		}
+	}
+
+	s.CapacityCount = s.Used.Size() - s.Used.Count
+}
+
+// Checks if address belongs to the pool ranges and is not excluded
+func (s *Subnet) AddrAllowed(ip uint32) bool {
+	for _, r := range s.Exclusions {
+		if r.Contains(ip) {
+			return false
+		}
+	}
+
+	for _, r := range s.Ranges {
+		if r.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Marks address as occupied in the pool (assumes locked subnet)
+func (s *Subnet) AddrUse(ip uint32) {
+	s.Used.Set(ip)
+}
+
+// Returns address back to the pool (assumes locked subnet)
+func (s *Subnet) AddrRelease(ip uint32) {
+	// Reserved and excluded addresses never return to the pool
+	if _, ok := s.ReservationsIP[ip]; ok || !s.AddrAllowed(ip) {
+		return
+	}
+
+	s.Used.Clear(ip)
 }
 
 func (s *Subnet) LeasesActive() int {
@@ -84,19 +299,74 @@ func (s *Subnet) UpdateStats() {
 	s.Unlock()
 }
 
-func (s *Subnet) UpdateStatsNoLock() {
+// Also returns addresses of expired leases to the pool,
+// they're still kept in maps until cleaned up to be reused by the same MAC.
+// Returns copies of bound leases which have expired since the last call
+func (s *Subnet) UpdateStatsNoLock() (Unbound []Lease) {
 	s.LeasesActiveCount = 0
 	s.LeasesExpiredCount = 0
+	s.ExpiresNext = time.Time{}
+
 	for _, Lease := range s.LeasesByIP {
 		if Lease.Expired() {
 			s.LeasesExpiredCount++
+			s.AddrRelease(Lease.IP)
+
+			if Lease.Bound {
+				Lease.Bound = false
+				Unbound = append(Unbound, *Lease)
+			}
 		} else {
 			s.LeasesActiveCount++
+			s.ExpiresNextUpdate(Lease.Expires)
 		}
 	}
+
+	return
 }
 
-func (s *Subnet) CleanupExpired() (ExpiredMAC, ExpiredIP int) {
+// Sets lease's expiration (assumes locked subnet)
+func (s *Subnet) LeaseExpiresSet(l *Lease, Expires time.Time) {
+	l.Expires = Expires
+
+	// Unknown one stays unknown until the next scan
+	if !s.ExpiresNext.IsZero() {
+		s.ExpiresNextUpdate(Expires)
+	}
+}
+
+func (s *Subnet) ExpiresNextUpdate(Expires time.Time) {
+	if s.ExpiresNext.IsZero() || Expires.Before(s.ExpiresNext) {
+		s.ExpiresNext = Expires
+	}
+}
+
+// Returns addresses of leases expired since the last scan to the pool (assumes locked subnet).
+// Leases are scanned only if some of them could have expired
+func (s *Subnet) ReleaseExpiredNoLock() (Released int) {
+	if !s.ExpiresNext.IsZero() && time.Now().Before(s.ExpiresNext) {
+		return
+	}
+
+	s.ExpiresNext = time.Time{}
+	for _, Lease := range s.LeasesByIP {
+		if !Lease.Expired() {
+			s.ExpiresNextUpdate(Lease.Expires)
+			continue
+		}
+
+		if s.Used.IsSet(Lease.IP) {
+			s.AddrRelease(Lease.IP)
+			Released++
+		}
+	}
+
+	return
+}
+
+// Deletes leases expired more than dhcp.cleanup_age ago, returns the number of them
+// deleted by MAC and the ones deleted from LeasesByIP
+func (s *Subnet) CleanupExpired() (ExpiredMAC int, Removed []*Lease) {
 	var (
 		Lease *Lease
 		ok    bool
@@ -110,8 +380,9 @@ func (s *Subnet) CleanupExpired() (ExpiredMAC, ExpiredIP int) {
 
 			// Check if the corresponding lease is in LeasesByIP and delete it also
 			if Lease, ok = s.LeasesByIP[l.IP]; ok && Lease.MAC == l.MAC {
-				ExpiredIP++
+				Removed = append(Removed, Lease)
 				delete(s.LeasesByIP, l.IP)
+				s.AddrRelease(l.IP)
 			}
 		}
 	}
@@ -129,19 +400,28 @@ func (s *Subnet) StatsInit() {
 }
 
 type Segment struct {
-	Id   int
-	Name string
+	Id       int
+	Name     string
+	Priority int // Segments with higher priority are evaluated first
 
 	DetectRule       string
 	DetectExpression *govaluate.EvaluableExpression
+	Matcher          SegmentMatcher // Compiled DetectRule, nil if it's not supported
 
-	DNSRandom bool
+	DNSRandom    bool
+	Option82Echo bool
+	RateLimit    RateLimits
+	Lease        LeasePolicy
+	Util         UtilThresholds
 
 	AutoMode           bool
 	AutoModeMask       uint32
 	AutoModeRangeStart uint32
 	AutoModeRangeEnd   uint32
+	AutoModeRanges     []IPRange // Relative to the generated network
+	AutoModeExclusions []IPRange
 	AutoModeRouter     uint32
+	AutoModeRoutes     []ClasslessRoute // Gateways are relative to the generated network
 	AutoModeDNS        []net.IP
 	AutoModeLeaseTTL   time.Duration
 
@@ -152,7 +432,8 @@ type Segment struct {
 	LeasesActive  int
 	LeasesExpired int
 
-	Stats *metrics.Stats
+	Stats   *metrics.Stats
+	Latency *Histogram
 	sync.RWMutex
 }
 
@@ -162,6 +443,7 @@ func (s *Segment) StatsInit() {
 	}
 
 	s.Stats.Init()
+	s.Latency = NewHistogram(HistogramBucketsRequest)
 }
 
 func (s *Segment) DeleteDynamicSubnets() {
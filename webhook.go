@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	WEBHOOK_QUEUE_SIZE = 1000
+	WEBHOOK_BACKOFF    = time.Second // Doubled after each failed attempt
+)
+
+// Posts events as JSON from its own goroutine, failed posts are retried with exponential backoff.
+// Events are dropped if the queue is full
+type Webhook struct {
+	Name    string
+	URL     string
+	Retries int
+	Client  *http.Client
+	Queue   chan interface{}
+	Dropped uint64
+}
+
+func NewWebhook(Name, URL string, Timeout time.Duration, Retries int) (w *Webhook) {
+	w = &Webhook{
+		Name:    Name,
+		URL:     URL,
+		Retries: Retries,
+		Client:  &http.Client{Timeout: Timeout},
+		Queue:   make(chan interface{}, WEBHOOK_QUEUE_SIZE),
+	}
+
+	go w.Worker()
+	return
+}
+
+func (w *Webhook) Send(Event interface{}) {
+	select {
+	case w.Queue <- Event:
+	default:
+		if atomic.AddUint64(&w.Dropped, 1)%100 == 1 {
+			log.Errorf("Webhook '%s': queue is full, %d events dropped so far", w.Name, atomic.LoadUint64(&w.Dropped))
+		}
+	}
+}
+
+func (w *Webhook) Worker() {
+	for Event := range w.Queue {
+		js, err := json.Marshal(Event)
+		if err != nil {
+			log.Errorf("Webhook '%s': unable to marshal event: %s", w.Name, err)
+			continue
+		}
+
+		Backoff := WEBHOOK_BACKOFF
+		for Try := 0; ; Try++ {
+			if err = w.Post(js); err == nil {
+				break
+			}
+
+			if Try >= w.Retries {
+				log.Errorf("Webhook '%s': giving up after %d tries: %s", w.Name, Try+1, err)
+				break
+			}
+
+			log.Warnf("Webhook '%s': %s, retrying in %s", w.Name, err, Backoff)
+			time.Sleep(Backoff)
+			Backoff *= 2
+		}
+	}
+}
+
+func (w *Webhook) Post(js []byte) (err error) {
+	var r *http.Response
+	if r, err = w.Client.Post(w.URL, "application/json", bytes.NewReader(js)); err != nil {
+		return
+	}
+	r.Body.Close()
+
+	if r.StatusCode/100 != 2 {
+		err = fmt.Errorf("HTTP status %s", r.Status)
+	}
+
+	return
+}